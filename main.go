@@ -4,17 +4,39 @@ import (
 	"fmt"
 	"github.com/PapiCZ/kiv_zos/shell"
 	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
 	"github.com/abiosoft/ishell"
 	"os"
+	"sync"
 )
 
 func main() {
+	volumePath := ""
+	useBackupSuperblock := false
+	upgrade := false
+	for _, arg := range os.Args[1:] {
+		if arg == "--use-backup-superblock" {
+			useBackupSuperblock = true
+		} else if arg == "--upgrade" {
+			upgrade = true
+		} else {
+			volumePath = arg
+		}
+	}
+	if volumePath == "" {
+		fmt.Println("usage: kiv_zos [--use-backup-superblock] [--upgrade] volume")
+		return
+	}
+
 	s := ishell.New()
 	s.SetPrompt("/ > ")
 	s.Set("shell", s)
-	s.Set("volume_path", os.Args[1])
+	s.Set("volume_path", volumePath)
 	s.Set("fs", &vfs.Filesystem{})
 	s.Set("s", s)
+	// Commands and background scrub use the filesystem while holding the lock
+	s.Set("lock", &sync.Mutex{})
+	s.Set("scrub", new(*vfsapi.BackgroundScrub))
 
 	path := s.Get("volume_path").(string)
 	_, err := os.Stat(path)
@@ -25,111 +47,222 @@ func main() {
 			fmt.Println(err)
 		}
 
-		// Read superblock
-		var sb vfs.Superblock
-		err = volume.ReadStruct(0, &sb)
+		// Read superblock and create filesystem
+		var fs vfs.Filesystem
+		if useBackupSuperblock {
+			fs, err = vfs.LoadFilesystemFromBackup(volume)
+		} else if upgrade {
+			fs, err = vfs.UpgradeFilesystem(volume)
+		} else {
+			fs, err = vfs.LoadFilesystem(volume)
+		}
 		if err != nil {
 			fmt.Println(err)
+			if _, ok := err.(vfs.OutdatedFormatVersion); ok {
+				fmt.Println("volume can be upgraded with --upgrade, make a copy of it first")
+			} else if !useBackupSuperblock {
+				fmt.Println("damaged superblock can be loaded from backup with --use-backup-superblock")
+			}
+			return
+		}
+		if useBackupSuperblock {
+			fmt.Println("superblock was loaded from backup, damaged copies are restored")
+		}
+		if upgrade {
+			fmt.Printf("volume uses format version %d\n", vfs.FormatVersion)
+		}
+		if fs.Superblock.State == vfs.StateResizing {
+			// Journal mustn't be replayed over partly moved regions either
+			fmt.Println(vfs.ResizeInterrupted{})
 			return
 		}
 
-		// Create filesystem
-		fs := vfs.NewFilesystemFromSuperblock(volume, sb)
+		// Finish operations interrupted by crash
+		replayed, err := vfs.ReplayJournal(fs.Volume, fs.Superblock)
+		if _, ok := err.(vfs.TornJournalRecord); ok {
+			fmt.Println(err)
+		} else if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if replayed {
+			fmt.Println("unfinished transaction was replayed from journal")
+		}
+
+		// Volume stays dirty until the shell is exited
+		wasDirty, err := fs.Mount()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if wasDirty {
+			fmt.Println("WARNING: volume wasn't unmounted cleanly, checking filesystem")
+			report, err := vfsapi.CheckFilesystem(fs, false)
+			for _, problem := range report.Problems {
+				fmt.Println(problem)
+			}
+			if err != nil {
+				fmt.Println(err)
+			} else if len(report.Problems) > 0 {
+				fmt.Println("use check --repair to fix the problems")
+			}
+		}
 
 		*(s.Get("fs").(*vfs.Filesystem)) = fs
 	}
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "format",
-		Func:      shell.Format,
+		Func:      shell.Locked(shell.Format),
+		Completer: nil,
+	})
+
+	s.AddCmd(&ishell.Cmd{
+		Name:      "resize",
+		Func:      shell.Locked(shell.Resize),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "mkdir",
-		Func:      shell.Mkdir,
+		Func:      shell.Locked(shell.Mkdir),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "ls",
-		Func:      shell.Ls,
+		Func:      shell.Locked(shell.Ls),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "rmdir",
-		Func:      shell.Rmdir,
+		Func:      shell.Locked(shell.Rmdir),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "rm",
-		Func:      shell.Rm,
+		Func:      shell.Locked(shell.Rm),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "badrm",
-		Func:      shell.Badrm,
+		Func:      shell.Locked(shell.Badrm),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "mv",
-		Func:      shell.Mv,
+		Func:      shell.Locked(shell.Mv),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "cd",
-		Func:      shell.Cd,
+		Func:      shell.Locked(shell.Cd),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "cp",
-		Func:      shell.Cp,
+		Func:      shell.Locked(shell.Cp),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "incp",
-		Func:      shell.Incp,
+		Func:      shell.Locked(shell.Incp),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "outcp",
-		Func:      shell.Outcp,
+		Func:      shell.Locked(shell.Outcp),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "pwd",
-		Func:      shell.Pwd,
+		Func:      shell.Locked(shell.Pwd),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "cat",
-		Func:      shell.Cat,
+		Func:      shell.Locked(shell.Cat),
 		Completer: nil,
 	})
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "info",
-		Func:      shell.Info,
+		Func:      shell.Locked(shell.Info),
 		Completer: nil,
 	})
 
 
 	s.AddCmd(&ishell.Cmd{
 		Name:      "check",
-		Func:      shell.Check,
+		Func:      shell.Locked(shell.Check),
 		Completer: nil,
 	})
 
+	s.AddCmd(&ishell.Cmd{
+		Name:      "scrub",
+		Func:      shell.Locked(shell.Scrub),
+		Completer: nil,
+	})
+
+	s.AddCmd(&ishell.Cmd{
+		Name:      "ln",
+		Func:      shell.Locked(shell.Ln),
+		Completer: nil,
+	})
+
+	s.AddCmd(&ishell.Cmd{
+		Name:      "setxattr",
+		Func:      shell.Locked(shell.Setxattr),
+		Completer: nil,
+	})
+
+	s.AddCmd(&ishell.Cmd{
+		Name:      "getxattr",
+		Func:      shell.Locked(shell.Getxattr),
+		Completer: nil,
+	})
+
+	s.AddCmd(&ishell.Cmd{
+		Name:      "lsxattr",
+		Func:      shell.Locked(shell.Lsxattr),
+		Completer: nil,
+	})
+
+	s.AddCmd(&ishell.Cmd{
+		Name:      "rmxattr",
+		Func:      shell.Locked(shell.Rmxattr),
+		Completer: nil,
+	})
+
+	s.AddCmd(&ishell.Cmd{
+		Name:      "chmod",
+		Func:      shell.Locked(shell.Chmod),
+		Completer: nil,
+	})
+
+	s.AddCmd(&ishell.Cmd{
+		Name:      "chown",
+		Func:      shell.Locked(shell.Chown),
+		Completer: nil,
+	})
+
+	s.AddCmd(&ishell.Cmd{
+		Name:      "su",
+		Func:      shell.Locked(shell.Su),
+		Completer: nil,
+	})
+
+	// Nested commands take the lock themselves
 	s.AddCmd(&ishell.Cmd{
 		Name:      "load",
 		Func:      shell.Load,
@@ -137,4 +270,17 @@ func main() {
 	})
 
 	s.Run()
+
+	if scrub := *s.Get("scrub").(**vfsapi.BackgroundScrub); scrub != nil {
+		scrub.Cancel()
+		scrub.Wait()
+	}
+
+	fs := s.Get("fs").(*vfs.Filesystem)
+	if fs.Volume != nil {
+		err := fs.Unmount()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
 }
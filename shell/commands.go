@@ -11,33 +11,109 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-func Format(c *ishell.Context) {
-	if len(c.Args) != 1 {
-		c.Println("expected 1 argument")
-		return
+// parseSize parses number with optional kb, mb or gb unit
+func parseSize(arg string) (vfs.VolumePtr, error) {
+	re := regexp.MustCompile("^(?P<value>\\d+)(?P<unit>.{0,2})$")
+	submatch := re.FindStringSubmatch(arg)
+	if submatch == nil {
+		return 0, fmt.Errorf("invalid size %s", arg)
 	}
 
-	re := regexp.MustCompile("(?P<value>\\d+)(?P<unit>.{0,2})")
-	submatch := re.FindStringSubmatch(c.Args[0])
-
 	value, err := strconv.Atoi(submatch[1])
 	if err != nil {
-		c.Err(err)
+		return 0, err
 	}
 	unit := strings.ToLower(submatch[2])
 
-	var size vfs.VolumePtr
 	switch unit {
 	case "kb":
-		size = vfs.VolumePtr(value * 1e3)
+		return vfs.VolumePtr(value * 1e3), nil
 	case "mb":
-		size = vfs.VolumePtr(value * 1e6)
+		return vfs.VolumePtr(value * 1e6), nil
 	case "gb":
-		size = vfs.VolumePtr(value * 1e9)
+		return vfs.VolumePtr(value * 1e9), nil
+	case "":
+		return vfs.VolumePtr(value), nil
 	default:
-		size = vfs.VolumePtr(value)
+		return 0, fmt.Errorf("invalid unit %s", unit)
+	}
+}
+
+// Format creates new filesystem, usage:
+// format [-b cluster size] [-i bytes per inode | -N inode count] [-s signature] [-L label] [-m reserved percentage] [-c] [-e] size
+// -c enables checksums of file data, -e makes new files use extents
+func Format(c *ishell.Context) {
+	if runningScrub(c) != nil {
+		c.Println("scrub is running, use scrub cancel")
+		return
+	}
+
+	options := vfs.DefaultFormatOptions()
+	args := make([]string, 0, 1)
+	for i := 0; i < len(c.Args); i++ {
+		switch c.Args[i] {
+		case "-b", "-i", "-N", "-s", "-L", "-m":
+		case "-c":
+			options.DataChecksums = true
+			continue
+		case "-e":
+			options.Extents = true
+			continue
+		default:
+			args = append(args, c.Args[i])
+			continue
+		}
+
+		if i+1 >= len(c.Args) {
+			c.Printf("option %s expects value\n", c.Args[i])
+			return
+		}
+		flag, value := c.Args[i], c.Args[i+1]
+		i++
+
+		if flag == "-s" {
+			options.Signature = value
+			continue
+		}
+		if flag == "-L" {
+			options.Label = value
+			continue
+		}
+
+		number, err := parseSize(value)
+		if err != nil {
+			c.Err(err)
+			return
+		}
+
+		switch flag {
+		case "-b":
+			if number > vfs.MaxClusterSize {
+				c.Printf("cluster size can't be greater than %d\n", vfs.MaxClusterSize)
+				return
+			}
+			options.ClusterSize = int16(number)
+		case "-i":
+			options.BytesPerInode = number
+		case "-N":
+			options.InodeCount = number
+		case "-m":
+			options.ReservedPercentage = int(number)
+		}
+	}
+
+	if len(args) != 1 {
+		c.Println("expected 1 argument")
+		return
+	}
+
+	size, err := parseSize(args[0])
+	if err != nil {
+		c.Err(err)
+		return
 	}
 
 	if size < 1e6 {
@@ -45,6 +121,13 @@ func Format(c *ishell.Context) {
 		return
 	}
 
+	// Check options before the old filesystem is overwritten
+	_, err = vfs.NewSuperblockWithOptions(size, options)
+	if err != nil {
+		c.Err(err)
+		return
+	}
+
 	path := c.Get("volume_path").(string)
 	// Create new filesystem
 	err = vfs.PrepareVolumeFile(path, size)
@@ -55,7 +138,7 @@ func Format(c *ishell.Context) {
 	}
 
 	// Create filesystem
-	fs, err := vfs.NewFilesystem(volume, 4096)
+	fs, err := vfs.NewFilesystemWithOptions(volume, options)
 	if err != nil {
 		c.Err(err)
 	}
@@ -79,9 +162,53 @@ func Format(c *ishell.Context) {
 		c.Err(err)
 	}
 
+	err = vfsapi.CreateLostFound(fs)
+	if err != nil {
+		c.Err(err)
+	}
+
+	// New filesystem is in use until the shell is exited
+	_, err = fs.Mount()
+	if err != nil {
+		c.Err(err)
+	}
+
 	*(c.Get("fs").(*vfs.Filesystem)) = fs
 }
 
+func Resize(c *ishell.Context) {
+	if runningScrub(c) != nil {
+		c.Println("scrub is running, use scrub cancel")
+		return
+	}
+
+	if len(c.Args) != 1 {
+		c.Println("expected 1 argument")
+		return
+	}
+
+	fs := c.Get("fs").(*vfs.Filesystem)
+
+	size, err := parseSize(c.Args[0])
+	if err != nil {
+		c.Err(err)
+		return
+	}
+
+	if size < 1e6 {
+		c.Println("MINIMUM FILESYSTEM SIZE IS 1MB")
+		return
+	}
+
+	err = vfsapi.Resize(fs, size)
+	if err != nil {
+		c.Err(err)
+		return
+	}
+
+	c.Println("OK")
+}
+
 func Mkdir(c *ishell.Context) {
 	if len(c.Args) != 1 {
 		c.Println("expected 1 argument")
@@ -108,9 +235,16 @@ func Mkdir(c *ishell.Context) {
 func Ls(c *ishell.Context) {
 	fs := c.Get("fs").(*vfs.Filesystem)
 
+	args := c.Args
+	long := false
+	if len(args) > 0 && args[0] == "-l" {
+		long = true
+		args = args[1:]
+	}
+
 	var path string
-	if len(c.Args) == 1 {
-		path = c.Args[0]
+	if len(args) == 1 {
+		path = args[0]
 	} else {
 		path = "."
 	}
@@ -132,10 +266,29 @@ func Ls(c *ishell.Context) {
 	}
 
 	for _, v := range files {
+		typeMark := "-"
 		if v.IsDir() {
-			c.Printf("+ %s\n", v.Name())
+			typeMark = "+"
+		} else if v.IsSymlink() {
+			typeMark = "@"
+		}
+
+		if long {
+			c.Printf("%s %04o %3d %5d %5d %10d  mod %s  chg %s  acc %s  crt %s  %s\n",
+				typeMark,
+				v.Mode(),
+				v.LinkCount(),
+				v.Uid(),
+				v.Gid(),
+				v.Size(),
+				v.ModTime().Format(TimeFormat),
+				v.ChangeTime().Format(TimeFormat),
+				v.AccessTime().Format(TimeFormat),
+				v.CreationTime().Format(TimeFormat),
+				v.Name(),
+			)
 		} else {
-			c.Printf("- %s\n", v.Name())
+			c.Printf("%s %s\n", typeMark, v.Name())
 		}
 	}
 }
@@ -200,7 +353,7 @@ func Rm(c *ishell.Context) {
 	fs := c.Get("fs").(*vfs.Filesystem)
 
 	path := c.Args[0]
-	file, err := vfsapi.Open(*fs, path, false)
+	file, err := vfsapi.Lstat(*fs, path)
 	if err != nil {
 		switch err.(type) {
 		case vfs.DirectoryEntryNotFound:
@@ -232,7 +385,7 @@ func Badrm(c *ishell.Context) {
 	fs := c.Get("fs").(*vfs.Filesystem)
 
 	path := c.Args[0]
-	file, err := vfsapi.Open(*fs, path, false)
+	file, err := vfsapi.Lstat(*fs, path)
 	if err != nil {
 		switch err.(type) {
 		case vfs.DirectoryEntryNotFound:
@@ -592,13 +745,16 @@ func Info(c *ishell.Context) {
 		return
 	}
 
-	directPtrs, indirect1Ptrs, indirect2Ptrs, err := vfsapi.DataClustersInfo(*fs, path)
+	directPtrs, indirect1Ptrs, indirect2Ptrs, indirect3Ptrs, err := vfsapi.DataClustersInfo(*fs, path)
 	if err != nil {
 		c.Err(err)
 		return
 	}
 
 	c.Printf("%s - %d - %d\n", file.Name(), file.Size(), file.InodePtr())
+	if file.Stat().IsInline() {
+		c.Println("Data are stored inline in the inode")
+	}
 	c.Println("Direct pointers")
 	c.Println(strings.Join(ClusterPtrsToStrings(directPtrs), " "))
 
@@ -617,14 +773,132 @@ func Info(c *ishell.Context) {
 		}
 		c.Println()
 	}
+
+	if len(indirect3Ptrs) > 0 {
+		c.Println("\nIndirect3 pointers")
+		for k, v := range indirect3Ptrs {
+			c.Printf("%d ->\n", k)
+			for k2, v2 := range v {
+				c.Printf("\t%d ->\n", k2)
+				for k3, v3 := range v2 {
+					c.Printf("\t\t%d -> ", k3)
+					c.Println(strings.Join(ClusterPtrsToStrings(v3), " "))
+				}
+			}
+			c.Println()
+		}
+	}
+
+	extents, err := vfsapi.ExtentsInfo(*fs, path)
+	if err != nil {
+		c.Err(err)
+		return
+	}
+
+	if len(extents) > 0 {
+		c.Println("\nExtents")
+		for _, extent := range extents {
+			c.Printf("%d -> %d (%d)\n", extent.Logical, extent.Start, extent.Length)
+		}
+	}
+
+	holes, err := vfsapi.HolesInfo(*fs, path)
+	if err != nil {
+		c.Err(err)
+		return
+	}
+
+	if len(holes) > 0 {
+		c.Println("\nHoles")
+		for _, hole := range holes {
+			c.Printf("%d (%d)\n", hole.Logical, hole.Length)
+		}
+	}
 }
 
 func Check(c *ishell.Context) {
+	args := c.Args
+	repair := false
+	if len(args) > 0 && args[0] == "--repair" {
+		repair = true
+		args = args[1:]
+	}
+
+	if len(args) != 0 {
+		c.Println("expected 0 arguments")
+		return
+	}
+
 	fs := c.Get("fs").(*vfs.Filesystem)
 
-	err := vfsapi.FsCheck(*fs)
+	report, err := vfsapi.CheckFilesystem(*fs, repair)
+	for _, problem := range report.Problems {
+		c.Println(problem)
+	}
 	if err != nil {
 		c.Err(err)
+		return
+	}
+
+	if len(report.Problems) == 0 {
+		c.Println("OK")
+	}
+}
+
+// Scrub verifies checksums of all data clusters in background and prints files
+// with corrupted content when it's finished, usage:
+// scrub
+// scrub status
+// scrub cancel
+func Scrub(c *ishell.Context) {
+	if len(c.Args) > 1 {
+		c.Println("expected at most 1 argument")
+		return
+	}
+
+	if len(c.Args) == 0 {
+		if runningScrub(c) != nil {
+			c.Println("scrub is already running")
+			return
+		}
+
+		fs := c.Get("fs").(*vfs.Filesystem)
+		*(c.Get("scrub").(**vfsapi.BackgroundScrub)) = vfsapi.StartScrub(fs, c.Get("lock").(*sync.Mutex))
+		c.Println("scrub started")
+		return
+	}
+
+	scrub := *c.Get("scrub").(**vfsapi.BackgroundScrub)
+	if scrub == nil {
+		c.Println("scrub wasn't started")
+		return
+	}
+
+	switch c.Args[0] {
+	case "status":
+		status := scrub.Status()
+		if status.Running {
+			c.Printf("%d of %d clusters checked\n", status.CheckedClusters, status.TotalClusters)
+			return
+		}
+
+		// The scrub has finished, so Wait doesn't block
+		report, err := scrub.Wait()
+		for _, corrupted := range report.Corrupted {
+			c.Println(corrupted)
+		}
+		if err != nil {
+			c.Err(err)
+			return
+		}
+
+		c.Printf("%d clusters checked, %d without checksum, %d corrupted\n",
+			report.CheckedClusters, report.UncheckedClusters, len(report.Corrupted))
+	case "cancel":
+		scrub.Cancel()
+		c.Println("OK")
+	default:
+		c.Println("expected status or cancel")
 	}
 }
 
@@ -662,3 +936,213 @@ func Load(c *ishell.Context) {
 		}
 	}
 }
+
+func Ln(c *ishell.Context) {
+	args := c.Args
+	symbolic := false
+	if len(args) > 0 && args[0] == "-s" {
+		symbolic = true
+		args = args[1:]
+	}
+
+	if len(args) != 2 {
+		c.Println("expected 2 arguments")
+		return
+	}
+
+	fs := c.Get("fs").(*vfs.Filesystem)
+
+	var err error
+	if symbolic {
+		err = vfsapi.Symlink(*fs, args[0], args[1])
+	} else {
+		err = vfsapi.Link(*fs, args[0], args[1])
+	}
+	if err != nil {
+		switch err.(type) {
+		case vfs.DirectoryEntryNotFound:
+			c.Println("FILE NOT FOUND (není zdroj)")
+		case vfs.DuplicateDirectoryEntry:
+			c.Println("EXIST (nelze založit, již existuje)")
+		case vfs.PermissionDenied:
+			c.Println("PERMISSION DENIED")
+		default:
+			c.Err(err)
+		}
+		return
+	}
+
+	c.Println("OK")
+}
+
+func Chmod(c *ishell.Context) {
+	if len(c.Args) != 2 {
+		c.Println("expected 2 arguments")
+		return
+	}
+
+	fs := c.Get("fs").(*vfs.Filesystem)
+
+	mode, err := strconv.ParseUint(c.Args[0], 8, 16)
+	if err != nil {
+		c.Println("INVALID MODE (očekáváno osmičkové číslo)")
+		return
+	}
+
+	err = vfsapi.Chmod(*fs, c.Args[1], uint16(mode))
+	if err != nil {
+		switch err.(type) {
+		case vfs.DirectoryEntryNotFound:
+			c.Println("FILE NOT FOUND (není zdroj)")
+		case vfs.PermissionDenied:
+			c.Println("PERMISSION DENIED")
+		default:
+			c.Err(err)
+		}
+		return
+	}
+
+	c.Println("OK")
+}
+
+func Chown(c *ishell.Context) {
+	if len(c.Args) != 2 {
+		c.Println("expected 2 arguments")
+		return
+	}
+
+	fs := c.Get("fs").(*vfs.Filesystem)
+
+	identity, err := ParseIdentity(c.Args[0])
+	if err != nil {
+		c.Println("INVALID OWNER (očekáváno uid[:gid])")
+		return
+	}
+
+	err = vfsapi.Chown(*fs, c.Args[1], identity.Uid, identity.Gid)
+	if err != nil {
+		switch err.(type) {
+		case vfs.DirectoryEntryNotFound:
+			c.Println("FILE NOT FOUND (není zdroj)")
+		case vfs.PermissionDenied:
+			c.Println("PERMISSION DENIED")
+		default:
+			c.Err(err)
+		}
+		return
+	}
+
+	c.Println("OK")
+}
+
+// Su switches identity used for all following commands
+func Su(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("expected 1 argument")
+		return
+	}
+
+	fs := c.Get("fs").(*vfs.Filesystem)
+
+	identity, err := ParseIdentity(c.Args[0])
+	if err != nil {
+		c.Println("INVALID USER (očekáváno uid[:gid])")
+		return
+	}
+
+	fs.Identity = identity
+}
+
+func Setxattr(c *ishell.Context) {
+	if len(c.Args) < 3 {
+		c.Println("expected 3 arguments")
+		return
+	}
+
+	fs := c.Get("fs").(*vfs.Filesystem)
+
+	// Value can contain spaces
+	value := strings.Join(c.Args[2:], " ")
+
+	err := vfsapi.Setxattr(*fs, c.Args[0], c.Args[1], []byte(value))
+	if err != nil {
+		printXattrError(c, err)
+		return
+	}
+
+	c.Println("OK")
+}
+
+func Getxattr(c *ishell.Context) {
+	if len(c.Args) != 2 {
+		c.Println("expected 2 arguments")
+		return
+	}
+
+	fs := c.Get("fs").(*vfs.Filesystem)
+
+	value, err := vfsapi.Getxattr(*fs, c.Args[0], c.Args[1])
+	if err != nil {
+		printXattrError(c, err)
+		return
+	}
+
+	c.Printf("%s\n", value)
+}
+
+func Lsxattr(c *ishell.Context) {
+	if len(c.Args) != 1 {
+		c.Println("expected 1 argument")
+		return
+	}
+
+	fs := c.Get("fs").(*vfs.Filesystem)
+
+	names, err := vfsapi.Listxattr(*fs, c.Args[0])
+	if err != nil {
+		printXattrError(c, err)
+		return
+	}
+
+	for _, name := range names {
+		value, err := vfsapi.Getxattr(*fs, c.Args[0], name)
+		if err != nil {
+			printXattrError(c, err)
+			return
+		}
+
+		c.Printf("%s=%s\n", name, value)
+	}
+}
+
+func Rmxattr(c *ishell.Context) {
+	if len(c.Args) != 2 {
+		c.Println("expected 2 arguments")
+		return
+	}
+
+	fs := c.Get("fs").(*vfs.Filesystem)
+
+	err := vfsapi.Removexattr(*fs, c.Args[0], c.Args[1])
+	if err != nil {
+		printXattrError(c, err)
+		return
+	}
+
+	c.Println("OK")
+}
+
+func printXattrError(c *ishell.Context, err error) {
+	switch err.(type) {
+	case vfs.DirectoryEntryNotFound:
+		c.Println("FILE NOT FOUND (není zdroj)")
+	case vfs.XattrNotFound:
+		c.Println("ATTRIBUTE NOT FOUND")
+	case vfs.NoXattrSpace:
+		c.Println("NO SPACE FOR ATTRIBUTE")
+	case vfs.PermissionDenied:
+		c.Println("PERMISSION DENIED")
+	default:
+		c.Err(err)
+	}
+}
@@ -2,9 +2,15 @@ package shell
 
 import (
 	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"github.com/abiosoft/ishell"
 	"strconv"
+	"strings"
+	"sync"
 )
 
+const TimeFormat = "2006-01-02 15:04:05"
+
 func ClusterPtrsToStrings(ptrs []vfs.ClusterPtr) []string {
 	strs := make([]string, 0)
 	for _, ptr := range ptrs {
@@ -13,3 +19,44 @@ func ClusterPtrsToStrings(ptrs []vfs.ClusterPtr) []string {
 
 	return strs
 }
+
+// ParseIdentity parses identity in uid[:gid] format, gid defaults to uid
+func ParseIdentity(s string) (vfs.Identity, error) {
+	parts := strings.SplitN(s, ":", 2)
+
+	uid, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return vfs.Identity{}, err
+	}
+
+	gid := uid
+	if len(parts) == 2 {
+		gid, err = strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return vfs.Identity{}, err
+		}
+	}
+
+	return vfs.Identity{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// Locked runs command while holding the lock shared with background scrub
+func Locked(f func(c *ishell.Context)) func(c *ishell.Context) {
+	return func(c *ishell.Context) {
+		lock := c.Get("lock").(*sync.Mutex)
+		lock.Lock()
+		defer lock.Unlock()
+
+		f(c)
+	}
+}
+
+// runningScrub returns background scrub that hasn't finished yet
+func runningScrub(c *ishell.Context) *vfsapi.BackgroundScrub {
+	scrub := *c.Get("scrub").(**vfsapi.BackgroundScrub)
+	if scrub == nil || !scrub.Status().Running {
+		return nil
+	}
+
+	return scrub
+}
@@ -1,19 +1,14 @@
 package tests
 
 import (
+	"bytes"
 	"github.com/PapiCZ/kiv_zos/vfs"
 	"testing"
 )
 
 func PrepareFS(size vfs.VolumePtr, t *testing.T) vfs.Filesystem {
 	// Create volume
-	path := tempFileName("", "")
-	err := vfs.PrepareVolumeFile(path, size)
-
-	volume, err := vfs.NewVolume(path)
-	if err != nil {
-		t.Fatal(err)
-	}
+	volume := vfs.NewMemoryVolume(size)
 
 	// Create filesystem
 	fs, err := vfs.NewFilesystem(volume, 2048)
@@ -71,7 +66,7 @@ func TestAllocate(t *testing.T) {
 	allocatedSize, err := vfs.Allocate(vfs.MutableInode{
 		Inode:    &inode,
 		InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, inodeObject.VolumePtr),
-	}, fs.Volume, fs.Superblock, 1e8)
+	}, fs.Volume, fs.Superblock, fs.Identity, 1e8)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -99,7 +94,7 @@ func TestReallocation(t *testing.T) {
 		allocatedSize, err := vfs.Allocate(vfs.MutableInode{
 			Inode:    &inode,
 			InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, inodeObject.VolumePtr),
-		}, fs.Volume, fs.Superblock, 10)
+		}, fs.Volume, fs.Superblock, fs.Identity, 10)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -130,7 +125,7 @@ func TestShrink(t *testing.T) {
 	allocatedSize, err := vfs.Allocate(vfs.MutableInode{
 		Inode:    &inode,
 		InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, inodeObject.VolumePtr),
-	}, fs.Volume, fs.Superblock, 1e7)
+	}, fs.Volume, fs.Superblock, fs.Identity, 1e7)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -142,9 +137,100 @@ func TestShrink(t *testing.T) {
 	shrinkedSize, err := vfs.Shrink(vfs.MutableInode{
 		Inode:    &inode,
 		InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, inodeObject.VolumePtr),
-	}, fs.Volume, fs.Superblock, 8000)
+	}, fs.Volume, fs.Superblock, fs.Identity, 8000)
 
 	if shrinkedSize != 8000+192 {
 		t.Errorf("shrinked size is incorrect, %d instead of %d", shrinkedSize, vfs.VolumePtr(8000+192))
 	}
 }
+
+func TestAllocateIndirect3(t *testing.T) {
+	// Small clusters make indirect3 reachable with small volume
+	fs, err := vfs.NewFilesystem(vfs.NewMemoryVolume(2e7), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.WriteStructureToVolume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inodeObject, err := vfs.FindFreeInode(fs.Volume, fs.Superblock, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inode := inodeObject.Object.(vfs.Inode)
+	mutableInode := vfs.MutableInode{
+		Inode:    &inode,
+		InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, inodeObject.VolumePtr),
+	}
+
+	freeClusters, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 direct, 128 indirect1 and 128*128 indirect2 clusters are followed by 300 indirect3 clusters
+	const clusterCount = 5 + 128 + 128*128 + 300
+	data := make([]byte, clusterCount*512)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+
+	_, err = mutableInode.WriteData(fs.Volume, fs.Superblock, fs.Identity, 0, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inode.Indirect3 == vfs.Unused {
+		t.Fatal("indirect3 should be used")
+	}
+
+	_, _, _, indirect3Ptrs, err := inode.GetUsedPtrs(fs.Volume, fs.Superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indirect3DataClusters := 0
+	for _, doublePtrTable := range indirect3Ptrs[inode.Indirect3] {
+		for _, singlePtrTable := range doublePtrTable {
+			indirect3DataClusters += len(singlePtrTable)
+		}
+	}
+	if indirect3DataClusters != 300 {
+		t.Errorf("indirect3 maps %d clusters instead of 300", indirect3DataClusters)
+	}
+
+	readData := make([]byte, len(data))
+	_, err = inode.ReadData(fs.Volume, fs.Superblock, 0, readData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readData, data) {
+		t.Error("read data don't match written data")
+	}
+
+	_, err = vfs.Allocate(mutableInode, fs.Volume, fs.Superblock, fs.Identity, 2e9)
+	if _, ok := err.(vfs.FileTooLarge); !ok {
+		t.Errorf("expected FileTooLarge error, got %v", err)
+	}
+
+	_, err = vfs.Shrink(mutableInode, fs.Volume, fs.Superblock, fs.Identity, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inode.AllocatedClusters != 0 || inode.Indirect3 != vfs.Unused {
+		t.Errorf("inode still has %d clusters after shrink", inode.AllocatedClusters)
+	}
+
+	freeClustersAfterShrink, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freeClustersAfterShrink[0].VolumePtr != freeClusters[0].VolumePtr {
+		t.Error("clusters weren't freed")
+	}
+}
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
 	"math/rand"
 	"os"
 	"reflect"
@@ -91,3 +92,94 @@ func TestCachedVolumeWrite(t *testing.T) {
 		t.Error("read and written data are not equal")
 	}
 }
+
+func TestCachedVolumeEviction(t *testing.T) {
+	volume := CreateVolume(t)
+	defer func() {
+		_ = volume.Destroy()
+	}()
+
+	cachedVolume := vfs.NewCachedVolumeWithSize(volume, 2)
+
+	for i := 0; i < 5; i++ {
+		err := cachedVolume.WriteByteAt(vfs.VolumePtr(i*vfs.CachePageSize+1), byte(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cachedVolume.CachedPages() != 2 {
+		t.Errorf("cache holds %d pages instead of %d", cachedVolume.CachedPages(), 2)
+	}
+
+	// Evicted pages must already be written to the volume
+	for i := 0; i < 3; i++ {
+		value, err := volume.ReadByteAt(vfs.VolumePtr(i*vfs.CachePageSize + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value != byte(i+1) {
+			t.Errorf("evicted page %d wasn't written back", i)
+		}
+	}
+
+	// Recently used pages must be readable from cache before flush
+	for i := 3; i < 5; i++ {
+		value, err := cachedVolume.ReadByteAt(vfs.VolumePtr(i*vfs.CachePageSize + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value != byte(i+1) {
+			t.Errorf("cached page %d contains wrong data", i)
+		}
+	}
+
+	err := cachedVolume.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := volume.ReadByteAt(vfs.VolumePtr(4*vfs.CachePageSize + 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != 5 {
+		t.Error("flushed page wasn't written back")
+	}
+}
+
+func TestFilesystemOnCachedVolume(t *testing.T) {
+	volume := vfs.NewMemoryVolume(1e7)
+	cachedVolume := vfs.NewCachedVolume(volume)
+	fs := PrepareFSForApiOnVolume(cachedVolume, t)
+
+	err := vfsapi.Mkdir(fs, "foodir1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cachedVolume.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Filesystem loaded directly from the underlying volume must see flushed data
+	sb := vfs.Superblock{}
+	err = volume.ReadStruct(0, &sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uncachedFs := vfs.NewFilesystemFromSuperblock(volume, sb)
+	exists, err := vfsapi.Exists(uncachedFs, "/foodir1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists {
+		t.Error("directory created through cache doesn't exist in underlying volume")
+	}
+}
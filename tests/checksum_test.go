@@ -0,0 +1,311 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"io"
+	"sync"
+	"testing"
+)
+
+// corruptByte flips all bits of byte on volume
+func corruptByte(fs vfs.Filesystem, volumePtr vfs.VolumePtr, t *testing.T) {
+	value, err := fs.Volume.ReadByteAt(volumePtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Volume.WriteByteAt(volumePtr, ^value)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSuperblockChecksum(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	// Byte in the volume label
+	corruptByte(fs, 20, t)
+
+	_, err := vfs.LoadFilesystem(fs.Volume)
+	if _, ok := err.(vfs.SuperblockChecksumMismatch); !ok {
+		t.Errorf("expected SuperblockChecksumMismatch error, got %v", err)
+	}
+
+	checkRepaired(fs, vfsapi.BadChecksum, t)
+
+	_, err = vfs.LoadFilesystem(fs.Volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInodeChecksum(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	writeFile(fs, "/file", patternData(100, 0), t)
+	file, err := vfsapi.Open(fs, "/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inodePtr := vfs.InodePtr(file.InodePtr())
+
+	// Byte in size of the file
+	corruptByte(fs, vfs.InodePtrToVolumePtr(fs.Superblock, inodePtr)+1, t)
+
+	_, err = vfsapi.Open(fs, "/file", false)
+	if mismatch, ok := err.(vfs.InodeChecksumMismatch); !ok || mismatch.InodePtr != inodePtr {
+		t.Errorf("expected InodeChecksumMismatch error for inode %d, got %v", inodePtr, err)
+	}
+
+	problem := checkRepaired(fs, vfsapi.BadChecksum, t)
+	if problem.InodePtr != inodePtr || problem.Path != "/file" {
+		t.Errorf("problem was reported for inode %d and path %s", problem.InodePtr, problem.Path)
+	}
+}
+
+func TestBitmapChecksum(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	corruptByte(fs, fs.Superblock.ClusterBitmapStartAddress+10, t)
+
+	_, err := vfs.IsClusterFree(fs.Volume, fs.Superblock, 0)
+	if mismatch, ok := err.(vfs.BitmapChecksumMismatch); !ok || mismatch.Address != fs.Superblock.ClusterBitmapStartAddress {
+		t.Errorf("expected BitmapChecksumMismatch error, got %v", err)
+	}
+
+	// Flipped bits are reported as orphaned clusters and freed
+	checkRepaired(fs, vfsapi.BadChecksum, t)
+
+	_, err = vfsapi.Open(fs, "/file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectoryClusterChecksum(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	err := vfsapi.Mkdir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err = vfsapi.Open(fs, fmt.Sprintf("/dir/file_%d", i), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := vfsapi.Open(fs, "/dir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(dir.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterPtr := mutableInode.Inode.Direct1
+
+	// Byte in name of the first file
+	corruptByte(fs, vfs.ClusterPtrToVolumePtr(fs.Superblock, clusterPtr)+40, t)
+
+	_, err = dir.ReadDir()
+	if mismatch, ok := err.(vfs.ClusterChecksumMismatch); !ok || mismatch.ClusterPtr != clusterPtr {
+		t.Errorf("expected ClusterChecksumMismatch error for cluster %d, got %v", clusterPtr, err)
+	}
+
+	problem := checkRepaired(fs, vfsapi.BadChecksum, t)
+	if problem.ClusterPtr != clusterPtr || problem.Path != "/dir" {
+		t.Errorf("problem was reported for cluster %d and path %s", problem.ClusterPtr, problem.Path)
+	}
+}
+
+func PrepareFSWithDataChecksums(size vfs.VolumePtr, t *testing.T) vfs.Filesystem {
+	options := vfs.DefaultFormatOptions()
+	options.DataChecksums = true
+
+	return PrepareFSWithOptions(size, options, t)
+}
+
+func TestDataClusterChecksum(t *testing.T) {
+	fs := PrepareFSWithDataChecksums(1e7, t)
+
+	err := vfsapi.Mkdir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(fs, "/dir/file", patternData(10000, 0), t)
+	writeFile(fs, "/other", patternData(10000, 1), t)
+
+	file, err := vfsapi.Open(fs, "/dir/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterPtr := mutableInode.Inode.Direct2
+
+	report, err := vfsapi.Scrub(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupted) != 0 {
+		t.Errorf("%d clusters of healthy volume are corrupted", len(report.Corrupted))
+	}
+
+	corruptByte(fs, vfs.ClusterPtrToVolumePtr(fs.Superblock, clusterPtr)+10, t)
+
+	_, _, err = file.ReadAll()
+	if mismatch, ok := err.(vfs.ClusterChecksumMismatch); !ok || mismatch.ClusterPtr != clusterPtr {
+		t.Errorf("expected ClusterChecksumMismatch error for cluster %d, got %v", clusterPtr, err)
+	}
+	checkFile(fs, "/other", patternData(10000, 1), t)
+
+	var lastChecked, lastTotal vfs.ClusterPtr
+	report, err = vfsapi.Scrub(fs, func(checked, total vfs.ClusterPtr) {
+		lastChecked, lastTotal = checked, total
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastChecked != lastTotal || lastTotal != report.CheckedClusters {
+		t.Errorf("progress ended at %d of %d clusters, %d were checked", lastChecked, lastTotal, report.CheckedClusters)
+	}
+	if len(report.Corrupted) != 1 {
+		t.Fatalf("%d corrupted clusters were found instead of 1", len(report.Corrupted))
+	}
+	corrupted := report.Corrupted[0]
+	if corrupted.ClusterPtr != clusterPtr || corrupted.Path != "/dir/file" {
+		t.Errorf("corruption was reported for cluster %d and path %s", corrupted.ClusterPtr, corrupted.Path)
+	}
+}
+
+func TestDataChecksumsAreOptional(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	writeFile(fs, "/file", patternData(10000, 0), t)
+	file, err := vfsapi.Open(fs, "/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corruptByte(fs, vfs.ClusterPtrToVolumePtr(fs.Superblock, mutableInode.Inode.Direct1), t)
+
+	_, _, err = file.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := vfsapi.Scrub(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupted) != 0 {
+		t.Errorf("%d corrupted clusters were found without data checksums", len(report.Corrupted))
+	}
+}
+
+func TestScrubSkipsHoles(t *testing.T) {
+	fs := PrepareFSWithDataChecksums(1e7, t)
+
+	before, err := vfsapi.Scrub(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := vfsapi.Open(fs, "/sparse", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("head"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Second cluster is addressed by indirect1 table
+	_, err = file.Seek(20*int64(fs.Superblock.ClusterSize), io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("tail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := vfsapi.Scrub(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.CheckedClusters != before.CheckedClusters+2 {
+		t.Errorf("%d clusters were checked instead of %d", report.CheckedClusters, before.CheckedClusters+2)
+	}
+	if report.UncheckedClusters != before.UncheckedClusters+1 {
+		t.Errorf("%d clusters weren't checked instead of %d", report.UncheckedClusters, before.UncheckedClusters+1)
+	}
+}
+
+func TestBackgroundScrub(t *testing.T) {
+	fs := PrepareFSWithDataChecksums(1e7, t)
+
+	writeFile(fs, "/file", patternData(100000, 0), t)
+	file, err := vfsapi.Open(fs, "/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptByte(fs, vfs.ClusterPtrToVolumePtr(fs.Superblock, mutableInode.Inode.Direct1), t)
+
+	expected, err := vfsapi.Scrub(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scrub := vfsapi.StartScrub(&fs, &sync.Mutex{})
+	report, err := scrub.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.CheckedClusters != expected.CheckedClusters || len(report.Corrupted) != 1 {
+		t.Errorf("%d clusters were checked and %d corrupted instead of %d and 1",
+			report.CheckedClusters, len(report.Corrupted), expected.CheckedClusters)
+	}
+
+	status := scrub.Status()
+	if status.Running || status.CheckedClusters != status.TotalClusters {
+		t.Errorf("finished scrub has status %+v", status)
+	}
+}
+
+func TestCancelBackgroundScrub(t *testing.T) {
+	fs := PrepareFSWithDataChecksums(1e7, t)
+	writeFile(fs, "/file", patternData(100000, 0), t)
+
+	// Scrub can't start until the lock is released
+	lock := &sync.Mutex{}
+	lock.Lock()
+	scrub := vfsapi.StartScrub(&fs, lock)
+	if !scrub.Status().Running {
+		t.Error("scrub isn't running")
+	}
+	scrub.Cancel()
+	scrub.Cancel()
+	lock.Unlock()
+
+	report, err := scrub.Wait()
+	if _, ok := err.(vfsapi.ScrubCanceled); !ok {
+		t.Errorf("expected ScrubCanceled error, got %v", err)
+	}
+	if report.CheckedClusters != 0 {
+		t.Errorf("%d clusters were checked after cancel", report.CheckedClusters)
+	}
+}
@@ -2,6 +2,8 @@ package tests
 
 import (
 	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"strings"
 	"testing"
 )
 
@@ -25,6 +27,7 @@ func TestDirectoryEntryCreation(t *testing.T) {
 	childInode, err := vfs.CreateNewDirectory(
 		fs.Volume,
 		fs.Superblock,
+		fs.Identity,
 		vfs.VolumePtrToInodePtr(fs.Superblock, rootInodeObj.VolumePtr),
 		vfs.MutableInode{
 			Inode:    &rootInode,
@@ -126,3 +129,156 @@ func TestDirectoryEntryCreation(t *testing.T) {
 		t.Error("invalid inode pointer in directory entry")
 	}
 }
+
+func TestLongDirectoryEntryNames(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	for _, name := range []string{"report_2024_final.txt", "report_2024_draft.txt"} {
+		_, err := vfsapi.Open(fs, name, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rootFile, err := vfsapi.Open(fs, "/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := rootFile.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 4 {
+		t.Fatalf("expected 4 files, got %d", len(files))
+	}
+
+	for k, v := range []string{".", "..", "report_2024_final.txt", "report_2024_draft.txt"} {
+		if files[k].Name() != v {
+			t.Errorf("bad file name, %s instead of %s", files[k].Name(), v)
+		}
+	}
+}
+
+func TestTooLongDirectoryEntryName(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	err := vfsapi.Mkdir(fs, strings.Repeat("x", vfs.DirectoryEntryNameLength+1))
+	if _, ok := err.(vfs.NameTooLong); !ok {
+		t.Errorf("expected NameTooLong error, got %v", err)
+	}
+
+	err = vfsapi.Mkdir(fs, strings.Repeat("x", vfs.DirectoryEntryNameLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyDirectoryEntryNames(t *testing.T) {
+	fs, err := vfs.NewFilesystem(vfs.NewMemoryVolume(1e7), 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate volume created before long names were supported
+	fs.Superblock.FeatureFlags &^= vfs.FeatureLongNames
+
+	err = fs.WriteStructureToVolume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootInodeObj, err := vfs.FindFreeInode(fs.Volume, fs.Superblock, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInode := rootInodeObj.Object.(vfs.Inode)
+
+	err = vfs.InitRootDirectory(&fs, &vfs.MutableInode{
+		Inode:    &rootInode,
+		InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, rootInodeObj.VolumePtr),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Mkdir(fs, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Mkdir(fs, "longer_than_12")
+	if _, ok := err.(vfs.NameTooLong); !ok {
+		t.Errorf("expected NameTooLong error, got %v", err)
+	}
+
+	exists, err := vfsapi.Exists(fs, "/legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("directory with legacy name doesn't exist")
+	}
+}
+
+func TestRemovedDirectoryEntrySlotIsReused(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	root, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, fs.RootInodePtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfs.AppendDirectoryEntries(fs.Volume, fs.Superblock, fs.Identity, root,
+		vfs.NewDirectoryEntry("first", 10),
+		vfs.NewDirectoryEntry("second", 11),
+		vfs.NewDirectoryEntry("third", 12),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := root.Inode.Size
+
+	directoryEntry, err := vfs.RemoveDirectoryEntry(fs.Volume, fs.Superblock, fs.Identity, root, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if directoryEntry.InodePtr != 11 {
+		t.Errorf("removed entry points to inode %d instead of 11", directoryEntry.InodePtr)
+	}
+
+	_, _, err = vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, *root.Inode, "second")
+	if _, ok := err.(vfs.DirectoryEntryNotFound); !ok {
+		t.Errorf("expected DirectoryEntryNotFound error, got %v", err)
+	}
+
+	// Shorter name fits into the free slot
+	err = vfs.AppendDirectoryEntries(fs.Volume, fs.Superblock, fs.Identity, root, vfs.NewDirectoryEntry("new", 13))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root.Inode.Size != size {
+		t.Errorf("directory grew to %d bytes instead of reusing free slot", root.Inode.Size)
+	}
+
+	deptr, _, err := vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, *root.Inode, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deptr != 3 {
+		t.Errorf("deptr is %d instead of 3", deptr)
+	}
+
+	directoryEntries, err := vfs.ReadAllDirectoryEntries(fs.Volume, fs.Superblock, *root.Inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range []string{".", "..", "first", "new", "third"} {
+		if string(directoryEntries[k].NameBytes()) != v {
+			t.Errorf("bad directory entry name, %s instead of %s", directoryEntries[k].NameBytes(), v)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"testing"
+)
+
+func TestIndexedDirectoryLookup(t *testing.T) {
+	// Small clusters make the index tree grow several levels
+	fs, err := vfs.NewFilesystem(vfs.NewMemoryVolume(1e7), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.WriteStructureToVolume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootInodeObj, err := vfs.FindFreeInode(fs.Volume, fs.Superblock, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInode := rootInodeObj.Object.(vfs.Inode)
+	root := vfs.MutableInode{
+		Inode:    &rootInode,
+		InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, rootInodeObj.VolumePtr),
+	}
+
+	err = vfs.InitRootDirectory(&fs, &root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 1500
+	for i := 0; i < count; i++ {
+		err = vfs.AppendDirectoryEntries(fs.Volume, fs.Superblock, fs.Identity, root,
+			vfs.NewDirectoryEntry(fmt.Sprintf("file_%d", i), vfs.InodePtr(i+10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rootInode.DirectoryIndex == vfs.Unused {
+		t.Fatal("large directory should be indexed")
+	}
+
+	for i := 0; i < count; i++ {
+		deptr, directoryEntry, err := vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, rootInode, fmt.Sprintf("file_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if deptr != vfs.DEPtr(i+2) {
+			t.Errorf("deptr of file_%d is %d instead of %d", i, deptr, i+2)
+		}
+		if directoryEntry.InodePtr != vfs.InodePtr(i+10) {
+			t.Errorf("inode of file_%d is %d instead of %d", i, directoryEntry.InodePtr, i+10)
+		}
+	}
+
+	_, _, err = vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, rootInode, "file_missing")
+	if _, ok := err.(vfs.DirectoryEntryNotFound); !ok {
+		t.Errorf("expected DirectoryEntryNotFound error, got %v", err)
+	}
+
+	// Directory that fits into one cluster again drops its index
+	directoryEntries, err := vfs.ReadAllDirectoryEntries(fs.Volume, fs.Superblock, rootInode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfs.SaveDirectoryEntries(fs.Volume, fs.Superblock, fs.Identity, root, directoryEntries[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rootInode.DirectoryIndex != vfs.Unused {
+		t.Error("small directory shouldn't be indexed")
+	}
+
+	_, directoryEntry, err := vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, rootInode, "file_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if directoryEntry.InodePtr != 10 {
+		t.Errorf("inode of file_0 is %d instead of 10", directoryEntry.InodePtr)
+	}
+}
+
+func TestFsCheckWithIndexedDirectory(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	for i := 0; i < 150; i++ {
+		err := vfsapi.Mkdir(fs, fmt.Sprintf("directory_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 150; i += 3 {
+		err := vfsapi.Remove(fs, fmt.Sprintf("directory_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 150; i++ {
+		exists, err := vfsapi.Exists(fs, fmt.Sprintf("/directory_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exists != (i%3 != 0) {
+			t.Errorf("directory_%d exists: %t", i, exists)
+		}
+	}
+
+	err := vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexedDirectoryRemoval(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	root, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, fs.RootInodePtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 500
+	for i := 0; i < count; i++ {
+		err = vfs.AppendDirectoryEntries(fs.Volume, fs.Superblock, fs.Identity, root,
+			vfs.NewDirectoryEntry(fmt.Sprintf("file_%d", i), vfs.InodePtr(i+10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := root.Inode.Size
+
+	for i := 0; i < count; i += 2 {
+		_, err = vfs.RemoveDirectoryEntry(fs.Volume, fs.Superblock, fs.Identity, root, fmt.Sprintf("file_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if root.Inode.Size != size {
+		t.Errorf("directory size changed from %d to %d after removal", size, root.Inode.Size)
+	}
+
+	for i := 0; i < count; i++ {
+		_, _, err := vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, *root.Inode, fmt.Sprintf("file_%d", i))
+		if i%2 == 0 {
+			if _, ok := err.(vfs.DirectoryEntryNotFound); !ok {
+				t.Errorf("expected DirectoryEntryNotFound error for file_%d, got %v", i, err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Short names fit into slots of removed entries
+	for i := 0; i < 10; i++ {
+		err = vfs.AppendDirectoryEntries(fs.Volume, fs.Superblock, fs.Identity, root,
+			vfs.NewDirectoryEntry(fmt.Sprintf("n%d", i), vfs.InodePtr(i+1000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if root.Inode.Size != size {
+		t.Errorf("directory grew to %d bytes instead of reusing free slots", root.Inode.Size)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, directoryEntry, err := vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, *root.Inode, fmt.Sprintf("n%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if directoryEntry.InodePtr != vfs.InodePtr(i+1000) {
+			t.Errorf("inode of n%d is %d instead of %d", i, directoryEntry.InodePtr, i+1000)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"testing"
+)
+
+func PrepareFSWithExtents(size vfs.VolumePtr, t *testing.T) vfs.Filesystem {
+	options := vfs.DefaultFormatOptions()
+	options.ClusterSize = 2048
+	options.Extents = true
+
+	return PrepareFSWithOptions(size, options, t)
+}
+
+func TestSequentialFileUsesOneExtent(t *testing.T) {
+	fs := PrepareFSWithExtents(1e7, t)
+
+	file, err := vfsapi.Open(fs, "/file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !mutableInode.Inode.UsesExtents() {
+		t.Fatal("inode should use extents")
+	}
+
+	extents, err := mutableInode.Inode.GetExtents(fs.Volume, fs.Superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) != 1 {
+		t.Errorf("sequential file has %d extents instead of 1", len(extents))
+	}
+	if extents[0].Length != mutableInode.Inode.AllocatedClusters {
+		t.Errorf("extent has %d clusters instead of %d", extents[0].Length, mutableInode.Inode.AllocatedClusters)
+	}
+
+	file, err = vfsapi.Open(fs, "/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, readData, err := file.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readData, data) {
+		t.Error("read data don't match written data")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFragmentedFileUsesExtentLeaves(t *testing.T) {
+	fs := PrepareFSWithExtents(1e7, t)
+
+	first, err := vfsapi.Open(fs, "/first", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := vfsapi.Open(fs, "/second", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freeClusters, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interleaved writes give every cluster its own extent
+	chunk := make([]byte, fs.Superblock.ClusterSize)
+	for i := 0; i < 50; i++ {
+		for j := range chunk {
+			chunk[j] = byte(i)
+		}
+
+		_, err = first.Write(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = second.Write(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(first.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mutableInode.Inode.ExtentDepth != 1 {
+		t.Errorf("extent depth is %d instead of 1", mutableInode.Inode.ExtentDepth)
+	}
+
+	first, err = vfsapi.Open(fs, "/first", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, data, err := first.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if data[i*int(fs.Superblock.ClusterSize)] != byte(i) {
+			t.Fatalf("cluster %d contains wrong data", i)
+		}
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shrinking drops leaves when extents fit into the inode again
+	_, err = vfs.Shrink(mutableInode, fs.Volume, fs.Superblock, fs.Identity, 2*vfs.VolumePtr(fs.Superblock.ClusterSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mutableInode.Inode.ExtentDepth != 0 || mutableInode.Inode.AllocatedClusters != 2 {
+		t.Errorf("shrunk inode has depth %d and %d clusters",
+			mutableInode.Inode.ExtentDepth, mutableInode.Inode.AllocatedClusters)
+	}
+
+	for _, path := range []string{"/first", "/second"} {
+		err = vfsapi.Remove(fs, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	freeClustersAfterRemove, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freeClustersAfterRemove[0].VolumePtr != freeClusters[0].VolumePtr {
+		t.Error("clusters of removed files weren't freed")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
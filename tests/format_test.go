@@ -0,0 +1,245 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func PrepareFSWithOptions(size vfs.VolumePtr, options vfs.FormatOptions, t *testing.T) vfs.Filesystem {
+	fs, err := vfs.NewFilesystemWithOptions(vfs.NewMemoryVolume(size), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.WriteStructureToVolume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootInodeObj, err := vfs.FindFreeInode(fs.Volume, fs.Superblock, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInode := rootInodeObj.Object.(vfs.Inode)
+
+	err = vfs.InitRootDirectory(&fs, &vfs.MutableInode{
+		Inode:    &rootInode,
+		InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, rootInodeObj.VolumePtr),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fs
+}
+
+func TestFormatOptions(t *testing.T) {
+	options := vfs.DefaultFormatOptions()
+	options.ClusterSize = 1024
+	options.BytesPerInode = 16384
+	options.Signature = "tester"
+	options.Label = "data"
+
+	fs := PrepareFSWithOptions(1e7, options, t)
+	sb := fs.Superblock
+
+	if sb.ClusterSize != 1024 {
+		t.Errorf("cluster size is %d instead of 1024", sb.ClusterSize)
+	}
+
+	inodeCount := (sb.JournalStartAddress - sb.InodesStartAddress) / vfs.VolumePtr(unsafe.Sizeof(vfs.Inode{}))
+	if expected := vfs.VolumePtr(1e7) / 16384; inodeCount != expected {
+		t.Errorf("volume has %d inodes instead of %d", inodeCount, expected)
+	}
+
+	if signature := strings.TrimRight(string(sb.Signature[:]), "\x00"); signature != "tester" {
+		t.Errorf("signature is %q instead of \"tester\"", signature)
+	}
+
+	if label := strings.TrimRight(string(sb.VolumeDescriptor[:]), "\x00"); label != "data" {
+		t.Errorf("label is %q instead of \"data\"", label)
+	}
+
+	if vfs.ClusterPtrToVolumePtr(sb, sb.ClusterCount) > 1e7 {
+		t.Error("data clusters don't fit into volume")
+	}
+
+	err := vfsapi.Mkdir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidFormatOptions(t *testing.T) {
+	invalidOptions := map[string]func(*vfs.FormatOptions){
+		"cluster size isn't power of two": func(o *vfs.FormatOptions) { o.ClusterSize = 1000 },
+		"cluster size is too small":       func(o *vfs.FormatOptions) { o.ClusterSize = 256 },
+		"both inode options":              func(o *vfs.FormatOptions) { o.BytesPerInode = 16384; o.InodeCount = 100 },
+		"bytes per inode is too small":    func(o *vfs.FormatOptions) { o.BytesPerInode = 100 },
+		"too many inodes":                 func(o *vfs.FormatOptions) { o.InodeCount = 1e6 },
+		"signature is too long":           func(o *vfs.FormatOptions) { o.Signature = "0123456789" },
+		"label is too long":               func(o *vfs.FormatOptions) { o.Label = strings.Repeat("x", 300) },
+		"too much reserved":               func(o *vfs.FormatOptions) { o.ReservedPercentage = 90 },
+	}
+
+	for name, modify := range invalidOptions {
+		options := vfs.DefaultFormatOptions()
+		modify(&options)
+
+		_, err := vfs.NewFilesystemWithOptions(vfs.NewMemoryVolume(1e7), options)
+		if _, ok := err.(vfs.InvalidFormatOptions); !ok {
+			t.Errorf("%s: expected InvalidFormatOptions error, got %v", name, err)
+		}
+	}
+}
+
+func TestReservedClusters(t *testing.T) {
+	options := vfs.DefaultFormatOptions()
+	options.ReservedPercentage = 50
+
+	fs := PrepareFSWithOptions(1e7, options, t)
+
+	_, err := vfsapi.Open(fs, "/file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vfsapi.Chown(fs, "/file", 1000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := fs
+	user.Identity = vfs.Identity{Uid: 1000, Gid: 1000}
+
+	file, err := vfsapi.Open(user, "/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One cluster more than is available for users
+	clusters := fs.Superblock.ClusterCount - fs.Superblock.ReservedClusters + 1
+	data := make([]byte, vfs.ClusterPtrToVolumePtr(fs.Superblock, clusters)-fs.Superblock.DataStartAddress)
+	_, err = file.Write(data)
+	if _, ok := err.(vfs.NoFreeClusterAvailableError); !ok {
+		t.Errorf("expected NoFreeClusterAvailableError error, got %v", err)
+	}
+
+	file, err = vfsapi.Open(fs, "/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		t.Errorf("root should be able to use reserved clusters, got %v", err)
+	}
+}
+
+func TestReservedClustersInAllAllocations(t *testing.T) {
+	options := vfs.DefaultFormatOptions()
+	options.ReservedPercentage = 10
+
+	fs := PrepareFSWithOptions(1e7, options, t)
+
+	operations := map[string]func(fs vfs.Filesystem, dir string) error{
+		"write": func(fs vfs.Filesystem, dir string) error {
+			file, err := vfsapi.Open(fs, dir+"/file", true)
+			if err != nil {
+				return err
+			}
+			_, err = file.Write(make([]byte, 1000))
+			return err
+		},
+		"directory growth": func(fs vfs.Filesystem, dir string) error {
+			for i := 0; i < 100; i++ {
+				_, err := vfsapi.Open(fs, fmt.Sprintf("%s/file_%d", dir, i), true)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		"symlink": func(fs vfs.Filesystem, dir string) error {
+			return vfsapi.Symlink(fs, "/"+strings.Repeat("x", 200), dir+"/link")
+		},
+		"xattr": func(fs vfs.Filesystem, dir string) error {
+			return vfsapi.Setxattr(fs, dir, "user.big", make([]byte, 1000))
+		},
+	}
+
+	// Directories are created while there's enough space, the user gets own
+	// directory for every operation
+	for name := range operations {
+		for _, dir := range []string{"/" + name, "/user " + name} {
+			err := vfsapi.Mkdir(fs, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := vfsapi.Chown(fs, "/user "+name, 1000, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only reserved clusters stay free
+	freeClusters, err := vfs.CountFreeClusters(fs.Volume, fs.Superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, freeClusters-fs.Superblock.ReservedClusters, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := fs
+	user.Identity = vfs.Identity{Uid: 1000, Gid: 1000}
+
+	for name, operation := range operations {
+		err = operation(user, "/user "+name)
+		if _, ok := err.(vfs.NoFreeClusterAvailableError); !ok {
+			t.Errorf("%s: expected NoFreeClusterAvailableError error, got %v", name, err)
+		}
+
+		err = operation(fs, "/"+name)
+		if err != nil {
+			t.Errorf("%s: root should be able to use reserved clusters, got %v", name, err)
+		}
+	}
+}
+
+func TestReservedClustersBehindCache(t *testing.T) {
+	options := vfs.DefaultFormatOptions()
+	options.ReservedPercentage = 50
+
+	fs := PrepareFSWithOptions(1e7, options, t)
+
+	// Identity is given to the allocator, so it doesn't matter what is in
+	// front of the volume
+	cachedVolume := vfs.NewCachedVolume(fs.Volume)
+	user := vfs.Identity{Uid: 1000, Gid: 1000}
+
+	freeClusters, err := vfs.CountFreeClusters(fs.Volume, fs.Superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := freeClusters - fs.Superblock.ReservedClusters + 1
+
+	_, err = vfs.FindFreeClusters(cachedVolume, fs.Superblock, user, count, true)
+	if _, ok := err.(vfs.NoFreeClusterAvailableError); !ok {
+		t.Errorf("expected NoFreeClusterAvailableError error, got %v", err)
+	}
+
+	_, err = vfs.FindFreeClusters(cachedVolume, fs.Superblock, fs.Identity, count, true)
+	if err != nil {
+		t.Errorf("root should be able to use reserved clusters, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
 	"os"
 	"testing"
 	"unsafe"
@@ -21,20 +22,24 @@ func TestSuperblockMath(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Create filesystem
-	fs, err := vfs.NewFilesystem(volume, 512)
+	// Create filesystem, 5 % of the volume can't hold any inode, see
+	// TestFormatRejectsVolumeWithoutInodes
+	options := vfs.DefaultFormatOptions()
+	options.ClusterSize = 512
+	options.InodeCount = 3
+	fs, err := vfs.NewFilesystemWithOptions(volume, options)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	s := fs.Superblock
 
-	metadataSize := vfs.VolumePtr(1e4 * 0.05)
-
 	sbSize := vfs.VolumePtr(unsafe.Sizeof(vfs.Superblock{}))
+	inodesSize := vfs.VolumePtr(3 * unsafe.Sizeof(vfs.Inode{}))
 
-	clusterBitmapSize := vfs.VolumePtr(3)
+	clusterBitmapSize := vfs.VolumePtr(2) // for 16 clusters
 	inodeBitmapSize := vfs.VolumePtr(1) // for 3 inodes
+	checksumTableSize := vfs.VolumePtr(72) // 16 clusters and 2 bitmap blocks
 
 	if s.ClusterBitmapStartAddress != sbSize {
 		t.Errorf("ClusterBitmapStartAddress value is not correct! %d, should be %d instead.", s.ClusterBitmapStartAddress, sbSize)
@@ -45,10 +50,218 @@ func TestSuperblockMath(t *testing.T) {
 	if s.InodesStartAddress != s.InodeBitmapStartAddress + inodeBitmapSize {
 		t.Errorf("InodesStartAddress value is not correct! %d, should be %d instead.", s.InodesStartAddress, s.InodeBitmapStartAddress + inodeBitmapSize)
 	}
-	if s.DataStartAddress != metadataSize {
-		t.Errorf("DataStartAddress value is not correct! %d, should be %d instead.", s.DataStartAddress, metadataSize)
+	if s.JournalStartAddress != s.InodesStartAddress + inodesSize {
+		t.Errorf("JournalStartAddress value is not correct! %d, should be %d instead.", s.JournalStartAddress, s.InodesStartAddress + inodesSize)
+	}
+	if s.ChecksumsStartAddress != s.JournalStartAddress + s.JournalSize {
+		t.Errorf("ChecksumsStartAddress value is not correct! %d, should be %d instead.", s.ChecksumsStartAddress, s.JournalStartAddress + s.JournalSize)
+	}
+	if s.DataStartAddress != s.ChecksumsStartAddress + checksumTableSize {
+		t.Errorf("DataStartAddress value is not correct! %d, should be %d instead.", s.DataStartAddress, s.ChecksumsStartAddress + checksumTableSize)
+	}
+	if s.ClusterCount != vfs.ClusterPtr((1e4-s.DataStartAddress)/vfs.VolumePtr(512)) {
+		t.Errorf("AllocatedClusters value is not correct! %d, should be %d instead.", s.ClusterCount, (1e4-s.DataStartAddress)/vfs.VolumePtr(512))
+	}
+}
+
+func TestFormatRejectsVolumeWithoutInodes(t *testing.T) {
+	// Superblock and metadata of single inode don't fit into 5 % of volume
+	_, err := vfs.NewFilesystem(vfs.NewMemoryVolume(1e4), 512)
+	if _, ok := err.(vfs.InvalidFormatOptions); !ok {
+		t.Errorf("expected InvalidFormatOptions error, got %v", err)
+	}
+}
+
+func TestLoadFilesystemRootInode(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	loadedFs, err := vfs.LoadFilesystem(fs.Volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loadedFs.Superblock.RootInodePtr != fs.RootInodePtr {
+		t.Errorf("root inode is %d instead of %d", loadedFs.Superblock.RootInodePtr, fs.RootInodePtr)
+	}
+
+	if loadedFs.RootInodePtr != fs.RootInodePtr || loadedFs.CurrentInodePtr != fs.RootInodePtr {
+		t.Error("loaded filesystem doesn't start in root directory")
+	}
+}
+
+func TestLoadFilesystemRejectsUnknownVolume(t *testing.T) {
+	volume := vfs.NewMemoryVolume(1e6)
+
+	_, err := vfs.LoadFilesystem(volume)
+	if _, ok := err.(vfs.UnknownVolumeFormat); !ok {
+		t.Errorf("expected UnknownVolumeFormat, got %v", err)
+	}
+}
+
+func TestLoadFilesystemRejectsNewerVersion(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	fs.Superblock.FormatVersion = vfs.FormatVersion + 1
+	err := fs.WriteSuperblock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = vfs.LoadFilesystem(fs.Volume)
+	if _, ok := err.(vfs.UnsupportedFormatVersion); !ok {
+		t.Errorf("expected UnsupportedFormatVersion, got %v", err)
+	}
+
+	fs.Superblock.FormatVersion = vfs.FormatVersion
+	fs.Superblock.FeatureFlags |= 1 << 31
+	err = fs.WriteSuperblock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = vfs.LoadFilesystem(fs.Volume)
+	if _, ok := err.(vfs.UnsupportedFeatures); !ok {
+		t.Errorf("expected UnsupportedFeatures, got %v", err)
+	}
+}
+
+func TestRecoveryFromBackupSuperblock(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	data := patternData(10000, 0)
+	writeFile(fs, "/file", data, t)
+
+	err := fs.Volume.WriteStruct(0, make([]byte, unsafe.Sizeof(vfs.Superblock{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = vfs.LoadFilesystem(fs.Volume)
+	if err == nil {
+		t.Fatal("filesystem was loaded with overwritten superblock")
+	}
+
+	backupFs, err := vfs.LoadFilesystemFromBackup(fs.Volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupFs.Superblock != fs.Superblock {
+		t.Error("backup superblock differs from the original one")
+	}
+
+	checkRepaired(backupFs, vfsapi.BadSuperblock, t)
+
+	loadedFs, err := vfs.LoadFilesystem(fs.Volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(loadedFs, "/file", data, t)
+}
+
+func TestBackupSuperblocksFollowResize(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	for _, size := range []vfs.VolumePtr{2e7, 5e6} {
+		err := vfsapi.Resize(&fs, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, address := range vfs.BackupSuperblockAddresses(size) {
+			sb, err := vfs.ReadSuperblockAt(fs.Volume, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sb != fs.Superblock {
+				t.Errorf("backup at address %d wasn't updated", address)
+			}
+		}
+
+		err = vfsapi.FsCheck(fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMountTracksCleanUnmount(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	wasDirty, err := fs.Mount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wasDirty {
+		t.Error("new volume is dirty")
+	}
+
+	// Volume wasn't unmounted
+	loadedFs, err := vfs.LoadFilesystem(fs.Volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedFs.Superblock.State != vfs.StateDirty || loadedFs.Superblock.LastMountTime == 0 {
+		t.Error("mount wasn't recorded in superblock")
+	}
+
+	wasDirty, err = loadedFs.Mount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wasDirty {
+		t.Error("volume that wasn't unmounted isn't dirty")
+	}
+
+	err = loadedFs.Unmount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedFs, err = vfs.LoadFilesystem(fs.Volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedFs.Superblock.State != vfs.StateClean || loadedFs.Superblock.MountCount != 2 {
+		t.Errorf("volume has state %d and mount count %d", loadedFs.Superblock.State, loadedFs.Superblock.MountCount)
+	}
+
+	err = vfsapi.FsCheck(loadedFs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMountCountsFreeClusters(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	writeFile(fs, "/file", patternData(10000, 0), t)
+
+	counted, err := vfs.CountFreeClusters(fs.Volume, fs.Superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Allocations don't change the count in superblock
+	fs.Superblock.FreeClusters = counted + 5
+	err = fs.WriteSuperblock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedFs, err := vfs.LoadFilesystem(fs.Volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadedFs.Mount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedFs, err = vfs.LoadFilesystem(fs.Volume)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if s.ClusterCount != vfs.ClusterPtr((1e4-metadataSize)/vfs.VolumePtr(512)) {
-		t.Errorf("AllocatedClusters value is not correct! %d, should be %d instead.", s.ClusterCount, (1e6-metadataSize)/vfs.VolumePtr(512))
+	if loadedFs.Superblock.FreeClusters != counted {
+		t.Errorf("superblock counts %d free clusters instead of %d", loadedFs.Superblock.FreeClusters, counted)
 	}
 }
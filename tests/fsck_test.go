@@ -0,0 +1,207 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"testing"
+)
+
+func findProblem(report vfsapi.FsCheckReport, kind vfsapi.FsCheckProblemKind) (vfsapi.FsCheckProblem, bool) {
+	for _, problem := range report.Problems {
+		if problem.Kind == kind {
+			return problem, true
+		}
+	}
+
+	return vfsapi.FsCheckProblem{}, false
+}
+
+func checkRepaired(fs vfs.Filesystem, kind vfsapi.FsCheckProblemKind, t *testing.T) vfsapi.FsCheckProblem {
+	report, err := vfsapi.CheckFilesystem(fs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problem, ok := findProblem(report, kind)
+	if !ok {
+		t.Fatalf("problem %q wasn't detected", kind)
+	}
+	if problem.Repaired {
+		t.Error("problem was repaired without repair mode")
+	}
+
+	report, err = vfsapi.CheckFilesystem(fs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range report.Problems {
+		if !problem.Repaired {
+			t.Errorf("problem wasn't repaired: %s", problem)
+		}
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return problem
+}
+
+func TestFsCheckRepairsOrphanedCluster(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	clusters, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterPtr := vfs.VolumePtrToClusterPtr(fs.Superblock, clusters[0].VolumePtr)
+
+	problem := checkRepaired(fs, vfsapi.OrphanedCluster, t)
+	if problem.ClusterPtr != clusterPtr || problem.InodePtr != vfsapi.NoInode {
+		t.Errorf("problem was reported for cluster %d and inode %d", problem.ClusterPtr, problem.InodePtr)
+	}
+
+	isFree, err := vfs.IsClusterFree(fs.Volume, fs.Superblock, clusterPtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFree {
+		t.Error("orphaned cluster wasn't freed")
+	}
+}
+
+func TestFsCheckRepairsZombieInode(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	inodeObj, err := vfs.FindFreeInode(fs.Volume, fs.Superblock, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inodePtr := vfs.VolumePtrToInodePtr(fs.Superblock, inodeObj.VolumePtr)
+
+	problem := checkRepaired(fs, vfsapi.ZombieInode, t)
+	if problem.InodePtr != inodePtr {
+		t.Errorf("problem was reported for inode %d instead of %d", problem.InodePtr, inodePtr)
+	}
+
+	isFree, err := vfs.IsInodeFree(fs.Volume, fs.Superblock, inodePtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFree {
+		t.Error("zombie inode wasn't freed")
+	}
+}
+
+func TestFsCheckRepairsFreeClusterInUse(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	writeFile(fs, "/file", patternData(10000, 0), t)
+
+	file, err := vfsapi.Open(fs, "/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterPtr := mutableInode.Inode.Direct2
+
+	err = vfs.FreeCluster(fs.Volume, fs.Superblock, clusterPtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problem := checkRepaired(fs, vfsapi.FreeClusterInUse, t)
+	if problem.ClusterPtr != clusterPtr || problem.InodePtr != mutableInode.InodePtr || problem.Path != "/file" {
+		t.Errorf("problem was reported for cluster %d, inode %d and path %s",
+			problem.ClusterPtr, problem.InodePtr, problem.Path)
+	}
+
+	checkFile(fs, "/file", patternData(10000, 0), t)
+}
+
+func TestFsCheckReattachesOrphans(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	fileData := patternData(10000, 0)
+	writeFile(fs, "/file", fileData, t)
+
+	err := vfsapi.Mkdir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vfsapi.Mkdir(fs, "/dir/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nestedData := patternData(5000, 1)
+	writeFile(fs, "/dir/sub/nested", nestedData, t)
+
+	file, err := vfsapi.Open(fs, "/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInodePtr := file.InodePtr()
+	dir, err := vfsapi.Open(fs, "/dir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirInodePtr := dir.InodePtr()
+
+	err = vfsapi.BadRemove(fs, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// BadRemove refuses non-empty directories
+	rootMutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, fs.RootInodePtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = vfs.RemoveDirectoryEntry(fs.Volume, fs.Superblock, fs.Identity, rootMutableInode, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := vfsapi.CheckFilesystem(fs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zombies := 0
+	for _, problem := range report.Problems {
+		if problem.Kind == vfsapi.ZombieInode {
+			zombies++
+		}
+		if !problem.Repaired {
+			t.Errorf("problem wasn't repaired: %s", problem)
+		}
+	}
+	if zombies != 4 {
+		t.Errorf("%d zombie inodes were found instead of 4", zombies)
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := fmt.Sprintf("/lost+found/#%d", fileInodePtr)
+	dirPath := fmt.Sprintf("/lost+found/#%d", dirInodePtr)
+	checkFile(fs, filePath, fileData, t)
+	checkFile(fs, dirPath+"/sub/nested", nestedData, t)
+
+	lostFound, err := vfsapi.Open(fs, "/lost+found", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := vfsapi.Open(fs, dirPath+"/..", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent.InodePtr() != lostFound.InodePtr() {
+		t.Error("\"..\" of reattached directory doesn't point to lost+found")
+	}
+}
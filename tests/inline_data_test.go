@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"testing"
+)
+
+func TestTinyFileIsInline(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	freeClusters, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := vfsapi.Open(fs, "/tiny", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !file.Stat().IsInline() {
+		t.Error("tiny file should be stored inline")
+	}
+
+	freeClustersAfterWrite, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freeClustersAfterWrite[0].VolumePtr != freeClusters[0].VolumePtr {
+		t.Error("tiny file shouldn't allocate any cluster")
+	}
+
+	// File is moved to clusters when it grows
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutableInode.Inode.HasInlineData() || mutableInode.Inode.AllocatedClusters != 1 {
+		t.Errorf("grown file has inline flag %t and %d clusters",
+			mutableInode.Inode.HasInlineData(), mutableInode.Inode.AllocatedClusters)
+	}
+
+	file, err = vfsapi.Open(fs, "/tiny", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, readData, err := file.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readData, append([]byte("hello"), data...)) {
+		t.Errorf("data are %q", readData)
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Remove(fs, "/tiny")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freeClustersAfterRemove, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freeClustersAfterRemove[0].VolumePtr != freeClusters[0].VolumePtr {
+		t.Error("cluster of removed file wasn't freed")
+	}
+}
+
+func TestSmallDirectoryIsInline(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	err := vfsapi.Mkdir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := vfsapi.Open(fs, "/dir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dir.Stat().IsInline() {
+		t.Error("empty directory should be stored inline")
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err = vfsapi.Open(fs, fmt.Sprintf("/dir/file_%d", i), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err = vfsapi.Open(fs, "/dir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.Stat().IsInline() {
+		t.Error("directory with many entries should be moved to clusters")
+	}
+
+	fileInfos, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileInfos) != 12 {
+		t.Errorf("directory has %d entries instead of 12", len(fileInfos))
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
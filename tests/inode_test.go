@@ -8,13 +8,7 @@ import (
 
 func PrepareInode(fsSize vfs.VolumePtr, allocationSize vfs.VolumePtr, t *testing.T) (vfs.Filesystem, vfs.Inode, vfs.InodePtr) {
 	// Create volume
-	path := tempFileName("", "")
-	err := vfs.PrepareVolumeFile(path, fsSize)
-
-	volume, err := vfs.NewVolume(path)
-	if err != nil {
-		t.Fatal(err)
-	}
+	volume := vfs.NewMemoryVolume(fsSize)
 
 	// Create filesystem
 	fs, err := vfs.NewFilesystem(volume, 4096)
@@ -61,7 +55,7 @@ func PrepareInode(fsSize vfs.VolumePtr, allocationSize vfs.VolumePtr, t *testing
 	_, err = vfs.Allocate(vfs.MutableInode{
 		Inode:    &inode,
 		InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, inodeObject.VolumePtr),
-	}, fs.Volume, fs.Superblock, allocationSize)
+	}, fs.Volume, fs.Superblock, fs.Identity, allocationSize)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -138,7 +132,7 @@ func TestAppendData(t *testing.T) {
 		data[i] = charset[i%len(charset)]
 	}
 
-	n, err := mutableInode.AppendData(fs.Volume, fs.Superblock, data[:1_000_000])
+	n, err := mutableInode.AppendData(fs.Volume, fs.Superblock, fs.Identity, data[:1_000_000])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -147,7 +141,7 @@ func TestAppendData(t *testing.T) {
 		t.Error("not all data was written")
 	}
 
-	n, err = mutableInode.AppendData(fs.Volume, fs.Superblock, data[1_000_000:])
+	n, err = mutableInode.AppendData(fs.Volume, fs.Superblock, fs.Identity, data[1_000_000:])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -209,7 +203,7 @@ func TestAppendDataReallocation(t *testing.T) {
 	}
 
 	for i := 0; i < len(data)/100; i++ {
-		_, err := mutableInode.AppendData(fs.Volume, fs.Superblock, data[i*100:(i+1)*100])
+		_, err := mutableInode.AppendData(fs.Volume, fs.Superblock, fs.Identity, data[i*100:(i+1)*100])
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"testing"
+)
+
+func TestTransactionReadsOwnWrites(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	tx := vfs.BeginTransaction(fs.Volume, fs.Superblock)
+	err := vfs.OccupyCluster(tx, fs.Superblock, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := tx.ReadByteAt(fs.Superblock.ClusterBitmapStartAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vfs.GetBitInByte(value, 3) != vfs.Occupied {
+		t.Error("transaction doesn't see its own write")
+	}
+
+	value, err = fs.Volume.ReadByteAt(fs.Superblock.ClusterBitmapStartAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vfs.GetBitInByte(value, 3) != vfs.Free {
+		t.Error("uncommitted write reached the volume")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err = fs.Volume.ReadByteAt(fs.Superblock.ClusterBitmapStartAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vfs.GetBitInByte(value, 3) != vfs.Occupied {
+		t.Error("committed write didn't reach the volume")
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	// Simulate crash after the journal was committed but before checkpoint
+	record := make([]byte, 12)
+	record[0] = byte(fs.Superblock.ClusterBitmapStartAddress)
+	record[1] = byte(fs.Superblock.ClusterBitmapStartAddress >> 8)
+	record[8] = 1
+	record = append(record, 0xff)
+
+	err := fs.Volume.WriteStruct(fs.Superblock.JournalStartAddress+16, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Volume.WriteStruct(fs.Superblock.JournalStartAddress, struct {
+		State       byte
+		RecordCount int32
+		Length      vfs.VolumePtr
+	}{vfs.JournalCommitted, 1, vfs.VolumePtr(len(record))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := vfs.ReplayJournal(fs.Volume, fs.Superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replayed {
+		t.Fatal("journal should be replayed")
+	}
+
+	value, err := fs.Volume.ReadByteAt(fs.Superblock.ClusterBitmapStartAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 0xff {
+		t.Errorf("journal record wasn't applied, got %x", value)
+	}
+
+	replayed, err = vfs.ReplayJournal(fs.Volume, fs.Superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed {
+		t.Error("journal should be empty after replay")
+	}
+}
+
+func TestFsCheckAfterJournaledOperations(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	err := vfsapi.Mkdir(fs, "foodir1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Mkdir(fs, "bardir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Rename(fs, "bardir2", "foobardir3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Remove(fs, "foobardir3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTornJournalRecordIsDiscarded(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	// Header of the record announces 4 bytes of data, but only 1 is there
+	record := make([]byte, 12)
+	record[0] = byte(fs.Superblock.ClusterBitmapStartAddress)
+	record[1] = byte(fs.Superblock.ClusterBitmapStartAddress >> 8)
+	record[8] = 4
+	record = append(record, 0xff)
+
+	err := fs.Volume.WriteStruct(fs.Superblock.JournalStartAddress+16, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Volume.WriteStruct(fs.Superblock.JournalStartAddress, struct {
+		State       byte
+		RecordCount int32
+		Length      vfs.VolumePtr
+	}{vfs.JournalCommitted, 1, vfs.VolumePtr(len(record))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := vfs.ReplayJournal(fs.Volume, fs.Superblock)
+	if _, ok := err.(vfs.TornJournalRecord); !ok {
+		t.Errorf("expected TornJournalRecord error, got %v", err)
+	}
+	if replayed {
+		t.Error("torn journal was replayed")
+	}
+
+	value, err := fs.Volume.ReadByteAt(fs.Superblock.ClusterBitmapStartAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value == 0xff {
+		t.Error("torn record was applied")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
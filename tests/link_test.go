@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"testing"
+)
+
+func TestHardLink(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	file, err := vfsapi.Open(fs, "/original", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = file.Write([]byte("shared data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Mkdir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Link(fs, "/original", "/dir/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Remove(fs, "/original")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := vfsapi.Open(fs, "/dir/link", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if link.Stat().LinkCount() != 1 {
+		t.Errorf("link count is %d instead of 1", link.Stat().LinkCount())
+	}
+
+	_, data, err := link.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "shared data" {
+		t.Errorf("data of linked file are %q", data)
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing the last link frees the inode
+	err = vfsapi.Remove(fs, "/dir/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isFree, err := vfs.IsInodeFree(fs.Volume, fs.Superblock, vfs.InodePtr(link.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFree {
+		t.Error("inode without links should be free")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHardLinkToDirectoryIsRejected(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	err := vfsapi.Mkdir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Link(fs, "/dir", "/link")
+	if err == nil {
+		t.Error("directory shouldn't be linked")
+	}
+}
+
+func TestFsCheckDetectsWrongLinkCount(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	file, err := vfsapi.Open(fs, "/file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutableInode.Inode.LinkCount = 2
+	err = mutableInode.Save(fs.Volume, fs.Superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err == nil {
+		t.Error("wrong link count wasn't detected")
+	}
+}
@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryVolumeWriteAndRead(t *testing.T) {
+	volume := vfs.NewMemoryVolume(1000)
+
+	myStruct := MyStruct{
+		A: 115,
+		B: 3524,
+		C: 513651350565461,
+		D: 1516516565,
+		E: 123,
+	}
+
+	err := volume.WriteStruct(53, myStruct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	myReadStruct := MyStruct{}
+	err = volume.ReadStruct(53, &myReadStruct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(myStruct, myReadStruct) {
+		t.Error("read and written data are not equal")
+	}
+
+	// Unwritten part of the volume is read as zeros
+	value, err := volume.ReadByteAt(900)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 0 {
+		t.Errorf("unwritten byte contains %d instead of 0", value)
+	}
+}
+
+func TestMemoryVolumeGrow(t *testing.T) {
+	volume := vfs.NewMemoryVolume(100)
+
+	_, err := volume.ReadByteAt(150)
+	if err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	err = volume.WriteByteAt(150, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := volume.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 151 {
+		t.Errorf("volume size is %d instead of %d", size, 151)
+	}
+
+	value, err := volume.ReadByteAt(150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 42 {
+		t.Errorf("read %d instead of %d", value, 42)
+	}
+}
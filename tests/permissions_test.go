@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"testing"
+)
+
+func TestPermissionsEnforcement(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	for _, path := range []string{"/shared", "/private"} {
+		err := vfsapi.Mkdir(fs, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := vfsapi.Chmod(fs, "/shared", vfs.ModeSticky|0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vfsapi.Chmod(fs, "/private", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := fs
+	alice.Identity = vfs.Identity{Uid: 1000, Gid: 1000}
+	bob := fs
+	bob.Identity = vfs.Identity{Uid: 1001, Gid: 1001}
+
+	err = vfsapi.Mkdir(alice, "/private/dir")
+	if _, ok := err.(vfs.PermissionDenied); !ok {
+		t.Errorf("expected PermissionDenied error, got %v", err)
+	}
+
+	_, err = vfsapi.Open(alice, "/private", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names of extended attributes are readable only with read permission
+	_, err = vfsapi.Listxattr(alice, "/private")
+	if _, ok := err.(vfs.PermissionDenied); !ok {
+		t.Errorf("expected PermissionDenied error, got %v", err)
+	}
+
+	file, err := vfsapi.Open(alice, "/shared/file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := file.Stat()
+	if info.Uid() != 1000 || info.Gid() != 1000 {
+		t.Errorf("file is owned by %d:%d instead of 1000:1000", info.Uid(), info.Gid())
+	}
+	if info.Mode() != vfs.DefaultFileMode {
+		t.Errorf("file has mode %o instead of %o", info.Mode(), vfs.DefaultFileMode)
+	}
+
+	// Others can read, but not write
+	file, err = vfsapi.Open(bob, "/shared/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("foobar"))
+	if _, ok := err.(vfs.PermissionDenied); !ok {
+		t.Errorf("expected PermissionDenied error, got %v", err)
+	}
+
+	err = vfsapi.Chmod(bob, "/shared/file", 0666)
+	if _, ok := err.(vfs.PermissionDenied); !ok {
+		t.Errorf("expected PermissionDenied error, got %v", err)
+	}
+
+	err = vfsapi.Chown(alice, "/shared/file", 1001, 1001)
+	if _, ok := err.(vfs.PermissionDenied); !ok {
+		t.Errorf("expected PermissionDenied error, got %v", err)
+	}
+
+	// Sticky directory protects files of other users
+	err = vfsapi.Remove(bob, "/shared/file")
+	if _, ok := err.(vfs.PermissionDenied); !ok {
+		t.Errorf("expected PermissionDenied error, got %v", err)
+	}
+
+	err = vfsapi.Rename(bob, "/shared/file", "/shared/stolen")
+	if _, ok := err.(vfs.PermissionDenied); !ok {
+		t.Errorf("expected PermissionDenied error, got %v", err)
+	}
+
+	err = vfsapi.Remove(alice, "/shared/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetgidDirectoryInheritsGroup(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	err := vfsapi.Mkdir(fs, "/project")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Chown(fs, "/project", 0, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Chmod(fs, "/project", vfs.ModeSetgid|0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := fs
+	alice.Identity = vfs.Identity{Uid: 1000, Gid: 1000}
+
+	err = vfsapi.Mkdir(alice, "/project/subdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := vfsapi.Open(alice, "/project/subdir", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := file.Stat()
+	if info.Uid() != 1000 || info.Gid() != 500 {
+		t.Errorf("directory is owned by %d:%d instead of 1000:500", info.Uid(), info.Gid())
+	}
+	if info.Mode()&vfs.ModeSetgid == 0 {
+		t.Error("subdirectory should inherit setgid bit")
+	}
+}
@@ -0,0 +1,381 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"testing"
+)
+
+func patternData(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i%251) + seed
+	}
+
+	return data
+}
+
+func writeFile(fs vfs.Filesystem, path string, data []byte, t *testing.T) {
+	file, err := vfsapi.Open(fs, path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFile(fs vfs.Filesystem, path string, expected []byte, t *testing.T) {
+	file, err := vfsapi.Open(fs, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, data, err := file.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, expected) {
+		t.Errorf("data of %s don't match", path)
+	}
+}
+
+func TestGrowFilesystem(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+	clusterCount := fs.Superblock.ClusterCount
+
+	first := patternData(8e6, 0)
+	writeFile(fs, "/first", first, t)
+
+	err := vfsapi.Resize(&fs, 2e7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fs.Superblock.ClusterCount < 2*clusterCount {
+		t.Errorf("volume has %d clusters, at least %d expected", fs.Superblock.ClusterCount, 2*clusterCount)
+	}
+
+	// Second file wouldn't fit into the old volume
+	second := patternData(8e6, 1)
+	writeFile(fs, "/second", second, t)
+
+	checkFile(fs, "/first", first, t)
+	checkFile(fs, "/second", second, t)
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedFs, err := vfs.LoadFilesystem(fs.Volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedFs.Superblock != fs.Superblock {
+		t.Error("resized superblock wasn't written to volume")
+	}
+}
+
+func testShrinkFilesystem(fs vfs.Filesystem, t *testing.T) {
+	// Files created after the big one are at the end of the volume
+	writeFile(fs, "/big", patternData(5e6, 0), t)
+
+	err := vfsapi.Mkdir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		_, err = vfsapi.Open(fs, fmt.Sprintf("/dir/file_%d", i), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kept := patternData(1e6, 1)
+	writeFile(fs, "/kept", kept, t)
+
+	xattrValue := bytes.Repeat([]byte("x"), 1000)
+	err = vfsapi.Setxattr(fs, "/kept", "big", xattrValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Remove(fs, "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Resize(&fs, 4e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := fs.Volume.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 4e6 {
+		t.Errorf("volume has %d bytes instead of 4000000", size)
+	}
+
+	checkFile(fs, "/kept", kept, t)
+
+	value, err := vfsapi.Getxattr(fs, "/kept", "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, xattrValue) {
+		t.Error("extended attribute doesn't match")
+	}
+
+	for i := 0; i < 200; i++ {
+		_, err = vfsapi.Open(fs, fmt.Sprintf("/dir/file_%d", i), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShrinkFilesystem(t *testing.T) {
+	testShrinkFilesystem(PrepareFSForApi(1e7, t), t)
+}
+
+func TestShrinkFilesystemWithExtents(t *testing.T) {
+	testShrinkFilesystem(PrepareFSWithExtents(1e7, t), t)
+}
+
+func TestShrinkPopulatedFilesystem(t *testing.T) {
+	fs := PrepareFSForApi(2e7, t)
+
+	err := vfsapi.Mkdir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 400; i++ {
+		writeFile(fs, fmt.Sprintf("/dir/file_%d", i), patternData(1000, byte(i)), t)
+	}
+
+	// Clusters of new backup superblock are used by the files
+	err = vfsapi.Resize(&fs, 3e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 400; i++ {
+		checkFile(fs, fmt.Sprintf("/dir/file_%d", i), patternData(1000, byte(i)), t)
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShrinkBelowUsedSpace(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+	sb := fs.Superblock
+
+	data := patternData(6e6, 0)
+	writeFile(fs, "/file", data, t)
+
+	err := vfsapi.Resize(&fs, 4e6)
+	if _, ok := err.(vfs.VolumeTooSmall); !ok {
+		t.Errorf("expected VolumeTooSmall error, got %v", err)
+	}
+
+	if fs.Superblock != sb {
+		t.Error("superblock was changed by refused resize")
+	}
+
+	checkFile(fs, "/file", data, t)
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShrinkToUsedSpace(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	first := patternData(2e6, 0)
+	third := patternData(2e6, 2)
+	writeFile(fs, "/first", first, t)
+	writeFile(fs, "/second", patternData(2e6, 1), t)
+	writeFile(fs, "/third", third, t)
+
+	// Clusters of new backup superblock may end up in the free hole
+	err := vfsapi.Remove(fs, "/second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Resize(&fs, 1e6)
+	tooSmall, ok := err.(vfs.VolumeTooSmall)
+	if !ok {
+		t.Fatalf("expected VolumeTooSmall error, got %v", err)
+	}
+
+	// Clusters are freed one by one until the shrink is refused before
+	// anything is moved
+	clusterSize := vfs.VolumePtr(fs.Superblock.ClusterSize)
+	for size := tooSmall.MinSize + 8*clusterSize; ; size -= clusterSize {
+		sb := fs.Superblock
+		err = vfsapi.Resize(&fs, size)
+		if _, ok := err.(vfs.VolumeTooSmall); ok {
+			if fs.Superblock != sb {
+				t.Error("superblock was changed by refused resize")
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkFile(fs, "/first", first, t)
+	checkFile(fs, "/third", third, t)
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// unresizableVolume fails when its size is changed, like host file on full
+// disk
+type unresizableVolume struct {
+	vfs.StorageVolume
+}
+
+func (u unresizableVolume) Resize(size vfs.VolumePtr) error {
+	return errors.New("volume can't be resized")
+}
+
+func TestFailedResizeRestoresState(t *testing.T) {
+	volume := vfs.NewMemoryVolume(1e7)
+	fs := PrepareFSForApiOnVolume(unresizableVolume{volume}, t)
+
+	data := patternData(10000, 0)
+	writeFile(fs, "/file", data, t)
+	state := fs.Superblock.State
+
+	err := vfsapi.Resize(&fs, 2e7)
+	if err == nil {
+		t.Fatal("resize of unresizable volume succeeded")
+	}
+
+	loadedFs, err := vfs.LoadFilesystem(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedFs.Superblock.State != state {
+		t.Errorf("volume is in state %d instead of %d", loadedFs.Superblock.State, state)
+	}
+
+	checkFile(loadedFs, "/file", data, t)
+
+	err = vfsapi.FsCheck(loadedFs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// crashingVolume stops writing after its size is changed, like host that
+// crashes while regions are moved
+type crashingVolume struct {
+	vfs.StorageVolume
+	crashed *bool
+}
+
+func (c crashingVolume) Resize(size vfs.VolumePtr) error {
+	err := c.StorageVolume.Resize(size)
+	*c.crashed = true
+
+	return err
+}
+
+func (c crashingVolume) WriteStruct(volumePtr vfs.VolumePtr, data interface{}) error {
+	if *c.crashed {
+		return errors.New("volume crashed")
+	}
+
+	return c.StorageVolume.WriteStruct(volumePtr, data)
+}
+
+func (c crashingVolume) WriteByteAt(volumePtr vfs.VolumePtr, data byte) error {
+	if *c.crashed {
+		return errors.New("volume crashed")
+	}
+
+	return c.StorageVolume.WriteByteAt(volumePtr, data)
+}
+
+func TestInterruptedResizeIsReported(t *testing.T) {
+	volume := vfs.NewMemoryVolume(1e7)
+	fs := PrepareFSForApiOnVolume(crashingVolume{volume, new(bool)}, t)
+
+	writeFile(fs, "/file", patternData(10000, 0), t)
+
+	err := vfsapi.Resize(&fs, 2e7)
+	if err == nil {
+		t.Fatal("resize of crashing volume succeeded")
+	}
+
+	// Superblock with the old layout mustn't be written
+	err = fs.Unmount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedFs, err := vfs.LoadFilesystem(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedFs.Superblock.State != vfs.StateResizing {
+		t.Errorf("volume is in state %d instead of %d", loadedFs.Superblock.State, vfs.StateResizing)
+	}
+
+	report, err := vfsapi.CheckFilesystem(loadedFs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problem, ok := findProblem(report, vfsapi.InterruptedResize)
+	if !ok {
+		t.Fatal("interrupted resize wasn't reported")
+	}
+	if problem.Repaired {
+		t.Error("interrupted resize can't be repaired")
+	}
+
+	wasDirty, err := loadedFs.Mount()
+	if _, ok := err.(vfs.ResizeInterrupted); !ok {
+		t.Errorf("expected ResizeInterrupted error, got %v", err)
+	}
+	if !wasDirty {
+		t.Error("volume with interrupted resize was mounted as clean")
+	}
+
+	loadedFs, err = vfs.LoadFilesystem(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = vfsapi.CheckFilesystem(loadedFs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := findProblem(report, vfsapi.InterruptedResize); !ok {
+		t.Error("interrupted resize wasn't reported after mount")
+	}
+}
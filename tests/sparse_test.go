@@ -0,0 +1,219 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"io"
+	"testing"
+)
+
+func testSparseFile(fs vfs.Filesystem, t *testing.T) {
+	freeClusters, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := vfsapi.Open(fs, "/sparse", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusterSize := int64(fs.Superblock.ClusterSize)
+	_, err = file.Write([]byte("head"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Gap spans direct pointers and part of indirect1 table
+	_, err = file.Seek(20*clusterSize+10, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("tail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holes, err := vfsapi.HolesInfo(fs, "/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holes) != 1 || holes[0].Logical != 1 || holes[0].Length != 19 {
+		t.Errorf("holes are %v instead of [{1 19}]", holes)
+	}
+
+	file, err = vfsapi.Open(fs, "/sparse", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := file.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make([]byte, 20*clusterSize+14)
+	copy(expected, "head")
+	copy(expected[20*clusterSize+10:], "tail")
+	if !bytes.Equal(data, expected) {
+		t.Error("sparse file doesn't read as zeros in holes")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing into the hole splits it
+	_, err = file.Seek(10*clusterSize+5, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("middle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(expected[10*clusterSize+5:], "middle")
+
+	holes, err = vfsapi.HolesInfo(fs, "/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holes) != 2 || holes[0].Length != 9 || holes[1].Logical != 11 || holes[1].Length != 9 {
+		t.Errorf("holes are %v instead of [{1 9} {11 9}]", holes)
+	}
+
+	file, err = vfsapi.Open(fs, "/sparse", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, err = file.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Error("data of filled hole don't match")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Remove(fs, "/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freeClustersAfterRemove, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freeClustersAfterRemove[0].VolumePtr != freeClusters[0].VolumePtr {
+		t.Error("clusters of removed sparse file weren't freed")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSparseFile(t *testing.T) {
+	testSparseFile(PrepareFSForApi(1e7, t), t)
+}
+
+func TestSparseFileWithExtents(t *testing.T) {
+	testSparseFile(PrepareFSWithExtents(1e7, t), t)
+}
+
+func TestShrinkSparseFileWithExtents(t *testing.T) {
+	fs := PrepareFSWithExtents(1e7, t)
+
+	file, err := vfsapi.Open(fs, "/sparse", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clusters 0-9 are a hole
+	_, err = file.Seek(10*int64(fs.Superblock.ClusterSize), io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("tail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = vfs.Shrink(mutableInode, fs.Volume, fs.Superblock, fs.Identity, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutableInode, err = vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutableInode.Inode.AllocatedClusters != 0 {
+		t.Errorf("shrunk file has %d allocated clusters", mutableInode.Inode.AllocatedClusters)
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWritePastEndClearsStaleData(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	file, err := vfsapi.Open(fs, "/file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(bytes.Repeat([]byte("x"), 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutableInode.Inode.Size = 10
+	err = mutableInode.Save(fs.Volume, fs.Superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err = vfsapi.Open(fs, "/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Seek(50, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err = vfsapi.Open(fs, "/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := file.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(bytes.Repeat([]byte("x"), 10), make([]byte, 50)...)
+	expected = append(expected, 'y')
+	if !bytes.Equal(data, expected) {
+		t.Errorf("data are %q", data)
+	}
+}
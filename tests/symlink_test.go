@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"strings"
+	"testing"
+)
+
+func TestSymlink(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	err := vfsapi.Mkdir(fs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := vfsapi.Open(fs, "/dir/file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = file.Write([]byte("target data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	longTarget := "/" + strings.Repeat("../", 30) + "dir/file"
+	targets := map[string]string{
+		"/absolute": "/dir/file",
+		"/relative": "dir/file",
+		"/dirlink":  "dir",
+		"/long":     longTarget,
+		"/chained":  "relative",
+	}
+
+	for link, target := range targets {
+		err = vfsapi.Symlink(fs, target, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		readTarget, err := vfsapi.Readlink(fs, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readTarget != target {
+			t.Errorf("target of %s is %q instead of %q", link, readTarget, target)
+		}
+	}
+
+	for _, path := range []string{"/absolute", "/relative", "/dirlink/file", "/long", "/chained"} {
+		file, err := vfsapi.Open(fs, path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, data, err := file.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "target data" {
+			t.Errorf("data read through %s are %q", path, data)
+		}
+	}
+
+	fileInfo, err := vfsapi.Lstat(fs, "/dirlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileInfo.IsSymlink() || fileInfo.IsDir() {
+		t.Error("lstat should describe the symlink itself")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing symlink keeps its target
+	for link := range targets {
+		err = vfsapi.Remove(fs, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exists, err := vfsapi.Exists(fs, "/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("target was removed together with symlink")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	err := vfsapi.Symlink(fs, "b", "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Symlink(fs, "a", "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = vfsapi.Open(fs, "/a", false)
+	if _, ok := err.(vfs.TooManySymlinks); !ok {
+		t.Errorf("expected TooManySymlinks error, got %v", err)
+	}
+
+	// Dangling symlink can't be shadowed by new file
+	err = vfsapi.Symlink(fs, "missing", "/dangling")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = vfsapi.Open(fs, "/dangling", true)
+	if _, ok := err.(vfs.DuplicateDirectoryEntry); !ok {
+		t.Errorf("expected DuplicateDirectoryEntry error, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+#!/bin/sh
+# Creates volumes in older format versions that are upgraded by
+# upgrade_test.go. Every volume is created by shell built from the last
+# commit with given format version, v1-short is the only volume without
+# long names.
+set -e
+
+repo=$(git rev-parse --show-toplevel)
+out=$(cd "$(dirname "$0")" && pwd)
+work=$(mktemp -d)
+trap 'git -C "$repo" worktree remove --force "$work/tree"; rm -rf "$work"' EXIT
+
+git -C "$repo" worktree add --detach "$work/tree" HEAD >/dev/null
+
+# Same content as patternData in tests
+pattern() {
+	python3 -c "import sys; sys.stdout.buffer.write(bytes((i % 251 + $2) % 256 for i in range($1)))" > "$3"
+}
+pattern 100 1 "$work/readme"
+pattern 20 2 "$work/tiny"
+pattern 50000 0 "$work/data"
+: > "$work/empty"
+
+generate() {
+	name=$1 version=$2 commit=$3 format=$4
+
+	git -C "$work/tree" checkout --quiet "$commit"
+	(cd "$work/tree" && go build -o "$work/kiv" .)
+
+	entry="entry-with-a-long-name-%03d"
+	if [ "$name" = v1-short ]; then
+		entry="e%03d"
+	fi
+
+	{
+		echo "format $format"
+		echo "mkdir docs"
+		echo "incp $work/readme docs/readme.txt"
+		echo "incp $work/tiny docs/tiny.txt"
+		echo "incp $work/data data.bin"
+		echo "mkdir many"
+		for i in $(seq 0 149); do
+			echo "incp $work/empty many/$(printf "$entry" "$i")"
+		done
+		echo "rm many/$(printf "$entry" 7)"
+		if [ "$version" -ge 5 ]; then
+			echo "chmod 600 docs/readme.txt"
+			echo "chown 1000:100 data.bin"
+		fi
+		if [ "$version" -ge 6 ]; then
+			echo "ln docs/readme.txt hardlink.txt"
+		fi
+		if [ "$version" -ge 7 ]; then
+			echo "ln -s docs/readme.txt symlink"
+			echo "ln -s /many/entry-with-a-long-name-001/../../many/entry-with-a-long-name-002 longlink"
+		fi
+		if [ "$version" -ge 8 ]; then
+			echo "setxattr docs/readme.txt user.comment short value"
+			echo "setxattr data.bin user.long $(printf 'x%.0s' $(seq 1 100))"
+		fi
+		echo "exit"
+	} | (cd "$work" && ./kiv "$work/$name.img") > "$work/$name.log"
+
+	if grep -v -e '^OK$' -e '^$' "$work/$name.log"; then
+		echo "commands failed for $name" >&2
+		exit 1
+	fi
+	gzip -9 -n -c "$work/$name.img" > "$out/$name.img.gz"
+}
+
+generate v1-short 1 8362d89 2MB
+generate v1 1 330f9d9 2MB
+generate v2 2 348f689 2MB
+generate v3 3 11bbcf2 2MB
+generate v4 4 ae70fd7 2MB
+generate v5 5 e506190 2MB
+generate v6 6 7d0979f 2MB
+generate v7 7 2be6b5f 2MB
+generate v8 8 9deae80 2MB
+generate v9 9 9a414f5 2MB
+generate v10 10 1d1508b 2MB
+generate v11 11 5a86f06 "-m 5 2MB"
+generate v12 12 4f22b5a "-c -m 5 2MB"
+generate v13 13 07aa493 "-m 5 2MB"
+generate v14 14 2fcaf7e "-e -m 5 2MB"
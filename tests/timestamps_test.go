@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"testing"
+	"time"
+)
+
+func TestFileTimestamps(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	beforeCreation := time.Now()
+	file, err := vfsapi.Open(fs, "/myfile", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := file.Stat()
+	if info.CreationTime().Before(beforeCreation) || info.CreationTime().After(time.Now()) {
+		t.Errorf("creation time %v is not between %v and now", info.CreationTime(), beforeCreation)
+	}
+	if !info.ModTime().Equal(info.CreationTime()) {
+		t.Errorf("new file has modification time %v instead of %v", info.ModTime(), info.CreationTime())
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	_, err = file.Write([]byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info = file.Stat()
+	if !info.ModTime().After(info.CreationTime()) {
+		t.Error("write didn't update modification time")
+	}
+	if !info.ChangeTime().Equal(info.ModTime()) {
+		t.Error("write didn't update change time")
+	}
+	modTime := info.ModTime()
+
+	time.Sleep(2 * time.Millisecond)
+	err = vfsapi.Rename(fs, "/myfile", "/renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err = vfsapi.Open(fs, "/renamed", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info = file.Stat()
+	if !info.ModTime().Equal(modTime) {
+		t.Error("rename shouldn't change modification time")
+	}
+	if !info.ChangeTime().After(modTime) {
+		t.Error("rename didn't update change time")
+	}
+
+	_, _, err = file.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info = file.Stat()
+	if !info.AccessTime().After(info.ModTime()) {
+		t.Error("read didn't update access time")
+	}
+}
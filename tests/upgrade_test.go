@@ -0,0 +1,227 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Volumes in testdata were created by generate.sh with shell of older
+// versions, v1-short doesn't have long names
+var legacyVolumes = []struct {
+	name    string
+	version uint16
+}{
+	{"v1-short", 1},
+	{"v1", 1},
+	{"v2", 2},
+	{"v3", 3},
+	{"v4", 4},
+	{"v5", 5},
+	{"v6", 6},
+	{"v7", 7},
+	{"v8", 8},
+	{"v9", 9},
+	{"v10", 10},
+	{"v11", 11},
+	{"v12", 12},
+	{"v13", 13},
+	{"v14", 14},
+}
+
+func loadLegacyVolume(name string, t *testing.T) vfs.MemoryVolume {
+	file, err := os.Open(filepath.Join("testdata", name+".img.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := vfs.NewMemoryVolume(vfs.VolumePtr(len(data)))
+	err = volume.WriteStruct(0, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return volume
+}
+
+func legacyEntryName(volumeName string, i int) string {
+	if volumeName == "v1-short" {
+		return fmt.Sprintf("e%03d", i)
+	}
+
+	return fmt.Sprintf("entry-with-a-long-name-%03d", i)
+}
+
+func loadInodeByPath(fs vfs.Filesystem, path string, t *testing.T) vfs.Inode {
+	file, err := vfsapi.Open(fs, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return *mutableInode.Inode
+}
+
+func TestLoadFilesystemRejectsOutdatedVersion(t *testing.T) {
+	volume := loadLegacyVolume("v14", t)
+
+	_, err := vfs.LoadFilesystem(volume)
+	if err != (vfs.OutdatedFormatVersion{Version: 14}) {
+		t.Errorf("expected OutdatedFormatVersion, got %v", err)
+	}
+}
+
+func TestUpgradeFilesystem(t *testing.T) {
+	started := time.Now()
+
+	for _, legacy := range legacyVolumes {
+		t.Run(legacy.name, func(t *testing.T) {
+			volume := loadLegacyVolume(legacy.name, t)
+
+			fs, err := vfs.UpgradeFilesystem(volume)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fs.Superblock.FormatVersion != vfs.FormatVersion {
+				t.Errorf("format version is %d instead of %d", fs.Superblock.FormatVersion, vfs.FormatVersion)
+			}
+			if fs.Superblock.ClusterSize != 4096 {
+				t.Errorf("cluster size is %d instead of 4096", fs.Superblock.ClusterSize)
+			}
+
+			err = vfsapi.FsCheck(fs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkFile(fs, "/docs/readme.txt", patternData(100, 1), t)
+			checkFile(fs, "/docs/tiny.txt", patternData(20, 2), t)
+			checkFile(fs, "/data.bin", patternData(50000, 0), t)
+
+			for i := 0; i < 150; i++ {
+				exists, err := vfsapi.Exists(fs, "/many/"+legacyEntryName(legacy.name, i))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if exists != (i != 7) {
+					t.Errorf("entry %d exists: %t", i, exists)
+				}
+			}
+
+			many := loadInodeByPath(fs, "/many", t)
+			if (many.DirectoryIndex != vfs.Unused) != (legacy.name != "v1-short") {
+				t.Error("large directory isn't indexed")
+			}
+
+			data := loadInodeByPath(fs, "/data.bin", t)
+			if legacy.version >= 4 && time.Unix(0, data.ModifyTime).After(started) {
+				t.Error("modification time wasn't kept")
+			}
+			if legacy.version >= 5 && (data.Uid != 1000 || data.Gid != 100) {
+				t.Errorf("owner is %d:%d instead of 1000:100", data.Uid, data.Gid)
+			}
+
+			readme := loadInodeByPath(fs, "/docs/readme.txt", t)
+			if legacy.version >= 5 && readme.Mode != 0600 {
+				t.Errorf("mode is %o instead of 600", readme.Mode)
+			}
+
+			if legacy.version >= 6 {
+				checkFile(fs, "/hardlink.txt", patternData(100, 1), t)
+				if readme.LinkCount != 2 {
+					t.Errorf("link count is %d instead of 2", readme.LinkCount)
+				}
+			}
+
+			if legacy.version >= 7 {
+				target, err := vfsapi.Readlink(fs, "/symlink")
+				if err != nil || target != "docs/readme.txt" {
+					t.Errorf("symlink points to %s, %v", target, err)
+				}
+
+				target, err = vfsapi.Readlink(fs, "/longlink")
+				if err != nil || target != "/many/entry-with-a-long-name-001/../../many/entry-with-a-long-name-002" {
+					t.Errorf("symlink points to %s, %v", target, err)
+				}
+			}
+
+			if legacy.version >= 8 {
+				value, err := vfsapi.Getxattr(fs, "/docs/readme.txt", "user.comment")
+				if err != nil || string(value) != "short value" {
+					t.Errorf("attribute is %s, %v", value, err)
+				}
+
+				value, err = vfsapi.Getxattr(fs, "/data.bin", "user.long")
+				if err != nil || !bytes.Equal(value, bytes.Repeat([]byte("x"), 100)) {
+					t.Errorf("attribute is %s, %v", value, err)
+				}
+			}
+
+			if legacy.version >= 11 && fs.Superblock.ReservedClusters == 0 {
+				t.Error("reserved clusters weren't kept")
+			}
+			if fs.Superblock.HasFeature(vfs.FeatureDataChecksums) != (legacy.version == 12) {
+				t.Error("data checksums weren't kept")
+			}
+			if fs.Superblock.HasFeature(vfs.FeatureExtents) != (legacy.version == 14) {
+				t.Error("extents weren't kept")
+			}
+
+			// Upgraded volume is loaded and used like any other
+			fs, err = vfs.LoadFilesystem(volume)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writeFile(fs, "/many/new", patternData(10000, 3), t)
+			err = vfsapi.Remove(fs, "/data.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = vfsapi.FsCheck(fs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFile(fs, "/many/new", patternData(10000, 3), t)
+		})
+	}
+}
+
+func TestUpgradeFilesystemLoadsCurrentVersion(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+	writeFile(fs, "/file", patternData(10000, 0), t)
+
+	upgradedFs, err := vfs.UpgradeFilesystem(fs.Volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upgradedFs.Superblock != fs.Superblock {
+		t.Error("superblock of current volume was changed")
+	}
+	checkFile(upgradedFs, "/file", patternData(10000, 0), t)
+}
@@ -8,14 +8,12 @@ import (
 
 func PrepareFSForApi(size vfs.VolumePtr, t *testing.T) vfs.Filesystem {
 	// Create volume
-	path := tempFileName("", "")
-	err := vfs.PrepareVolumeFile(path, size)
+	volume := vfs.NewMemoryVolume(size)
 
-	volume, err := vfs.NewVolume(path)
-	if err != nil {
-		t.Fatal(err)
-	}
+	return PrepareFSForApiOnVolume(volume, t)
+}
 
+func PrepareFSForApiOnVolume(volume vfs.StorageVolume, t *testing.T) vfs.Filesystem {
 	// Create filesystem
 	fs, err := vfs.NewFilesystem(volume, 2048)
 	if err != nil {
@@ -70,7 +68,7 @@ func PrepareFSForApi(size vfs.VolumePtr, t *testing.T) vfs.Filesystem {
 
 func TestListDirectories(t *testing.T) {
 	fs := PrepareFSForApi(1e7, t)
-	file, err := vfsapi.Open(fs, "/")
+	file, err := vfsapi.Open(fs, "/", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -113,7 +111,7 @@ func TestListDirectoriesWithCreatedDirectory(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	file, err := vfsapi.Open(fs, "/")
+	file, err := vfsapi.Open(fs, "/", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -172,7 +170,7 @@ func TestCreateNestedDirectory(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	file, err := vfsapi.Open(fs, "/foodir1")
+	file, err := vfsapi.Open(fs, "/foodir1", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -234,7 +232,7 @@ func TestDeleteEmptyDirectory(t *testing.T) {
 	}
 
 	// List directory
-	file, err := vfsapi.Open(fs, "/")
+	file, err := vfsapi.Open(fs, "/", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -303,7 +301,7 @@ func TestRenameDirectory(t *testing.T) {
 	}
 
 	// List directory
-	file, err := vfsapi.Open(fs, "/")
+	file, err := vfsapi.Open(fs, "/", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -386,7 +384,7 @@ func TestRenameNestedDirectory(t *testing.T) {
 	}
 
 	// List root directory
-	rootFile, err := vfsapi.Open(fs, "/")
+	rootFile, err := vfsapi.Open(fs, "/", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -411,7 +409,7 @@ func TestRenameNestedDirectory(t *testing.T) {
 	}
 
 	// List foodir1 directory
-	fooDir1File, err := vfsapi.Open(fs, "foodir1")
+	fooDir1File, err := vfsapi.Open(fs, "foodir1", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -436,7 +434,7 @@ func TestRenameNestedDirectory(t *testing.T) {
 	}
 
 	// List foodir2 directory
-	fooDir2File, err := vfsapi.Open(fs, "foodir2")
+	fooDir2File, err := vfsapi.Open(fs, "foodir2", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -464,12 +462,12 @@ func TestRenameNestedDirectory(t *testing.T) {
 func TestCreateNewFile(t *testing.T) {
 	fs := PrepareFSForApi(1e7, t)
 
-	_, err := vfsapi.Open(fs, "/myfile")
+	_, err := vfsapi.Open(fs, "/myfile", true)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	rootFile, err := vfsapi.Open(fs, "/")
+	rootFile, err := vfsapi.Open(fs, "/", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"github.com/PapiCZ/kiv_zos/vfsapi"
+	"testing"
+)
+
+func TestXattrs(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	file, err := vfsapi.Open(fs, "/file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Setxattr(fs, "/file", "content-type", []byte("text/plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, vfs.InodePtr(file.InodePtr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutableInode.Inode.XattrCluster != vfs.Unused {
+		t.Error("short attribute should be stored inline")
+	}
+
+	// Long values overflow into cluster
+	longValue := bytes.Repeat([]byte("x"), 500)
+	for i := 0; i < 3; i++ {
+		err = vfsapi.Setxattr(fs, "/file", fmt.Sprintf("long_%d", i), longValue)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = vfsapi.Setxattr(fs, "/file", "content-type", []byte("application/json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := vfsapi.Listxattr(fs, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedNames := []string{"content-type", "long_0", "long_1", "long_2"}
+	if fmt.Sprint(names) != fmt.Sprint(expectedNames) {
+		t.Errorf("attributes are %v instead of %v", names, expectedNames)
+	}
+
+	value, err := vfsapi.Getxattr(fs, "/file", "content-type")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "application/json" {
+		t.Errorf("value of content-type is %q", value)
+	}
+
+	value, err = vfsapi.Getxattr(fs, "/file", "long_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, longValue) {
+		t.Error("value of long_2 doesn't match")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = vfsapi.Removexattr(fs, "/file", fmt.Sprintf("long_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = vfsapi.Getxattr(fs, "/file", "long_0")
+	if _, ok := err.(vfs.XattrNotFound); !ok {
+		t.Errorf("expected XattrNotFound error, got %v", err)
+	}
+
+	err = mutableInode.Reload(fs.Volume, fs.Superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutableInode.Inode.XattrCluster != vfs.Unused {
+		t.Error("overflow cluster should be freed")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXattrSpaceLimit(t *testing.T) {
+	fs := PrepareFSForApi(1e7, t)
+
+	_, err := vfsapi.Open(fs, "/file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Setxattr(fs, "/file", "huge", make([]byte, 2*fs.Superblock.ClusterSize))
+	if _, ok := err.(vfs.NoXattrSpace); !ok {
+		t.Errorf("expected NoXattrSpace error, got %v", err)
+	}
+
+	freeClusters, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vfsapi.Setxattr(fs, "/file", "big", make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing file frees overflow cluster too
+	err = vfsapi.Remove(fs, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freeClustersAfterRemove, err := vfs.FindFreeClusters(fs.Volume, fs.Superblock, fs.Identity, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freeClustersAfterRemove[0].VolumePtr != freeClusters[0].VolumePtr {
+		t.Error("overflow cluster wasn't freed")
+	}
+
+	err = vfsapi.FsCheck(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
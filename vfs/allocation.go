@@ -26,14 +26,72 @@ func (n NoFreeClusterAvailableError) Error() string {
 	return "no free cluster is available"
 }
 
-func Allocate(mutableInode MutableInode, volume ReadWriteVolume, sb Superblock, size VolumePtr) (VolumePtr, error) {
+type FileTooLarge struct {
+	Size    VolumePtr
+	MaxSize VolumePtr
+}
+
+func (f FileTooLarge) Error() string {
+	return fmt.Sprintf("file of size %d can't be mapped by inode, maximal size is %d", f.Size, f.MaxSize)
+}
+
+func Allocate(mutableInode MutableInode, volume ReadWriteVolume, sb Superblock, identity Identity, size VolumePtr) (VolumePtr, error) {
 	// TODO: Maybe should return VolumeObject because caller doesn't know address of the mutableInode
 	// TODO: Do we have enough clusters and space?
 
+	// Data clusters are checked before anything is allocated, pointer tables
+	// are checked when they are found
+	err := checkReservedClusters(volume, sb, identity, NeededClusters(sb, size))
+	if err != nil {
+		return 0, err
+	}
+
+	if mutableInode.Inode.HasInlineData() {
+		err := mutableInode.moveInlineDataToClusters(volume, sb, identity)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if !mutableInode.Inode.UsesExtents() {
+		allocatedClusters := VolumePtr(mutableInode.Inode.AllocatedClusters) + VolumePtr(NeededClusters(sb, size))
+		if allocatedClusters > maxFileClusters(sb) {
+			return 0, FileTooLarge{
+				Size:    allocatedClusters * VolumePtr(sb.ClusterSize),
+				MaxSize: maxFileClusters(sb) * VolumePtr(sb.ClusterSize),
+			}
+		}
+	}
+
+	// Bitmap bits and pointer tables are modified many times, keep them in memory
+	cachedVolume := NewCachedVolume(volume)
+	allocatedSize, err := allocate(mutableInode.Inode, cachedVolume, sb, identity, size)
+	flushErr := cachedVolume.Flush()
+	if err != nil {
+		return 0, err
+	}
+	if flushErr != nil {
+		return 0, flushErr
+	}
+
+	// Save modified inode
+	err = mutableInode.Save(volume, sb)
+	if err != nil {
+		return allocatedSize, err
+	}
+
+	return allocatedSize, nil
+}
+
+func allocate(inode *Inode, volume ReadWriteVolume, sb Superblock, identity Identity, size VolumePtr) (VolumePtr, error) {
+	if inode.UsesExtents() {
+		return allocateExtents(inode, volume, sb, identity, size)
+	}
+
 	allocatedSize := VolumePtr(0)
 
 	// Allocate direct blocks
-	allocatedSizeDirect, err := allocateDirect(mutableInode.Inode, volume, sb, size)
+	allocatedSizeDirect, err := allocateDirect(inode, volume, sb, identity, size)
 	if err != nil {
 		return 0, err
 	}
@@ -42,7 +100,7 @@ func Allocate(mutableInode MutableInode, volume ReadWriteVolume, sb Superblock,
 
 	if size > 0 {
 		// Allocate indirect1
-		allocatedSizeIndirect1, err := allocateIndirect1(mutableInode.Inode, volume, sb, size)
+		allocatedSizeIndirect1, err := allocateIndirect1(inode, volume, sb, identity, size)
 		if err != nil {
 			return 0, err
 		}
@@ -50,30 +108,37 @@ func Allocate(mutableInode MutableInode, volume ReadWriteVolume, sb Superblock,
 		allocatedSize += allocatedSizeIndirect1
 
 		if size > 0 {
-			// Allocate indirect2
-			allocatedSizeIndirect2, err := allocateIndirect2(mutableInode.Inode, volume, sb, size)
-			if err != nil {
-				return 0, err
+			// Allocate indirect2, only as much as fits into it
+			sizeIndirect2 := size
+			freeIndirect2Size := (getPtrsPerCluster(sb)*getPtrsPerCluster(sb) - VolumePtr(allocatedDataClustersInIndirect2(*inode, sb))) * VolumePtr(sb.ClusterSize)
+			if sizeIndirect2 > freeIndirect2Size {
+				sizeIndirect2 = freeIndirect2Size
 			}
-			allocatedSize += allocatedSizeIndirect2
-		}
-	}
 
-	// Save modified inode
-	err = mutableInode.Save(volume, sb)
-	if err != nil {
-		return allocatedSize, err
+			if sizeIndirect2 > 0 {
+				allocatedSizeIndirect2, err := allocateIndirect2(inode, volume, sb, identity, sizeIndirect2)
+				if err != nil {
+					return 0, err
+				}
+				size -= allocatedSizeIndirect2
+				allocatedSize += allocatedSizeIndirect2
+			}
+
+			if size > 0 {
+				// Allocate indirect3
+				allocatedSizeIndirect3, err := allocateIndirect3(inode, volume, sb, identity, size)
+				if err != nil {
+					return 0, err
+				}
+				allocatedSize += allocatedSizeIndirect3
+			}
+		}
 	}
 
 	return allocatedSize, nil
 }
 
-func allocateDirect(inode *Inode, volume ReadWriteVolume, sb Superblock, size VolumePtr) (VolumePtr, error) {
-	//volume = NewCachedVolume(volume)
-	//defer func() {
-	//	_ = volume.(CachedVolume).Flush()
-	//}()
-
+func allocateDirect(inode *Inode, volume ReadWriteVolume, sb Superblock, identity Identity, size VolumePtr) (VolumePtr, error) {
 	directPtrs := []*ClusterPtr{
 		&inode.Direct1,
 		&inode.Direct2,
@@ -89,7 +154,7 @@ func allocateDirect(inode *Inode, volume ReadWriteVolume, sb Superblock, size Vo
 		size = VolumePtr(len(directPtrs) * int(sb.ClusterSize))
 	}
 	neededClusters := NeededClusters(sb, size)
-	clusterObjects, err := FindFreeClusters(volume, sb, neededClusters, true)
+	clusterObjects, err := FindFreeClusters(volume, sb, identity, neededClusters, true)
 	if err != nil {
 		return 0, err
 	}
@@ -105,15 +170,10 @@ func allocateDirect(inode *Inode, volume ReadWriteVolume, sb Superblock, size Vo
 	return allocatedSize, nil
 }
 
-func allocateIndirect1(inode *Inode, volume ReadWriteVolume, sb Superblock, size VolumePtr) (VolumePtr, error) {
-	//volume = NewCachedVolume(volume)
-	//defer func() {
-	//	_ = volume.(CachedVolume).Flush()
-	//}()
-
+func allocateIndirect1(inode *Inode, volume ReadWriteVolume, sb Superblock, identity Identity, size VolumePtr) (VolumePtr, error) {
 	if inode.Indirect1 == Unused {
 		// Allocate single pointer table
-		singlePtrTableObj, err := FindFreeClusters(volume, sb, 1, true)
+		singlePtrTableObj, err := FindFreeClusters(volume, sb, identity, 1, true)
 		if err != nil {
 			return 0, err
 		}
@@ -131,7 +191,7 @@ func allocateIndirect1(inode *Inode, volume ReadWriteVolume, sb Superblock, size
 		float64(getPtrsPerCluster(sb)-VolumePtr(singlePtrTableOffset)),
 	))
 
-	dataClusterObjects, err := FindFreeClusters(volume, sb, neededDataClusters, true)
+	dataClusterObjects, err := FindFreeClusters(volume, sb, identity, neededDataClusters, true)
 
 	// Convert volume ptrs to cluster ptrs
 	singlePtrs := make([]ClusterPtr, neededDataClusters)
@@ -165,15 +225,10 @@ func allocatedDataClustersInIndirect1(inode Inode, sb Superblock) ClusterPtr {
 	}
 }
 
-func allocateIndirect2(inode *Inode, volume ReadWriteVolume, sb Superblock, size VolumePtr) (VolumePtr, error) {
-	//volume = NewCachedVolume(volume)
-	//defer func() {
-	//	_ = volume.(CachedVolume).Flush()
-	//}()
-
+func allocateIndirect2(inode *Inode, volume ReadWriteVolume, sb Superblock, identity Identity, size VolumePtr) (VolumePtr, error) {
 	if inode.Indirect2 == Unused {
 		// Allocate double pointer table
-		doublePtrTableObj, err := FindFreeClusters(volume, sb, 1, true)
+		doublePtrTableObj, err := FindFreeClusters(volume, sb, identity, 1, true)
 		if err != nil {
 			return 0, err
 		}
@@ -197,13 +252,13 @@ func allocateIndirect2(inode *Inode, volume ReadWriteVolume, sb Superblock, size
 	))
 
 	// Allocate new data clusters
-	dataClusterObjects, err := FindFreeClusters(volume, sb, neededDataClusters, true)
+	dataClusterObjects, err := FindFreeClusters(volume, sb, identity, neededDataClusters, true)
 	if err != nil {
 		return 0, nil
 	}
 
 	// Allocate new single pointer clusters
-	singlePtrClusterObjects, err := FindFreeClusters(volume, sb, neededNewSinglePtrTables, true)
+	singlePtrClusterObjects, err := FindFreeClusters(volume, sb, identity, neededNewSinglePtrTables, true)
 	if err != nil {
 		return 0, nil
 	}
@@ -278,7 +333,7 @@ func allocateIndirect2(inode *Inode, volume ReadWriteVolume, sb Superblock, size
 
 func allocatedSinglePtrTablesInIndirect2(inode Inode, sb Superblock) ClusterPtr {
 	result := ClusterPtr(math.Ceil(
-		float64(inode.AllocatedClusters-InodeDirectCount-ClusterPtr(getPtrsPerCluster(sb))) / float64(getPtrsPerCluster(sb)),
+		float64(allocatedDataClustersInIndirect2(inode, sb)) / float64(getPtrsPerCluster(sb)),
 	))
 
 	if result > 0 {
@@ -294,39 +349,257 @@ func allocatedDataClustersInIndirect2(inode Inode, sb Superblock) ClusterPtr {
 	)
 
 	if result > 0 {
+		if VolumePtr(result) > getPtrsPerCluster(sb)*getPtrsPerCluster(sb) {
+			return ClusterPtr(getPtrsPerCluster(sb) * getPtrsPerCluster(sb))
+		}
 		return result
 	} else {
 		return 0
 	}
 }
 
-func Shrink(mutableInode MutableInode, volume ReadWriteVolume, sb Superblock, targetSize VolumePtr) (VolumePtr, error) {
-	newAllocatedSize, err := shrinkIndirect2(mutableInode.Inode, volume, sb, targetSize)
+// allocateIndirect3 maps data clusters one by one, pointer tables are
+// allocated when the first pointer is written into them
+func allocateIndirect3(inode *Inode, volume ReadWriteVolume, sb Superblock, identity Identity, size VolumePtr) (VolumePtr, error) {
+	if inode.Indirect3 == Unused {
+		// Allocate triple pointer table
+		triplePtrTableObj, err := FindFreeClusters(volume, sb, identity, 1, true)
+		if err != nil {
+			return 0, err
+		}
+
+		inode.Indirect3 = VolumePtrToClusterPtr(sb, triplePtrTableObj[0].VolumePtr)
+	}
+
+	ptrsPerCluster := getPtrsPerCluster(sb)
+	neededDataClusters := NeededClusters(sb, size)
+	dataClusterObjects, err := FindFreeClusters(volume, sb, identity, neededDataClusters, true)
+	if err != nil {
+		return 0, err
+	}
+
+	allocatedSize := VolumePtr(0)
+	for _, dataClusterObject := range dataClusterObjects {
+		index := VolumePtr(allocatedDataClustersInIndirect3(*inode, sb))
+
+		doublePtrTablePtr, err := getOrAllocatePtrTable(volume, sb, identity, inode.Indirect3, index/(ptrsPerCluster*ptrsPerCluster), index%(ptrsPerCluster*ptrsPerCluster) == 0)
+		if err != nil {
+			return allocatedSize, err
+		}
+
+		singlePtrTablePtr, err := getOrAllocatePtrTable(volume, sb, identity, doublePtrTablePtr, (index/ptrsPerCluster)%ptrsPerCluster, index%ptrsPerCluster == 0)
+		if err != nil {
+			return allocatedSize, err
+		}
+
+		err = volume.WriteStruct(
+			ClusterPtrToVolumePtr(sb, singlePtrTablePtr)+(index%ptrsPerCluster)*VolumePtr(unsafe.Sizeof(ClusterPtr(0))),
+			VolumePtrToClusterPtr(sb, dataClusterObject.VolumePtr),
+		)
+		if err != nil {
+			return allocatedSize, err
+		}
+
+		inode.AllocatedClusters++
+		allocatedSize += VolumePtr(sb.ClusterSize)
+	}
+
+	return allocatedSize, nil
+}
+
+// getOrAllocatePtrTable returns pointer stored at index of pointer table, new
+// table is allocated and stored there when allocate is true
+func getOrAllocatePtrTable(volume ReadWriteVolume, sb Superblock, identity Identity, tablePtr ClusterPtr, index VolumePtr, allocate bool) (ClusterPtr, error) {
+	if !allocate {
+		return readPtrFromTable(volume, sb, tablePtr, index)
+	}
+
+	ptr, err := newPtrTable(volume, sb, identity)
+	if err != nil {
+		return 0, err
+	}
+
+	return ptr, writePtrToTable(volume, sb, tablePtr, index, ptr)
+}
+
+func newPtrTable(volume ReadWriteVolume, sb Superblock, identity Identity) (ClusterPtr, error) {
+	ptrTableObj, err := FindFreeClusters(volume, sb, identity, 1, true)
+	if err != nil {
+		return Unused, err
+	}
+
+	return VolumePtrToClusterPtr(sb, ptrTableObj[0].VolumePtr), nil
+}
+
+func writePtrToTable(volume ReadWriteVolume, sb Superblock, tablePtr ClusterPtr, index VolumePtr, ptr ClusterPtr) error {
+	return volume.WriteStruct(ClusterPtrToVolumePtr(sb, tablePtr)+index*VolumePtr(unsafe.Sizeof(ClusterPtr(0))), ptr)
+}
+
+func readPtrFromTable(volume ReadWriteVolume, sb Superblock, tablePtr ClusterPtr, index VolumePtr) (ClusterPtr, error) {
+	var ptr ClusterPtr
+	err := volume.ReadStruct(ClusterPtrToVolumePtr(sb, tablePtr)+index*VolumePtr(unsafe.Sizeof(ClusterPtr(0))), &ptr)
+
+	return ptr, err
+}
+
+func allocatedDataClustersInIndirect3(inode Inode, sb Superblock) ClusterPtr {
+	result := VolumePtr(inode.AllocatedClusters) - InodeDirectCount - getPtrsPerCluster(sb) - getPtrsPerCluster(sb)*getPtrsPerCluster(sb)
+
+	if result > 0 {
+		return ClusterPtr(result)
+	} else {
+		return 0
+	}
+}
+
+// maxFileClusters returns number of data clusters that can be mapped by
+// direct, indirect1, indirect2 and indirect3 pointers
+func maxFileClusters(sb Superblock) VolumePtr {
+	ptrsPerCluster := getPtrsPerCluster(sb)
+
+	return InodeDirectCount + ptrsPerCluster + ptrsPerCluster*ptrsPerCluster + ptrsPerCluster*ptrsPerCluster*ptrsPerCluster
+}
+
+func Shrink(mutableInode MutableInode, volume ReadWriteVolume, sb Superblock, identity Identity, targetSize VolumePtr) (VolumePtr, error) {
+	// Freeing clusters flips many bits in the same bitmap bytes, keep them in memory
+	cachedVolume := NewCachedVolume(volume)
+	var err error
+	if targetSize == 0 && mutableInode.Inode.DirectoryIndex != Unused {
+		// Index of empty directory is useless
+		err = freeDirectoryIndex(mutableInode.Inode, cachedVolume, sb)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	newAllocatedSize := VolumePtr(0)
+	if mutableInode.Inode.HasInlineData() {
+		if targetSize < InodeInlineDataSize {
+			copy(mutableInode.Inode.InlineData[targetSize:], make([]byte, InodeInlineDataSize))
+		}
+	} else {
+		newAllocatedSize, err = shrink(mutableInode.Inode, cachedVolume, sb, identity, targetSize)
+	}
+	flushErr := cachedVolume.Flush()
+	if err != nil {
+		return newAllocatedSize, err
+	}
+	if flushErr != nil {
+		return newAllocatedSize, flushErr
+	}
+
+	if mutableInode.Inode.AllocatedClusters == 0 && sb.HasFeature(FeatureInlineData) {
+		// Empty inode stores its data inline again
+		mutableInode.Inode.Flags |= InodeFlagInlineData
+	}
+
+	mutableInode.Inode.Size = 0
+	mutableInode.Inode.Touch()
+	err = mutableInode.Save(volume, sb)
+	if err != nil {
+		return newAllocatedSize, err
+	}
+
+	return newAllocatedSize, nil
+}
+
+func shrink(inode *Inode, volume ReadWriteVolume, sb Superblock, identity Identity, targetSize VolumePtr) (VolumePtr, error) {
+	if inode.UsesExtents() {
+		return shrinkExtents(inode, volume, sb, identity, targetSize)
+	}
+
+	newAllocatedSize, err := shrinkIndirect3(inode, volume, sb, targetSize)
+	if err != nil {
+		return newAllocatedSize, err
+	}
+
+	if newAllocatedSize-VolumePtr(sb.ClusterSize) < targetSize {
+		// Nothing else has to be freed
+		return newAllocatedSize, nil
+	}
+
+	newAllocatedSize, err = shrinkIndirect2(inode, volume, sb, targetSize)
 	if err != nil {
 		return newAllocatedSize, err
 	}
 
 	if newAllocatedSize >= targetSize {
-		newAllocatedSize, err = shrinkIndirect1(mutableInode.Inode, volume, sb, targetSize)
+		newAllocatedSize, err = shrinkIndirect1(inode, volume, sb, targetSize)
 		if err != nil {
 			return newAllocatedSize, err
 		}
 
 		if newAllocatedSize >= targetSize {
-			newAllocatedSize, err = shrinkDirect(mutableInode.Inode, volume, sb, targetSize)
+			newAllocatedSize, err = shrinkDirect(inode, volume, sb, targetSize)
 			if err != nil {
 				return newAllocatedSize, err
 			}
 		}
 	}
 
-	mutableInode.Inode.Size = 0
-	err = mutableInode.Save(volume, sb)
-	if err != nil {
-		return newAllocatedSize, err
+	return newAllocatedSize, nil
+}
+
+// shrinkIndirect3 frees data clusters from the end of indirect3, pointer
+// tables are freed together with their first pointer
+func shrinkIndirect3(inode *Inode, volume ReadWriteVolume, sb Superblock, targetSize VolumePtr) (VolumePtr, error) {
+	ptrsPerCluster := getPtrsPerCluster(sb)
+	allocatedSize := VolumePtr(inode.AllocatedClusters) * VolumePtr(sb.ClusterSize)
+
+	for allocatedSize-VolumePtr(sb.ClusterSize) >= targetSize && allocatedDataClustersInIndirect3(*inode, sb) > 0 {
+		index := VolumePtr(allocatedDataClustersInIndirect3(*inode, sb)) - 1
+
+		doublePtrTablePtr, err := readPtrFromTable(volume, sb, inode.Indirect3, index/(ptrsPerCluster*ptrsPerCluster))
+		if err != nil {
+			return allocatedSize, err
+		}
+
+		singlePtrTablePtr, err := readPtrFromTable(volume, sb, doublePtrTablePtr, (index/ptrsPerCluster)%ptrsPerCluster)
+		if err != nil {
+			return allocatedSize, err
+		}
+
+		dataPtr, err := readPtrFromTable(volume, sb, singlePtrTablePtr, index%ptrsPerCluster)
+		if err != nil {
+			return allocatedSize, err
+		}
+
+		if dataPtr != Unused {
+			err = FreeCluster(volume, sb, dataPtr)
+			if err != nil {
+				return allocatedSize, err
+			}
+		}
+
+		if index%ptrsPerCluster == 0 {
+			err = FreeCluster(volume, sb, singlePtrTablePtr)
+			if err != nil {
+				return allocatedSize, err
+			}
+		}
+
+		if index%(ptrsPerCluster*ptrsPerCluster) == 0 {
+			err = FreeCluster(volume, sb, doublePtrTablePtr)
+			if err != nil {
+				return allocatedSize, err
+			}
+		}
+
+		allocatedSize -= VolumePtr(sb.ClusterSize)
+		inode.AllocatedClusters--
 	}
 
-	return newAllocatedSize, nil
+	if allocatedDataClustersInIndirect3(*inode, sb) <= 0 && inode.Indirect3 != Unused {
+		// Deallocate triple pointer table
+		err := FreeCluster(volume, sb, inode.Indirect3)
+		if err != nil {
+			return allocatedSize, err
+		}
+
+		inode.Indirect3 = Unused
+	}
+
+	return allocatedSize, nil
 }
 
 func shrinkDirect(inode *Inode, volume ReadWriteVolume, sb Superblock, targetSize VolumePtr) (VolumePtr, error) {
@@ -347,24 +620,24 @@ func shrinkDirect(inode *Inode, volume ReadWriteVolume, sb Superblock, targetSiz
 	}
 
 	// Find clusters for direct pointers
-	for i := 0; i < len(directPtrs); i++ {
-		if *directPtrs[i] == Unused {
+	for i := 0; i < len(directPtrs) && clustersToBeDeallocated > 0; i++ {
+		if ClusterPtr(len(directPtrs)-i) > inode.AllocatedClusters {
+			// Pointer is behind the end of mapping
 			continue
 		}
 
-		err := FreeCluster(volume, sb, *directPtrs[i])
-		if err != nil {
-			return allocatedSize, err
+		// Holes have no cluster to free
+		if *directPtrs[i] != Unused {
+			err := FreeCluster(volume, sb, *directPtrs[i])
+			if err != nil {
+				return allocatedSize, err
+			}
 		}
 
 		*directPtrs[i] = Unused
 		allocatedSize -= VolumePtr(sb.ClusterSize)
 		inode.AllocatedClusters--
 		clustersToBeDeallocated--
-
-		if clustersToBeDeallocated == 0 {
-			break
-		}
 	}
 
 	return allocatedSize, nil
@@ -392,9 +665,11 @@ func shrinkIndirect1(inode *Inode, volume ReadWriteVolume, sb Superblock, target
 
 	// Find clusters for direct pointers
 	for i := len(singlePtrs) - 1; i >= 0; i-- {
-		err = FreeCluster(volume, sb, singlePtrs[i])
-		if err != nil {
-			return allocatedSize, err
+		if singlePtrs[i] != Unused {
+			err = FreeCluster(volume, sb, singlePtrs[i])
+			if err != nil {
+				return allocatedSize, err
+			}
 		}
 
 		allocatedSize -= VolumePtr(sb.ClusterSize)
@@ -447,10 +722,12 @@ func shrinkIndirect2(inode *Inode, volume ReadWriteVolume, sb Superblock, target
 		}
 
 		for j := len(singlePtrs) - 1; j >= 0; j-- {
-			// Free data cluster
-			err = FreeCluster(volume, sb, singlePtrs[j])
-			if err != nil {
-				return allocatedSize, err
+			// Free data cluster, holes have none
+			if singlePtrs[j] != Unused {
+				err = FreeCluster(volume, sb, singlePtrs[j])
+				if err != nil {
+					return allocatedSize, err
+				}
 			}
 
 			if j == 0 {
@@ -499,6 +776,11 @@ func getPtrsPerCluster(sb Superblock) VolumePtr {
 
 func FindFreeInode(volume ReadWriteVolume, sb Superblock, occupy bool) (VolumeObject, error) {
 	for inodePtr := InodePtr(0); true; inodePtr++ {
+		if InodePtrToVolumePtr(sb, inodePtr+1) > inodesEndAddress(sb) {
+			// Inode would overlap with journal or data clusters
+			break
+		}
+
 		isFree, err := IsInodeFree(volume, sb, inodePtr)
 		if err != nil {
 			return VolumeObject{}, err
@@ -513,7 +795,13 @@ func FindFreeInode(volume ReadWriteVolume, sb Superblock, occupy bool) (VolumeOb
 			}
 
 			inode := NewInode()
-			err = volume.WriteStruct(InodePtrToVolumePtr(sb, inodePtr), inode)
+			if sb.HasFeature(FeatureExtents) {
+				inode.Flags |= InodeFlagExtents
+			}
+			if sb.HasFeature(FeatureInlineData) {
+				inode.Flags |= InodeFlagInlineData
+			}
+			err = MutableInode{Inode: &inode, InodePtr: inodePtr}.Save(volume, sb)
 			if err != nil {
 				return VolumeObject{}, err
 			}
@@ -529,6 +817,14 @@ func FindFreeInode(volume ReadWriteVolume, sb Superblock, occupy bool) (VolumeOb
 	return VolumeObject{}, NoFreeInodeAvailableError{}
 }
 
+func inodesEndAddress(sb Superblock) VolumePtr {
+	if sb.JournalSize > 0 {
+		return sb.JournalStartAddress
+	}
+
+	return sb.ChecksumsStartAddress
+}
+
 func IsInodeFree(volume ReadWriteVolume, sb Superblock, ptr InodePtr) (bool, error) {
 	bytePtr := sb.InodeBitmapStartAddress + VolumePtr(ptr/8)
 
@@ -536,7 +832,7 @@ func IsInodeFree(volume ReadWriteVolume, sb Superblock, ptr InodePtr) (bool, err
 		return false, OutOfRange{bytePtr, sb.InodesStartAddress - 1}
 	}
 
-	data, err := volume.ReadByte(bytePtr)
+	data, err := inodeBitmapArea(sb).readByte(volume, bytePtr)
 	if err != nil {
 		return false, err
 	}
@@ -551,20 +847,15 @@ func setValueInInodeBitmap(volume ReadWriteVolume, sb Superblock, ptr InodePtr,
 		return OutOfRange{bytePtr, sb.InodesStartAddress - 1}
 	}
 
-	data, err := volume.ReadByte(bytePtr)
+	area := inodeBitmapArea(sb)
+	data, err := area.readByte(volume, bytePtr)
 	if err != nil {
 		return err
 	}
 
 	data = SetBitInByte(data, int8(ptr%8), value)
 
-	err = volume.WriteByte(bytePtr, data)
-	if err != nil {
-		return err
-	}
-
-	return nil
-
+	return area.writeByte(volume, bytePtr, data)
 }
 
 func OccupyInode(volume ReadWriteVolume, sb Superblock, ptr InodePtr) error {
@@ -579,7 +870,14 @@ func NeededClusters(sb Superblock, size VolumePtr) ClusterPtr {
 	return ClusterPtr(math.Ceil(float64(size) / float64(sb.ClusterSize)))
 }
 
-func FindFreeClusters(volume ReadWriteVolume, sb Superblock, count ClusterPtr, occupy bool) ([]VolumeObject, error) {
+func FindFreeClusters(volume ReadWriteVolume, sb Superblock, identity Identity, count ClusterPtr, occupy bool) ([]VolumeObject, error) {
+	if occupy {
+		err := checkReservedClusters(volume, sb, identity, count)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	clusterObjects := make([]VolumeObject, 0)
 
 	volumeOffset := VolumePtr(0)
@@ -593,6 +891,11 @@ func FindFreeClusters(volume ReadWriteVolume, sb Superblock, count ClusterPtr, o
 		// Find zero bits in byte
 		bitmap := Bitmap(clusterBitmap[:n])
 		for clusterPtr := ClusterPtr(volumeOffset * 8); clusterPtr < ClusterPtr(volumeOffset*8)+ClusterPtr(n*8); clusterPtr++ {
+			if clusterPtr >= sb.ClusterCount {
+				// Last byte of bitmap may have bits behind the end of volume
+				return nil, errors.New("not enough available cluster")
+			}
+
 			value, err := bitmap.GetBit(VolumePtr(clusterPtr) - (volumeOffset * 8))
 			if err != nil {
 				return nil, err
@@ -632,11 +935,6 @@ func LoadClusterChunk(volume ReadWriteVolume, sb Superblock, offset VolumePtr, d
 		return 0, errors.New(fmt.Sprintf("address can't be equal or greater than %d", sb.InodeBitmapStartAddress))
 	}
 
-	err := volume.ReadBytes(volumePtr, data)
-	if err != nil {
-		return 0, err
-	}
-
 	var n VolumePtr
 	if sb.ClusterBitmapStartAddress+offset+VolumePtr(len(data)) >= sb.InodeBitmapStartAddress {
 		n = sb.InodeBitmapStartAddress - (sb.ClusterBitmapStartAddress + offset)
@@ -644,30 +942,87 @@ func LoadClusterChunk(volume ReadWriteVolume, sb Superblock, offset VolumePtr, d
 		n = VolumePtr(len(data))
 	}
 
+	err := clusterBitmapArea(sb).read(volume, offset, data[:n])
+	if err != nil {
+		return 0, err
+	}
+
 	return n, nil
 }
 
-func setValueInClusterBitmap(volume ReadWriteVolume, sb Superblock, ptr ClusterPtr, value byte) error {
+func IsClusterFree(volume ReadWriteVolume, sb Superblock, ptr ClusterPtr) (bool, error) {
 	bytePtr := sb.ClusterBitmapStartAddress + VolumePtr(ptr/8)
 
 	if bytePtr >= sb.InodeBitmapStartAddress {
-		return OutOfRange{bytePtr, sb.InodeBitmapStartAddress - 1}
+		return false, OutOfRange{bytePtr, sb.InodeBitmapStartAddress - 1}
 	}
 
-	data, err := volume.ReadByte(bytePtr)
+	data, err := clusterBitmapArea(sb).readByte(volume, bytePtr)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	data = SetBitInByte(data, int8(ptr%8), value)
+	return GetBitInByte(data, int8(ptr%8)) == Free, nil
+}
+
+// CountFreeClusters returns number of data clusters that aren't used
+func CountFreeClusters(volume ReadWriteVolume, sb Superblock) (ClusterPtr, error) {
+	clusterBitmap := make(Bitmap, NeededMemoryForBitmap(VolumePtr(sb.ClusterCount)))
+	err := clusterBitmapArea(sb).read(volume, 0, clusterBitmap)
+	if err != nil {
+		return 0, err
+	}
+
+	freeClusters := ClusterPtr(0)
+	for ptr := VolumePtr(0); ptr < VolumePtr(sb.ClusterCount); ptr++ {
+		value, err := clusterBitmap.GetBit(ptr)
+		if err != nil {
+			return 0, err
+		}
+
+		if value == Free {
+			freeClusters++
+		}
+	}
+
+	return freeClusters, nil
+}
+
+// checkReservedClusters refuses to allocate count clusters when fewer than
+// reserved clusters would stay free and identity isn't root
+func checkReservedClusters(volume ReadWriteVolume, sb Superblock, identity Identity, count ClusterPtr) error {
+	if sb.ReservedClusters == 0 || identity.IsRoot() {
+		return nil
+	}
 
-	err = volume.WriteByte(bytePtr, data)
+	freeClusters, err := CountFreeClusters(volume, sb)
 	if err != nil {
 		return err
 	}
 
+	if freeClusters-count < sb.ReservedClusters {
+		return NoFreeClusterAvailableError{}
+	}
+
 	return nil
+}
+
+func setValueInClusterBitmap(volume ReadWriteVolume, sb Superblock, ptr ClusterPtr, value byte) error {
+	bytePtr := sb.ClusterBitmapStartAddress + VolumePtr(ptr/8)
+
+	if bytePtr >= sb.InodeBitmapStartAddress {
+		return OutOfRange{bytePtr, sb.InodeBitmapStartAddress - 1}
+	}
+
+	area := clusterBitmapArea(sb)
+	data, err := area.readByte(volume, bytePtr)
+	if err != nil {
+		return err
+	}
+
+	data = SetBitInByte(data, int8(ptr%8), value)
 
+	return area.writeByte(volume, bytePtr, data)
 }
 
 func OccupyCluster(volume ReadWriteVolume, sb Superblock, ptr ClusterPtr) error {
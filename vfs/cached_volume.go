@@ -0,0 +1,327 @@
+package vfs
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	CachePageSize         = 4096
+	DefaultCachePageCount = 256
+)
+
+type cachePage struct {
+	volumePtr VolumePtr
+	data      []byte
+	// Range of bytes that were modified and must be written back
+	dirtyStart VolumePtr
+	dirtyEnd   VolumePtr
+}
+
+func (cp cachePage) isDirty() bool {
+	return cp.dirtyEnd > cp.dirtyStart
+}
+
+type volumeCache struct {
+	maxPages int
+	pages    map[VolumePtr]*list.Element
+	lru      *list.List
+}
+
+// CachedVolume is a write-back cache in front of another volume. Data are
+// cached in pages of CachePageSize bytes, the least recently used page is
+// written back and dropped when the cache is full. Modified data reach the
+// underlying volume only after Flush is called or when their page is evicted.
+type CachedVolume struct {
+	volume ReadWriteVolume
+	cache  *volumeCache
+}
+
+func NewCachedVolume(volume ReadWriteVolume) CachedVolume {
+	return NewCachedVolumeWithSize(volume, DefaultCachePageCount)
+}
+
+func NewCachedVolumeWithSize(volume ReadWriteVolume, maxPages int) CachedVolume {
+	if maxPages < 1 {
+		maxPages = 1
+	}
+
+	return CachedVolume{
+		volume: volume,
+		cache: &volumeCache{
+			maxPages: maxPages,
+			pages:    make(map[VolumePtr]*list.Element),
+			lru:      list.New(),
+		},
+	}
+}
+
+func (cv CachedVolume) loadPage(pagePtr VolumePtr, forWrite bool) (*cachePage, error) {
+	element, ok := cv.cache.pages[pagePtr]
+	if ok {
+		cv.cache.lru.MoveToFront(element)
+		return element.Value.(*cachePage), nil
+	}
+
+	page := &cachePage{
+		volumePtr: pagePtr,
+		data:      make([]byte, CachePageSize),
+	}
+	err := cv.volume.ReadBytes(pagePtr, page.data)
+	if err != nil {
+		// Page beyond the end of volume can still be written to, dirty range
+		// makes sure that we don't write anything else than the written data
+		if err != io.EOF || !forWrite {
+			return nil, err
+		}
+	}
+
+	if cv.cache.lru.Len() >= cv.cache.maxPages {
+		err = cv.evict()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cv.cache.pages[pagePtr] = cv.cache.lru.PushFront(page)
+
+	return page, nil
+}
+
+func (cv CachedVolume) evict() error {
+	element := cv.cache.lru.Back()
+	if element == nil {
+		return nil
+	}
+
+	page := element.Value.(*cachePage)
+	err := cv.writeBack(page)
+	if err != nil {
+		return err
+	}
+
+	cv.cache.lru.Remove(element)
+	delete(cv.cache.pages, page.volumePtr)
+
+	return nil
+}
+
+func (cv CachedVolume) writeBack(page *cachePage) error {
+	if !page.isDirty() {
+		return nil
+	}
+
+	err := cv.volume.WriteStruct(page.volumePtr+page.dirtyStart, page.data[page.dirtyStart:page.dirtyEnd])
+	if err != nil {
+		return err
+	}
+
+	page.dirtyStart = 0
+	page.dirtyEnd = 0
+
+	return nil
+}
+
+func (cv CachedVolume) writeBytes(volumePtr VolumePtr, data []byte) error {
+	dataOffset := VolumePtr(0)
+	for dataOffset < VolumePtr(len(data)) {
+		ptr := volumePtr + dataOffset
+		pagePtr := ptr - ptr%CachePageSize
+		offsetInPage := ptr - pagePtr
+
+		page, err := cv.loadPage(pagePtr, true)
+		if err != nil {
+			return err
+		}
+
+		n := VolumePtr(copy(page.data[offsetInPage:], data[dataOffset:]))
+
+		// Extend dirty range
+		if !page.isDirty() {
+			page.dirtyStart = offsetInPage
+			page.dirtyEnd = offsetInPage + n
+		} else {
+			if offsetInPage < page.dirtyStart {
+				page.dirtyStart = offsetInPage
+			}
+			if offsetInPage+n > page.dirtyEnd {
+				page.dirtyEnd = offsetInPage + n
+			}
+		}
+
+		dataOffset += n
+	}
+
+	return nil
+}
+
+func (cv CachedVolume) WriteStruct(volumePtr VolumePtr, data interface{}) error {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, data)
+	if err != nil {
+		return err
+	}
+
+	return cv.writeBytes(volumePtr, buf.Bytes())
+}
+
+func (cv CachedVolume) WriteByteAt(volumePtr VolumePtr, data byte) error {
+	return cv.writeBytes(volumePtr, []byte{data})
+}
+
+func (cv CachedVolume) ReadByteAt(volumePtr VolumePtr) (byte, error) {
+	data := make([]byte, 1)
+	err := cv.ReadBytes(volumePtr, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return data[0], nil
+}
+
+func (cv CachedVolume) ReadBytes(volumePtr VolumePtr, data []byte) error {
+	dataOffset := VolumePtr(0)
+	for dataOffset < VolumePtr(len(data)) {
+		ptr := volumePtr + dataOffset
+		pagePtr := ptr - ptr%CachePageSize
+		offsetInPage := ptr - pagePtr
+
+		page, err := cv.loadPage(pagePtr, false)
+		if err != nil {
+			return err
+		}
+
+		dataOffset += VolumePtr(copy(data[dataOffset:], page.data[offsetInPage:]))
+	}
+
+	return nil
+}
+
+func (cv CachedVolume) ReadStruct(volumePtr VolumePtr, data interface{}) error {
+	size := binary.Size(data)
+	if size < 0 {
+		return fmt.Errorf("cannot read %T from cache, size is not fixed", data)
+	}
+
+	dataBytes := make([]byte, size)
+	err := cv.ReadBytes(volumePtr, dataBytes)
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(bytes.NewReader(dataBytes), binary.LittleEndian, data)
+}
+
+func (cv CachedVolume) ReadObject(volumePtr VolumePtr, data interface{}) (VolumeObject, error) {
+	err := cv.ReadStruct(volumePtr, data)
+	if err != nil {
+		return VolumeObject{}, err
+	}
+
+	return NewVolumeObject(volumePtr, cv, data), nil
+}
+
+// Flush writes all modified pages to the underlying volume. Pages stay in
+// the cache, so subsequent reads are still served from memory.
+func (cv CachedVolume) Flush() error {
+	for element := cv.cache.lru.Back(); element != nil; element = element.Prev() {
+		err := cv.writeBack(element.Value.(*cachePage))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cv CachedVolume) CachedPages() int {
+	return cv.cache.lru.Len()
+}
+
+func (cv CachedVolume) storageVolume() (StorageVolume, error) {
+	storageVolume, ok := cv.volume.(StorageVolume)
+	if !ok {
+		return nil, errors.New("cached volume doesn't wrap a storage volume")
+	}
+
+	return storageVolume, nil
+}
+
+func (cv CachedVolume) Size() (VolumePtr, error) {
+	storageVolume, err := cv.storageVolume()
+	if err != nil {
+		return 0, err
+	}
+
+	return storageVolume.Size()
+}
+
+func (cv CachedVolume) Resize(size VolumePtr) error {
+	storageVolume, err := cv.storageVolume()
+	if err != nil {
+		return err
+	}
+
+	// Pages behind the new end must not be written back later
+	err = cv.Flush()
+	if err != nil {
+		return err
+	}
+	cv.cache.pages = make(map[VolumePtr]*list.Element)
+	cv.cache.lru.Init()
+
+	return storageVolume.Resize(size)
+}
+
+func (cv CachedVolume) Truncate() error {
+	storageVolume, err := cv.storageVolume()
+	if err != nil {
+		return err
+	}
+
+	err = cv.Flush()
+	if err != nil {
+		return err
+	}
+
+	return storageVolume.Truncate()
+}
+
+func (cv CachedVolume) Sync() error {
+	err := cv.Flush()
+	if err != nil {
+		return err
+	}
+
+	return syncVolume(cv.volume)
+}
+
+func (cv CachedVolume) Close() error {
+	storageVolume, err := cv.storageVolume()
+	if err != nil {
+		return err
+	}
+
+	err = cv.Flush()
+	if err != nil {
+		return err
+	}
+
+	return storageVolume.Close()
+}
+
+func (cv CachedVolume) Destroy() error {
+	storageVolume, err := cv.storageVolume()
+	if err != nil {
+		return err
+	}
+
+	cv.cache.pages = make(map[VolumePtr]*list.Element)
+	cv.cache.lru.Init()
+
+	return storageVolume.Destroy()
+}
@@ -0,0 +1,342 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Checksum table is placed between journal and data clusters. It starts with
+// checksum of every data cluster followed by checksums of cluster bitmap
+// blocks and inode bitmap blocks. Only clusters of directories are checked
+// unless the volume has FeatureDataChecksums.
+
+// bitmapBlockSize is number of bitmap bytes covered by single checksum
+const bitmapBlockSize = 512
+
+const checksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type SuperblockChecksumMismatch struct{}
+
+func (s SuperblockChecksumMismatch) Error() string {
+	return "checksum of superblock doesn't match"
+}
+
+type InodeChecksumMismatch struct {
+	InodePtr InodePtr
+}
+
+func (i InodeChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum of inode %d doesn't match", i.InodePtr)
+}
+
+type BitmapChecksumMismatch struct {
+	// Address of the first byte of corrupted block
+	Address VolumePtr
+}
+
+func (b BitmapChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum of bitmap block at address %d doesn't match", b.Address)
+}
+
+type ClusterChecksumMismatch struct {
+	ClusterPtr ClusterPtr
+}
+
+func (c ClusterChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum of cluster %d doesn't match", c.ClusterPtr)
+}
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// structChecksum returns checksum of on-disk representation of struct, its
+// Checksum field has to be zero
+func structChecksum(data interface{}) (uint32, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return checksum(buf.Bytes()), nil
+}
+
+func (sb Superblock) computeChecksum() (uint32, error) {
+	sb.Checksum = 0
+	return structChecksum(sb)
+}
+
+func (i Inode) computeChecksum() (uint32, error) {
+	i.Checksum = 0
+	return structChecksum(i)
+}
+
+// checksumTableSize returns size of checksum table for given number of
+// clusters and bitmap sizes
+func checksumTableSize(clusterCount ClusterPtr, clusterBitmapSize, inodeBitmapSize VolumePtr) VolumePtr {
+	return checksumSize * (VolumePtr(clusterCount) + bitmapBlockCount(clusterBitmapSize) + bitmapBlockCount(inodeBitmapSize))
+}
+
+func bitmapBlockCount(bitmapSize VolumePtr) VolumePtr {
+	return (bitmapSize + bitmapBlockSize - 1) / bitmapBlockSize
+}
+
+func readChecksum(volume ReadWriteVolume, volumePtr VolumePtr) (uint32, error) {
+	var value uint32
+	err := volume.ReadStruct(volumePtr, &value)
+
+	return value, err
+}
+
+func clusterChecksumAddress(sb Superblock, ptr ClusterPtr) VolumePtr {
+	return sb.ChecksumsStartAddress + checksumSize*VolumePtr(ptr)
+}
+
+// updateClusterChecksum computes checksum of current content of cluster
+func updateClusterChecksum(volume ReadWriteVolume, sb Superblock, ptr ClusterPtr) error {
+	data := make([]byte, sb.ClusterSize)
+	err := volume.ReadBytes(ClusterPtrToVolumePtr(sb, ptr), data)
+	if err != nil {
+		return err
+	}
+
+	return volume.WriteStruct(clusterChecksumAddress(sb, ptr), checksum(data))
+}
+
+// readVerifiedCluster reads the whole cluster and checks its checksum
+func readVerifiedCluster(volume ReadWriteVolume, sb Superblock, ptr ClusterPtr) ([]byte, error) {
+	data := make([]byte, sb.ClusterSize)
+	err := volume.ReadBytes(ClusterPtrToVolumePtr(sb, ptr), data)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := readChecksum(volume, clusterChecksumAddress(sb, ptr))
+	if err != nil {
+		return nil, err
+	}
+
+	if checksum(data) != expected {
+		return nil, ClusterChecksumMismatch{ptr}
+	}
+
+	return data, nil
+}
+
+// copyClusterChecksum is used when content of cluster is moved to another one
+func copyClusterChecksum(volume ReadWriteVolume, sb Superblock, from, to ClusterPtr) error {
+	value, err := readChecksum(volume, clusterChecksumAddress(sb, from))
+	if err != nil {
+		return err
+	}
+
+	return volume.WriteStruct(clusterChecksumAddress(sb, to), value)
+}
+
+// HasClusterChecksums tells if data clusters of the inode are checked
+func (i Inode) HasClusterChecksums(sb Superblock) bool {
+	return !i.HasInlineData() && (i.IsDir() || sb.HasFeature(FeatureDataChecksums))
+}
+
+// forEachDataCluster calls fn for every data cluster of the inode, holes are
+// skipped
+func forEachDataCluster(volume ReadWriteVolume, sb Superblock, inode Inode, fn func(ptr ClusterPtr) error) error {
+	if inode.HasInlineData() {
+		return nil
+	}
+
+	for index := ClusterPtr(0); index < inode.AllocatedClusters; index++ {
+		ptr, err := inode.ResolveDataClusterAddress(volume, sb, index)
+		if err != nil {
+			return err
+		}
+		if ptr == Unused {
+			continue
+		}
+
+		err = fn(ptr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpdateDataChecksums computes checksums of all data clusters of the inode
+func UpdateDataChecksums(volume ReadWriteVolume, sb Superblock, inode Inode) error {
+	return forEachDataCluster(volume, sb, inode, func(ptr ClusterPtr) error {
+		return updateClusterChecksum(volume, sb, ptr)
+	})
+}
+
+// VerifyClusterChecksum reads the cluster and returns ClusterChecksumMismatch
+// when its content doesn't match the checksum
+func VerifyClusterChecksum(volume ReadWriteVolume, sb Superblock, ptr ClusterPtr) error {
+	_, err := readVerifiedCluster(volume, sb, ptr)
+
+	return err
+}
+
+// bitmapArea is one of the bitmaps together with checksums of its blocks
+type bitmapArea struct {
+	start     VolumePtr
+	end       VolumePtr
+	checksums VolumePtr
+}
+
+func clusterBitmapArea(sb Superblock) bitmapArea {
+	return bitmapArea{
+		start:     sb.ClusterBitmapStartAddress,
+		end:       sb.InodeBitmapStartAddress,
+		checksums: sb.ChecksumsStartAddress + checksumSize*VolumePtr(sb.ClusterCount),
+	}
+}
+
+func inodeBitmapArea(sb Superblock) bitmapArea {
+	clusterArea := clusterBitmapArea(sb)
+
+	return bitmapArea{
+		start:     sb.InodeBitmapStartAddress,
+		end:       sb.InodesStartAddress,
+		checksums: clusterArea.checksums + checksumSize*clusterArea.blockCount(),
+	}
+}
+
+func (a bitmapArea) blockCount() VolumePtr {
+	return bitmapBlockCount(a.end - a.start)
+}
+
+// readBlock returns data of bitmap block, its checksum is verified
+func (a bitmapArea) readBlock(volume ReadWriteVolume, block VolumePtr) ([]byte, error) {
+	blockStart := a.start + block*bitmapBlockSize
+	blockEnd := blockStart + bitmapBlockSize
+	if blockEnd > a.end {
+		blockEnd = a.end
+	}
+
+	data := make([]byte, blockEnd-blockStart)
+	err := volume.ReadBytes(blockStart, data)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := readChecksum(volume, a.checksums+checksumSize*block)
+	if err != nil {
+		return nil, err
+	}
+
+	if checksum(data) != expected {
+		return nil, BitmapChecksumMismatch{blockStart}
+	}
+
+	return data, nil
+}
+
+// read reads bytes of bitmap from given offset, all touched blocks are
+// verified
+func (a bitmapArea) read(volume ReadWriteVolume, offset VolumePtr, data []byte) error {
+	for done := VolumePtr(0); done < VolumePtr(len(data)); {
+		block := (offset + done) / bitmapBlockSize
+		blockData, err := a.readBlock(volume, block)
+		if err != nil {
+			return err
+		}
+
+		done += VolumePtr(copy(data[done:], blockData[offset+done-block*bitmapBlockSize:]))
+	}
+
+	return nil
+}
+
+func (a bitmapArea) readByte(volume ReadWriteVolume, volumePtr VolumePtr) (byte, error) {
+	data := make([]byte, 1)
+	err := a.read(volume, volumePtr-a.start, data)
+
+	return data[0], err
+}
+
+// writeByte changes single byte of bitmap and checksum of its block
+func (a bitmapArea) writeByte(volume ReadWriteVolume, volumePtr VolumePtr, value byte) error {
+	block := (volumePtr - a.start) / bitmapBlockSize
+	data, err := a.readBlock(volume, block)
+	if err != nil {
+		return err
+	}
+
+	err = volume.WriteByteAt(volumePtr, value)
+	if err != nil {
+		return err
+	}
+
+	data[volumePtr-a.start-block*bitmapBlockSize] = value
+
+	return volume.WriteStruct(a.checksums+checksumSize*block, checksum(data))
+}
+
+func (a bitmapArea) updateChecksums(volume ReadWriteVolume) error {
+	for block := VolumePtr(0); block < a.blockCount(); block++ {
+		blockStart := a.start + block*bitmapBlockSize
+		blockEnd := blockStart + bitmapBlockSize
+		if blockEnd > a.end {
+			blockEnd = a.end
+		}
+
+		data := make([]byte, blockEnd-blockStart)
+		err := volume.ReadBytes(blockStart, data)
+		if err != nil {
+			return err
+		}
+
+		err = volume.WriteStruct(a.checksums+checksumSize*block, checksum(data))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a bitmapArea) verifyChecksums(volume ReadWriteVolume) ([]BitmapChecksumMismatch, error) {
+	mismatches := make([]BitmapChecksumMismatch, 0)
+	for block := VolumePtr(0); block < a.blockCount(); block++ {
+		_, err := a.readBlock(volume, block)
+		if mismatch, ok := err.(BitmapChecksumMismatch); ok {
+			mismatches = append(mismatches, mismatch)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return mismatches, nil
+}
+
+// UpdateBitmapChecksums computes checksums of all blocks of both bitmaps
+func UpdateBitmapChecksums(volume ReadWriteVolume, sb Superblock) error {
+	err := clusterBitmapArea(sb).updateChecksums(volume)
+	if err != nil {
+		return err
+	}
+
+	return inodeBitmapArea(sb).updateChecksums(volume)
+}
+
+// VerifyBitmapChecksums returns all blocks of bitmaps with wrong checksum
+func VerifyBitmapChecksums(volume ReadWriteVolume, sb Superblock) ([]BitmapChecksumMismatch, error) {
+	clusterMismatches, err := clusterBitmapArea(sb).verifyChecksums(volume)
+	if err != nil {
+		return nil, err
+	}
+
+	inodeMismatches, err := inodeBitmapArea(sb).verifyChecksums(volume)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(clusterMismatches, inodeMismatches...), nil
+}
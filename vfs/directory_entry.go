@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -23,13 +26,64 @@ func (d DuplicateDirectoryEntry) Error() string {
 	return "cannot create directory entry with duplicate name"
 }
 
-const DirectoryEntryNameLength = 12
+type NameTooLong struct {
+	Name      string
+	MaxLength int
+}
+
+func (n NameTooLong) Error() string {
+	return fmt.Sprintf("name %s is longer than %d bytes", n.Name, n.MaxLength)
+}
+
+type InvalidName struct {
+	Name string
+}
+
+func (i InvalidName) Error() string {
+	return fmt.Sprintf("name %q is not valid", i.Name)
+}
+
+const (
+	DirectoryEntryNameLength       = 255
+	LegacyDirectoryEntryNameLength = 12
+)
 
 type DirectoryEntry struct {
 	Name     [DirectoryEntryNameLength]byte
 	InodePtr InodePtr
 }
 
+// legacyDirectoryEntry is on-disk format of directory entry on volumes
+// without FeatureLongNames
+type legacyDirectoryEntry struct {
+	Name     [LegacyDirectoryEntryNameLength]byte
+	InodePtr InodePtr
+}
+
+// directoryEntryHeader precedes name of variable-length directory entry on
+// volumes with FeatureLongNames
+type directoryEntryHeader struct {
+	InodePtr     InodePtr
+	RecordLength uint16
+	NameLength   uint8
+}
+
+const directoryEntryHeaderSize = 7
+
+// FreeSlotInodePtr marks slot of removed directory entry
+const FreeSlotInodePtr = InodePtr(-1)
+
+// directorySlot is place in directory data occupied by single entry
+type directorySlot struct {
+	entry  DirectoryEntry
+	offset uint32
+	length uint32
+}
+
+func (s directorySlot) isFree() bool {
+	return s.entry.InodePtr == FreeSlotInodePtr
+}
+
 func NewDirectoryEntry(name string, inodePtr InodePtr) DirectoryEntry {
 	return DirectoryEntry{
 		Name:     StringNameToBytes(name),
@@ -39,12 +93,13 @@ func NewDirectoryEntry(name string, inodePtr InodePtr) DirectoryEntry {
 
 func InitRootDirectory(fs *Filesystem, mutableInode *MutableInode) error {
 	mutableInode.Inode.Type = InodeRootInodeType
+	mutableInode.Inode.Mode = DefaultDirectoryMode
 	err := mutableInode.Save(fs.Volume, fs.Superblock)
 	if err != nil {
 		return err
 	}
 
-	err = AppendDirectoryEntries(fs.Volume, fs.Superblock, *mutableInode,
+	err = AppendDirectoryEntries(fs.Volume, fs.Superblock, fs.Identity, *mutableInode,
 		NewDirectoryEntry(".", mutableInode.InodePtr),
 		NewDirectoryEntry("..", mutableInode.InodePtr),
 	)
@@ -60,17 +115,22 @@ func InitRootDirectory(fs *Filesystem, mutableInode *MutableInode) error {
 	fs.RootInodePtr = mutableInode.InodePtr
 	fs.CurrentInodePtr = mutableInode.InodePtr
 
-	return nil
+	// Persist root inode, so filesystem can be loaded only from superblock
+	fs.Superblock.RootInodePtr = mutableInode.InodePtr
+
+	return fs.WriteSuperblock()
 }
 
-func CreateNewDirectory(volume ReadWriteVolume, sb Superblock, parentInodePtr InodePtr, parent MutableInode, name string) (Inode, error) {
+func CreateNewDirectory(volume ReadWriteVolume, sb Superblock, identity Identity, parentInodePtr InodePtr, parent MutableInode, name string) (Inode, error) {
 	inodeObj, err := FindFreeInode(volume, sb, true)
 	if err != nil {
 		return Inode{}, err
 	}
 	inode := inodeObj.Object.(Inode)
+	inode.Type = InodeDirectoryType
+	inode.Mode = DefaultDirectoryMode
 
-	err = AppendDirectoryEntries(volume, sb, MutableInode{
+	err = AppendDirectoryEntries(volume, sb, identity, MutableInode{
 		Inode:    &inode,
 		InodePtr: VolumePtrToInodePtr(sb, inodeObj.VolumePtr),
 	},
@@ -84,6 +144,7 @@ func CreateNewDirectory(volume ReadWriteVolume, sb Superblock, parentInodePtr In
 	err = AppendDirectoryEntries(
 		volume,
 		sb,
+		identity,
 		parent,
 		NewDirectoryEntry(name, VolumePtrToInodePtr(sb, inodeObj.VolumePtr)),
 	)
@@ -94,102 +155,399 @@ func CreateNewDirectory(volume ReadWriteVolume, sb Superblock, parentInodePtr In
 	return inode, nil
 }
 
-func AppendDirectoryEntries(volume ReadWriteVolume, sb Superblock, inode MutableInode, directoryEntries ...DirectoryEntry) error {
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.LittleEndian, directoryEntries)
+func AppendDirectoryEntries(volume ReadWriteVolume, sb Superblock, identity Identity, inode MutableInode, directoryEntries ...DirectoryEntry) error {
+	// Put entries to slots of removed entries first
+	remainingEntries := make([]DirectoryEntry, 0, len(directoryEntries))
+	for _, directoryEntry := range directoryEntries {
+		reused, err := reuseDirectorySlot(volume, sb, identity, inode, directoryEntry)
+		if err != nil {
+			return err
+		}
+
+		if !reused {
+			remainingEntries = append(remainingEntries, directoryEntry)
+		}
+	}
+
+	if len(remainingEntries) == 0 {
+		return nil
+	}
+
+	data, offsets, err := encodeDirectoryEntries(sb, remainingEntries)
 	if err != nil {
 		return err
 	}
-	_, err = inode.AppendData(volume, sb, buf.Bytes())
+
+	return appendEncodedDirectoryEntries(volume, sb, identity, inode, remainingEntries, data, offsets)
+}
+
+func appendEncodedDirectoryEntries(volume ReadWriteVolume, sb Superblock, identity Identity, inode MutableInode, directoryEntries []DirectoryEntry, data []byte, offsets []uint32) error {
+	offset := uint32(inode.Inode.Size)
+	_, err := inode.AppendData(volume, sb, identity, data)
 	if err != nil {
 		return err
 	}
+
+	if inode.Inode.DirectoryIndex != Unused {
+		for i := range offsets {
+			offsets[i] += offset
+		}
+
+		return appendToDirectoryIndex(volume, sb, identity, *inode.Inode, directoryEntries, offsets)
+	} else if shouldIndexDirectory(sb, *inode.Inode) {
+		// Directory doesn't fit into single cluster anymore, linear search would be slow
+		return buildDirectoryIndex(volume, sb, identity, inode)
+	}
+
 	return nil
 }
 
+// reuseDirectorySlot writes directory entry to free slot that is large
+// enough. False is returned when there is no such slot.
+func reuseDirectorySlot(volume ReadWriteVolume, sb Superblock, identity Identity, inode MutableInode, directoryEntry DirectoryEntry) (bool, error) {
+	neededLength, err := directoryEntryLength(sb, directoryEntry)
+	if err != nil {
+		return false, err
+	}
+
+	if inode.Inode.DirectoryIndex != Unused {
+		return reuseIndexedDirectorySlot(volume, sb, identity, inode, directoryEntry, neededLength)
+	}
+
+	slots, err := readDirectorySlots(volume, sb, *inode.Inode)
+	if err != nil {
+		return false, err
+	}
+
+	for _, slot := range slots {
+		if slot.isFree() && slot.length >= neededLength {
+			slot.entry = directoryEntry
+			return true, writeDirectorySlot(volume, sb, identity, inode, slot)
+		}
+	}
+
+	return false, nil
+}
+
+func writeDirectorySlot(volume ReadWriteVolume, sb Superblock, identity Identity, inode MutableInode, slot directorySlot) error {
+	buf := new(bytes.Buffer)
+	err := encodeDirectoryEntry(sb, buf, slot.entry, slot.length)
+	if err != nil {
+		return err
+	}
+
+	_, err = inode.WriteData(volume, sb, identity, VolumePtr(slot.offset), buf.Bytes())
+
+	return err
+}
+
 func ReadAllDirectoryEntries(volume ReadWriteVolume, sb Superblock, inode Inode) ([]DirectoryEntry, error) {
+	slots, err := readDirectorySlots(volume, sb, inode)
+	if err != nil {
+		return nil, err
+	}
+
+	directoryEntries := make([]DirectoryEntry, 0, len(slots))
+	for _, slot := range slots {
+		if !slot.isFree() {
+			directoryEntries = append(directoryEntries, slot.entry)
+		}
+	}
+
+	return directoryEntries, nil
+}
+
+// readDirectorySlots returns all slots of directory including free ones,
+// index of slot is its DEPtr
+func readDirectorySlots(volume ReadWriteVolume, sb Superblock, inode Inode) ([]directorySlot, error) {
+	if inode.Size == 0 {
+		return []directorySlot{}, nil
+	}
+
 	directoryEntryBytes := make([]byte, inode.Size)
 	_, err := inode.ReadData(volume, sb, 0, directoryEntryBytes)
 	if err != nil {
 		return nil, err
 	}
-	directoryEntries := make([]DirectoryEntry, len(directoryEntryBytes)/int(unsafe.Sizeof(DirectoryEntry{})))
-	reader := bytes.NewReader(directoryEntryBytes)
-	err = binary.Read(reader, binary.LittleEndian, &directoryEntries)
+	return decodeDirectorySlots(sb, directoryEntryBytes)
+}
+
+// readDirectorySlotAt reads single slot that starts at given offset in
+// directory data
+func readDirectorySlotAt(volume ReadWriteVolume, sb Superblock, inode Inode, offset uint32) (directorySlot, error) {
+	var size int
+	if sb.HasFeature(FeatureLongNames) {
+		size = directoryEntryHeaderSize + DirectoryEntryNameLength
+	} else {
+		size = int(unsafe.Sizeof(legacyDirectoryEntry{}))
+	}
+	if VolumePtr(offset)+VolumePtr(size) > inode.Size {
+		size = int(inode.Size - VolumePtr(offset))
+	}
+
+	data := make([]byte, size)
+	_, err := inode.ReadData(volume, sb, VolumePtr(offset), data)
 	if err != nil {
-		return nil, err
+		return directorySlot{}, err
 	}
-	return directoryEntries, nil
+
+	if sb.HasFeature(FeatureLongNames) && len(data) >= directoryEntryHeaderSize {
+		// Cut off following entries
+		recordLength := int(binary.LittleEndian.Uint16(data[4:6]))
+		if recordLength < len(data) {
+			data = data[:recordLength]
+		}
+	}
+
+	slots, err := decodeDirectorySlots(sb, data)
+	if err != nil {
+		return directorySlot{}, err
+	}
+	if len(slots) == 0 {
+		return directorySlot{}, fmt.Errorf("corrupted directory, no entry at offset %d", offset)
+	}
+
+	slots[0].offset = offset
+
+	return slots[0], nil
+}
+
+// MaxNameLength returns the longest name in bytes that can be stored in
+// directory entry on given volume.
+func MaxNameLength(sb Superblock) int {
+	if sb.HasFeature(FeatureLongNames) {
+		return DirectoryEntryNameLength
+	}
+
+	return LegacyDirectoryEntryNameLength
+}
+
+func ValidateName(sb Superblock, name string) error {
+	if len(name) == 0 || strings.ContainsAny(name, "/\x00") || !utf8.ValidString(name) {
+		return InvalidName{name}
+	}
+
+	if len(name) > MaxNameLength(sb) {
+		return NameTooLong{name, MaxNameLength(sb)}
+	}
+
+	return nil
+}
+
+// directoryEntryLength returns number of bytes needed to store directory entry
+func directoryEntryLength(sb Superblock, directoryEntry DirectoryEntry) (uint32, error) {
+	name := directoryEntry.NameBytes()
+	if len(name) > MaxNameLength(sb) {
+		return 0, NameTooLong{string(name), MaxNameLength(sb)}
+	}
+
+	if sb.HasFeature(FeatureLongNames) {
+		return uint32(directoryEntryHeaderSize + len(name)), nil
+	}
+
+	return uint32(unsafe.Sizeof(legacyDirectoryEntry{})), nil
+}
+
+// encodeDirectoryEntry writes on-disk representation of directory entry.
+// Variable-length entry is padded to recordLength, so it fills the whole slot.
+func encodeDirectoryEntry(sb Superblock, buf *bytes.Buffer, directoryEntry DirectoryEntry, recordLength uint32) error {
+	length, err := directoryEntryLength(sb, directoryEntry)
+	if err != nil {
+		return err
+	}
+
+	name := directoryEntry.NameBytes()
+	if !sb.HasFeature(FeatureLongNames) {
+		legacyEntry := legacyDirectoryEntry{InodePtr: directoryEntry.InodePtr}
+		copy(legacyEntry.Name[:], name)
+		return binary.Write(buf, binary.LittleEndian, legacyEntry)
+	}
+
+	if recordLength < length {
+		recordLength = length
+	}
+
+	err = binary.Write(buf, binary.LittleEndian, directoryEntryHeader{
+		InodePtr:     directoryEntry.InodePtr,
+		RecordLength: uint16(recordLength),
+		NameLength:   uint8(len(name)),
+	})
+	if err != nil {
+		return err
+	}
+	buf.Write(name)
+	buf.Write(make([]byte, recordLength-length))
+
+	return nil
+}
+
+// encodeDirectoryEntries returns on-disk representation of directory entries
+// together with offset of every entry in the returned data
+func encodeDirectoryEntries(sb Superblock, directoryEntries []DirectoryEntry) ([]byte, []uint32, error) {
+	buf := new(bytes.Buffer)
+	offsets := make([]uint32, len(directoryEntries))
+	for i, directoryEntry := range directoryEntries {
+		offsets[i] = uint32(buf.Len())
+
+		err := encodeDirectoryEntry(sb, buf, directoryEntry, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return buf.Bytes(), offsets, nil
+}
+
+func decodeDirectorySlots(sb Superblock, data []byte) ([]directorySlot, error) {
+	if !sb.HasFeature(FeatureLongNames) {
+		legacyEntrySize := int(unsafe.Sizeof(legacyDirectoryEntry{}))
+		legacyEntries := make([]legacyDirectoryEntry, len(data)/legacyEntrySize)
+		err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &legacyEntries)
+		if err != nil {
+			return nil, err
+		}
+
+		slots := make([]directorySlot, len(legacyEntries))
+		for i, legacyEntry := range legacyEntries {
+			copy(slots[i].entry.Name[:], legacyEntry.Name[:])
+			slots[i].entry.InodePtr = legacyEntry.InodePtr
+			slots[i].offset = uint32(i * legacyEntrySize)
+			slots[i].length = uint32(legacyEntrySize)
+		}
+
+		return slots, nil
+	}
+
+	slots := make([]directorySlot, 0)
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		offset := uint32(len(data) - reader.Len())
+
+		header := directoryEntryHeader{}
+		err := binary.Read(reader, binary.LittleEndian, &header)
+		if err != nil {
+			return nil, err
+		}
+
+		if int(header.RecordLength) < directoryEntryHeaderSize+int(header.NameLength) {
+			return nil, fmt.Errorf("corrupted directory entry, record length %d is too small", header.RecordLength)
+		}
+
+		record := make([]byte, int(header.RecordLength)-directoryEntryHeaderSize)
+		_, err = io.ReadFull(reader, record)
+		if err != nil {
+			return nil, err
+		}
+
+		slot := directorySlot{
+			entry:  DirectoryEntry{InodePtr: header.InodePtr},
+			offset: offset,
+			length: uint32(header.RecordLength),
+		}
+		copy(slot.entry.Name[:], record[:header.NameLength])
+		slots = append(slots, slot)
+	}
+
+	return slots, nil
+}
+
+func (d DirectoryEntry) NameBytes() []byte {
+	n := bytes.IndexByte(d.Name[:], 0)
+	if n < 0 {
+		return d.Name[:]
+	}
+
+	return d.Name[:n]
 }
 
 func FindDirectoryEntryByName(volume ReadWriteVolume, sb Superblock, inode Inode, name string) (DEPtr, DirectoryEntry, error) {
-	directoryEntries, err := ReadAllDirectoryEntries(volume, sb, inode)
+	deptr, slot, err := findDirectorySlot(volume, sb, inode, name)
 	if err != nil {
 		return 0, DirectoryEntry{}, err
 	}
 
+	return deptr, slot.entry, nil
+}
+
+func findDirectorySlot(volume ReadWriteVolume, sb Superblock, inode Inode, name string) (DEPtr, directorySlot, error) {
+	if len(name) > MaxNameLength(sb) {
+		// Such name can't be stored, comparing truncated name would give false match
+		return 0, directorySlot{}, DirectoryEntryNotFound{name}
+	}
+
 	nameBytes := StringNameToBytes(name)
-	for i, directoryEntry := range directoryEntries {
-		if directoryEntry.Name == nameBytes {
-			return DEPtr(i), directoryEntry, nil
+	if inode.DirectoryIndex != Unused {
+		return findIndexedDirectorySlot(volume, sb, inode, name, nameBytes)
+	}
+
+	slots, err := readDirectorySlots(volume, sb, inode)
+	if err != nil {
+		return 0, directorySlot{}, err
+	}
+
+	for i, slot := range slots {
+		if !slot.isFree() && slot.entry.Name == nameBytes {
+			return DEPtr(i), slot, nil
 		}
 	}
 
-	return 0, DirectoryEntry{}, DirectoryEntryNotFound{name}
+	return 0, directorySlot{}, DirectoryEntryNotFound{name}
 }
 
 func FindDirectoryEntryByInodePtr(volume ReadWriteVolume, sb Superblock, inode Inode, inodePtr InodePtr) (DEPtr, DirectoryEntry, error) {
-	directoryEntries, err := ReadAllDirectoryEntries(volume, sb, inode)
+	slots, err := readDirectorySlots(volume, sb, inode)
 	if err != nil {
 		return 0, DirectoryEntry{}, err
 	}
 
-	for i, directoryEntry := range directoryEntries {
-		if directoryEntry.InodePtr == inodePtr {
-			return DEPtr(i), directoryEntry, nil
+	for i, slot := range slots {
+		if !slot.isFree() && slot.entry.InodePtr == inodePtr {
+			return DEPtr(i), slot.entry, nil
 		}
 	}
 
 	return 0, DirectoryEntry{}, DirectoryEntryNotFound{}
 }
 
-func RemoveDirectoryEntry(volume ReadWriteVolume, sb Superblock, mutableInode MutableInode, name string) (DirectoryEntry, error) {
-	directoryEntries, err := ReadAllDirectoryEntries(volume, sb, *mutableInode.Inode)
+// RemoveDirectoryEntry marks slot of the entry as free, rest of the directory
+// stays untouched. The slot is reused by AppendDirectoryEntries later.
+func RemoveDirectoryEntry(volume ReadWriteVolume, sb Superblock, identity Identity, mutableInode MutableInode, name string) (DirectoryEntry, error) {
+	deptr, slot, err := findDirectorySlot(volume, sb, *mutableInode.Inode, name)
 	if err != nil {
 		return DirectoryEntry{}, err
 	}
 
-	var foundDirectoryEntry DirectoryEntry
-	for i := 0; i < len(directoryEntries); i++ {
-		if directoryEntries[i].Name == StringNameToBytes(name) {
-			foundDirectoryEntry = directoryEntries[i]
-
-			// Delete matching directory entry
-			directoryEntries = append(directoryEntries[:i], directoryEntries[i+1:]...)
-		}
-	}
-
-	err = SaveDirectoryEntries(volume, sb, mutableInode, directoryEntries)
+	foundDirectoryEntry := slot.entry
+	slot.entry = DirectoryEntry{InodePtr: FreeSlotInodePtr}
+	err = writeDirectorySlot(volume, sb, identity, mutableInode, slot)
 	if err != nil {
 		return foundDirectoryEntry, err
 	}
 
+	if mutableInode.Inode.DirectoryIndex != Unused {
+		err = removeFromDirectoryIndex(volume, sb, *mutableInode.Inode, deptr, foundDirectoryEntry, slot)
+		if err != nil {
+			return foundDirectoryEntry, err
+		}
+	}
+
 	return foundDirectoryEntry, nil
 }
 
-func SaveDirectoryEntries(volume ReadWriteVolume, sb Superblock, mutableInode MutableInode, directoryEntries []DirectoryEntry) error {
-	_, err := Shrink(mutableInode, volume, sb, 0)
+// SaveDirectoryEntries rewrites whole directory, free slots are dropped.
+func SaveDirectoryEntries(volume ReadWriteVolume, sb Superblock, identity Identity, mutableInode MutableInode, directoryEntries []DirectoryEntry) error {
+	data, offsets, err := encodeDirectoryEntries(sb, directoryEntries)
 	if err != nil {
 		return err
 	}
 
-	buf := new(bytes.Buffer)
-	err = binary.Write(buf, binary.LittleEndian, directoryEntries)
+	// Shrinking to zero drops directory index too, it's built again while appending
+	_, err = Shrink(mutableInode, volume, sb, identity, 0)
 	if err != nil {
 		return err
 	}
 
-	_, err = mutableInode.AppendData(volume, sb, buf.Bytes())
+	err = appendEncodedDirectoryEntries(volume, sb, identity, mutableInode, directoryEntries, data, offsets)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,622 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// Large directories are indexed by B+tree keyed by hash of the name. Inode
+// points to the index head cluster which holds pointer to the root node, so
+// the root can be split without modifying the inode. Every index record
+// contains slot (ordinal number) of the directory entry and its offset in
+// directory data. Head also remembers free slots of removed entries, so they
+// can be reused without scanning the directory.
+
+const (
+	indexHeadHeaderSize = 12
+	indexFreeSlotSize   = 12
+	indexNodeHeaderSize = 7
+	indexRecordSize     = 12
+)
+
+type indexHeadHeader struct {
+	Root          ClusterPtr
+	SlotCount     int32
+	FreeSlotCount int32
+}
+
+type indexFreeSlot struct {
+	Slot   DEPtr
+	Offset uint32
+	Length uint32
+}
+
+type indexHead struct {
+	Root      ClusterPtr
+	SlotCount int32
+	// Free slots that don't fit into head cluster are forgotten until the
+	// directory is rewritten
+	freeSlots []indexFreeSlot
+}
+
+type indexNodeHeader struct {
+	Leaf  byte
+	Count uint16
+	Next  ClusterPtr
+}
+
+type indexKey struct {
+	Hash uint32
+	Slot DEPtr
+}
+
+func (k indexKey) less(other indexKey) bool {
+	if k.Hash != other.Hash {
+		return k.Hash < other.Hash
+	}
+
+	return k.Slot < other.Slot
+}
+
+// indexRecord is entry of index node. Value is offset of directory entry in
+// leaf nodes and pointer to child node in internal nodes.
+type indexRecord struct {
+	Hash  uint32
+	Slot  DEPtr
+	Value uint32
+}
+
+func (r indexRecord) key() indexKey {
+	return indexKey{r.Hash, r.Slot}
+}
+
+type indexNode struct {
+	clusterPtr ClusterPtr
+	leaf       bool
+	next       ClusterPtr
+	// Child for keys lower than key of the first record, only in internal nodes
+	firstChild ClusterPtr
+	records    []indexRecord
+}
+
+func NameHash(name []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(name)
+	return h.Sum32()
+}
+
+func maxIndexRecords(sb Superblock, leaf bool) int {
+	if leaf {
+		return (int(sb.ClusterSize) - indexNodeHeaderSize) / indexRecordSize
+	}
+
+	return (int(sb.ClusterSize) - indexNodeHeaderSize - 4) / indexRecordSize
+}
+
+func newIndexNode(volume ReadWriteVolume, sb Superblock, identity Identity, leaf bool) (indexNode, error) {
+	clusterObjects, err := FindFreeClusters(volume, sb, identity, 1, true)
+	if err != nil {
+		return indexNode{}, err
+	}
+
+	return indexNode{
+		clusterPtr: VolumePtrToClusterPtr(sb, clusterObjects[0].VolumePtr),
+		leaf:       leaf,
+		next:       Unused,
+		firstChild: Unused,
+		records:    make([]indexRecord, 0),
+	}, nil
+}
+
+func loadIndexNode(volume ReadWriteVolume, sb Superblock, clusterPtr ClusterPtr) (indexNode, error) {
+	data := make([]byte, sb.ClusterSize)
+	err := volume.ReadBytes(ClusterPtrToVolumePtr(sb, clusterPtr), data)
+	if err != nil {
+		return indexNode{}, err
+	}
+	reader := bytes.NewReader(data)
+
+	header := indexNodeHeader{}
+	err = binary.Read(reader, binary.LittleEndian, &header)
+	if err != nil {
+		return indexNode{}, err
+	}
+
+	node := indexNode{
+		clusterPtr: clusterPtr,
+		leaf:       header.Leaf == 1,
+		next:       header.Next,
+		firstChild: Unused,
+		records:    make([]indexRecord, header.Count),
+	}
+
+	if int(header.Count) > maxIndexRecords(sb, node.leaf) {
+		return indexNode{}, OutOfRange{VolumePtr(header.Count), VolumePtr(maxIndexRecords(sb, node.leaf))}
+	}
+
+	if !node.leaf {
+		err = binary.Read(reader, binary.LittleEndian, &node.firstChild)
+		if err != nil {
+			return indexNode{}, err
+		}
+	}
+
+	err = binary.Read(reader, binary.LittleEndian, node.records)
+	if err != nil {
+		return indexNode{}, err
+	}
+
+	return node, nil
+}
+
+func (n indexNode) save(volume ReadWriteVolume, sb Superblock) error {
+	var leaf byte
+	if n.leaf {
+		leaf = 1
+	}
+
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, indexNodeHeader{
+		Leaf:  leaf,
+		Count: uint16(len(n.records)),
+		Next:  n.next,
+	})
+	if err != nil {
+		return err
+	}
+
+	if !n.leaf {
+		err = binary.Write(buf, binary.LittleEndian, n.firstChild)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = binary.Write(buf, binary.LittleEndian, n.records)
+	if err != nil {
+		return err
+	}
+
+	return volume.WriteStruct(ClusterPtrToVolumePtr(sb, n.clusterPtr), buf.Bytes())
+}
+
+// childIndex returns index of child that covers given key
+func (n indexNode) childIndex(key indexKey) int {
+	return sort.Search(len(n.records), func(i int) bool {
+		return key.less(n.records[i].key())
+	})
+}
+
+func (n indexNode) child(index int) ClusterPtr {
+	if index == 0 {
+		return n.firstChild
+	}
+
+	return ClusterPtr(n.records[index-1].Value)
+}
+
+func maxIndexFreeSlots(sb Superblock) int {
+	return (int(sb.ClusterSize) - indexHeadHeaderSize) / indexFreeSlotSize
+}
+
+func loadIndexHead(volume ReadWriteVolume, sb Superblock, headPtr ClusterPtr) (indexHead, error) {
+	header := indexHeadHeader{}
+	err := volume.ReadStruct(ClusterPtrToVolumePtr(sb, headPtr), &header)
+	if err != nil {
+		return indexHead{}, err
+	}
+
+	if header.FreeSlotCount < 0 || int(header.FreeSlotCount) > maxIndexFreeSlots(sb) {
+		return indexHead{}, OutOfRange{VolumePtr(header.FreeSlotCount), VolumePtr(maxIndexFreeSlots(sb))}
+	}
+
+	head := indexHead{
+		Root:      header.Root,
+		SlotCount: header.SlotCount,
+		freeSlots: make([]indexFreeSlot, header.FreeSlotCount),
+	}
+	err = volume.ReadStruct(ClusterPtrToVolumePtr(sb, headPtr)+indexHeadHeaderSize, head.freeSlots)
+
+	return head, err
+}
+
+func saveIndexHead(volume ReadWriteVolume, sb Superblock, headPtr ClusterPtr, head indexHead) error {
+	err := volume.WriteStruct(ClusterPtrToVolumePtr(sb, headPtr), indexHeadHeader{
+		Root:          head.Root,
+		SlotCount:     head.SlotCount,
+		FreeSlotCount: int32(len(head.freeSlots)),
+	})
+	if err != nil {
+		return err
+	}
+
+	return volume.WriteStruct(ClusterPtrToVolumePtr(sb, headPtr)+indexHeadHeaderSize, head.freeSlots)
+}
+
+func (h *indexHead) addFreeSlot(sb Superblock, freeSlot indexFreeSlot) {
+	if len(h.freeSlots) < maxIndexFreeSlots(sb) {
+		h.freeSlots = append(h.freeSlots, freeSlot)
+	}
+}
+
+func createDirectoryIndex(volume ReadWriteVolume, sb Superblock, identity Identity) (ClusterPtr, error) {
+	headObjects, err := FindFreeClusters(volume, sb, identity, 1, true)
+	if err != nil {
+		return Unused, err
+	}
+	headPtr := VolumePtrToClusterPtr(sb, headObjects[0].VolumePtr)
+
+	root, err := newIndexNode(volume, sb, identity, true)
+	if err != nil {
+		return Unused, err
+	}
+
+	err = root.save(volume, sb)
+	if err != nil {
+		return Unused, err
+	}
+
+	return headPtr, saveIndexHead(volume, sb, headPtr, indexHead{Root: root.clusterPtr, SlotCount: 0})
+}
+
+func indexInsert(volume ReadWriteVolume, sb Superblock, identity Identity, head *indexHead, record indexRecord) error {
+	separator, err := indexInsertIntoNode(volume, sb, identity, head.Root, record)
+	if err != nil {
+		return err
+	}
+
+	if separator != nil {
+		// Root was split, tree grows by one level
+		newRoot, err := newIndexNode(volume, sb, identity, false)
+		if err != nil {
+			return err
+		}
+
+		newRoot.firstChild = head.Root
+		newRoot.records = append(newRoot.records, *separator)
+		err = newRoot.save(volume, sb)
+		if err != nil {
+			return err
+		}
+
+		head.Root = newRoot.clusterPtr
+	}
+
+	return nil
+}
+
+// indexInsertIntoNode inserts record into subtree. If the node has to be
+// split, separator record pointing to the new right sibling is returned.
+func indexInsertIntoNode(volume ReadWriteVolume, sb Superblock, identity Identity, clusterPtr ClusterPtr, record indexRecord) (*indexRecord, error) {
+	node, err := loadIndexNode(volume, sb, clusterPtr)
+	if err != nil {
+		return nil, err
+	}
+
+	position := node.childIndex(record.key())
+	if node.leaf {
+		node.records = append(node.records, indexRecord{})
+		copy(node.records[position+1:], node.records[position:])
+		node.records[position] = record
+	} else {
+		separator, err := indexInsertIntoNode(volume, sb, identity, node.child(position), record)
+		if err != nil || separator == nil {
+			return nil, err
+		}
+
+		node.records = append(node.records, indexRecord{})
+		copy(node.records[position+1:], node.records[position:])
+		node.records[position] = *separator
+	}
+
+	if len(node.records) <= maxIndexRecords(sb, node.leaf) {
+		return nil, node.save(volume, sb)
+	}
+
+	// Split node in half
+	right, err := newIndexNode(volume, sb, identity, node.leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	middle := len(node.records) / 2
+	var separator indexRecord
+	if node.leaf {
+		right.records = append(right.records, node.records[middle:]...)
+		node.records = node.records[:middle]
+		right.next = node.next
+		node.next = right.clusterPtr
+		separator = right.records[0]
+	} else {
+		separator = node.records[middle]
+		right.firstChild = ClusterPtr(separator.Value)
+		right.records = append(right.records, node.records[middle+1:]...)
+		node.records = node.records[:middle]
+	}
+	separator.Value = uint32(right.clusterPtr)
+
+	err = node.save(volume, sb)
+	if err != nil {
+		return nil, err
+	}
+
+	err = right.save(volume, sb)
+	if err != nil {
+		return nil, err
+	}
+
+	return &separator, nil
+}
+
+func indexFindLeaf(volume ReadWriteVolume, sb Superblock, head indexHead, key indexKey) (indexNode, error) {
+	node, err := loadIndexNode(volume, sb, head.Root)
+	if err != nil {
+		return indexNode{}, err
+	}
+
+	for !node.leaf {
+		node, err = loadIndexNode(volume, sb, node.child(node.childIndex(key)))
+		if err != nil {
+			return indexNode{}, err
+		}
+	}
+
+	return node, nil
+}
+
+// indexLookup returns all leaf records with given hash
+func indexLookup(volume ReadWriteVolume, sb Superblock, head indexHead, hash uint32) ([]indexRecord, error) {
+	key := indexKey{hash, math.MinInt32}
+	node, err := indexFindLeaf(volume, sb, head, key)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]indexRecord, 0)
+	position := node.childIndex(key)
+	for {
+		for ; position < len(node.records); position++ {
+			if node.records[position].Hash != hash {
+				return records, nil
+			}
+
+			records = append(records, node.records[position])
+		}
+
+		if node.next == Unused {
+			return records, nil
+		}
+
+		node, err = loadIndexNode(volume, sb, node.next)
+		if err != nil {
+			return nil, err
+		}
+		position = 0
+	}
+}
+
+// indexDelete removes record from leaf. Underfull nodes are not merged, the
+// tree never gets deeper than it was at its largest size.
+func indexDelete(volume ReadWriteVolume, sb Superblock, head indexHead, key indexKey) error {
+	node, err := indexFindLeaf(volume, sb, head, key)
+	if err != nil {
+		return err
+	}
+
+	for i, record := range node.records {
+		if record.key() == key {
+			node.records = append(node.records[:i], node.records[i+1:]...)
+			return node.save(volume, sb)
+		}
+	}
+
+	return nil
+}
+
+func (i Inode) GetDirectoryIndexPtrs(volume ReadWriteVolume, sb Superblock) ([]ClusterPtr, error) {
+	if i.DirectoryIndex == Unused {
+		return []ClusterPtr{}, nil
+	}
+
+	head, err := loadIndexHead(volume, sb, i.DirectoryIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	ptrs := []ClusterPtr{i.DirectoryIndex}
+	err = collectIndexNodePtrs(volume, sb, head.Root, &ptrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return ptrs, nil
+}
+
+func collectIndexNodePtrs(volume ReadWriteVolume, sb Superblock, clusterPtr ClusterPtr, out *[]ClusterPtr) error {
+	node, err := loadIndexNode(volume, sb, clusterPtr)
+	if err != nil {
+		return err
+	}
+
+	*out = append(*out, clusterPtr)
+	if node.leaf {
+		return nil
+	}
+
+	for i := 0; i <= len(node.records); i++ {
+		err = collectIndexNodePtrs(volume, sb, node.child(i), out)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func freeDirectoryIndex(inode *Inode, volume ReadWriteVolume, sb Superblock) error {
+	ptrs, err := inode.GetDirectoryIndexPtrs(volume, sb)
+	if err != nil {
+		return err
+	}
+
+	for _, ptr := range ptrs {
+		err = FreeCluster(volume, sb, ptr)
+		if err != nil {
+			return err
+		}
+	}
+
+	inode.DirectoryIndex = Unused
+
+	return nil
+}
+
+// buildDirectoryIndex creates index for directory that was linear so far
+func buildDirectoryIndex(volume ReadWriteVolume, sb Superblock, identity Identity, mutableInode MutableInode) error {
+	slots, err := readDirectorySlots(volume, sb, *mutableInode.Inode)
+	if err != nil {
+		return err
+	}
+
+	headPtr, err := createDirectoryIndex(volume, sb, identity)
+	if err != nil {
+		return err
+	}
+
+	head, err := loadIndexHead(volume, sb, headPtr)
+	if err != nil {
+		return err
+	}
+
+	for i, slot := range slots {
+		if slot.isFree() {
+			head.addFreeSlot(sb, indexFreeSlot{DEPtr(i), slot.offset, slot.length})
+			continue
+		}
+
+		err = indexInsert(volume, sb, identity, &head, indexRecord{
+			Hash:  NameHash(slot.entry.NameBytes()),
+			Slot:  DEPtr(i),
+			Value: slot.offset,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	head.SlotCount = int32(len(slots))
+
+	err = saveIndexHead(volume, sb, headPtr, head)
+	if err != nil {
+		return err
+	}
+
+	mutableInode.Inode.DirectoryIndex = headPtr
+
+	return mutableInode.Save(volume, sb)
+}
+
+func shouldIndexDirectory(sb Superblock, inode Inode) bool {
+	return sb.HasFeature(FeatureIndexedDirectories) &&
+		inode.DirectoryIndex == Unused &&
+		inode.Size > VolumePtr(sb.ClusterSize)
+}
+
+func appendToDirectoryIndex(volume ReadWriteVolume, sb Superblock, identity Identity, inode Inode, directoryEntries []DirectoryEntry, offsets []uint32) error {
+	head, err := loadIndexHead(volume, sb, inode.DirectoryIndex)
+	if err != nil {
+		return err
+	}
+
+	for i, directoryEntry := range directoryEntries {
+		err = indexInsert(volume, sb, identity, &head, indexRecord{
+			Hash:  NameHash(directoryEntry.NameBytes()),
+			Slot:  DEPtr(head.SlotCount),
+			Value: offsets[i],
+		})
+		if err != nil {
+			return err
+		}
+
+		head.SlotCount++
+	}
+
+	return saveIndexHead(volume, sb, inode.DirectoryIndex, head)
+}
+
+func findIndexedDirectorySlot(volume ReadWriteVolume, sb Superblock, inode Inode, name string, nameBytes [DirectoryEntryNameLength]byte) (DEPtr, directorySlot, error) {
+	head, err := loadIndexHead(volume, sb, inode.DirectoryIndex)
+	if err != nil {
+		return 0, directorySlot{}, err
+	}
+
+	records, err := indexLookup(volume, sb, head, NameHash([]byte(name)))
+	if err != nil {
+		return 0, directorySlot{}, err
+	}
+
+	// Compare names of all entries with the same hash
+	for _, record := range records {
+		slot, err := readDirectorySlotAt(volume, sb, inode, record.Value)
+		if err != nil {
+			return 0, directorySlot{}, err
+		}
+
+		if !slot.isFree() && slot.entry.Name == nameBytes {
+			return record.Slot, slot, nil
+		}
+	}
+
+	return 0, directorySlot{}, DirectoryEntryNotFound{name}
+}
+
+func reuseIndexedDirectorySlot(volume ReadWriteVolume, sb Superblock, identity Identity, inode MutableInode, directoryEntry DirectoryEntry, neededLength uint32) (bool, error) {
+	head, err := loadIndexHead(volume, sb, inode.Inode.DirectoryIndex)
+	if err != nil {
+		return false, err
+	}
+
+	for i, freeSlot := range head.freeSlots {
+		if freeSlot.Length < neededLength {
+			continue
+		}
+
+		err = writeDirectorySlot(volume, sb, identity, inode, directorySlot{directoryEntry, freeSlot.Offset, freeSlot.Length})
+		if err != nil {
+			return false, err
+		}
+
+		err = indexInsert(volume, sb, identity, &head, indexRecord{
+			Hash:  NameHash(directoryEntry.NameBytes()),
+			Slot:  freeSlot.Slot,
+			Value: freeSlot.Offset,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		head.freeSlots = append(head.freeSlots[:i], head.freeSlots[i+1:]...)
+
+		return true, saveIndexHead(volume, sb, inode.Inode.DirectoryIndex, head)
+	}
+
+	return false, nil
+}
+
+func removeFromDirectoryIndex(volume ReadWriteVolume, sb Superblock, inode Inode, deptr DEPtr, directoryEntry DirectoryEntry, slot directorySlot) error {
+	head, err := loadIndexHead(volume, sb, inode.DirectoryIndex)
+	if err != nil {
+		return err
+	}
+
+	err = indexDelete(volume, sb, head, indexKey{NameHash(directoryEntry.NameBytes()), deptr})
+	if err != nil {
+		return err
+	}
+
+	head.addFreeSlot(sb, indexFreeSlot{deptr, slot.offset, slot.length})
+
+	return saveIndexHead(volume, sb, inode.DirectoryIndex, head)
+}
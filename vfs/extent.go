@@ -0,0 +1,379 @@
+package vfs
+
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+)
+
+// InodeFlagExtents marks inode whose data clusters are mapped by extents
+// instead of direct and indirect pointers
+const InodeFlagExtents = 1
+
+// InodeExtentCount is number of extents stored directly in the inode. When
+// they are not enough, they are moved to leaf clusters and the inode keeps
+// only index entries pointing to the leaves.
+const InodeExtentCount = 4
+
+// Extent is a run of Length data clusters starting at cluster Start, which
+// holds cluster Logical of the file. Index entry uses Start as pointer to the
+// leaf cluster and Length as number of extents in the leaf.
+type Extent struct {
+	Logical ClusterPtr
+	Start   ClusterPtr
+	Length  ClusterPtr
+}
+
+func (e Extent) end() ClusterPtr {
+	return e.Logical + e.Length
+}
+
+type TooManyExtents struct {
+	Count int
+}
+
+func (t TooManyExtents) Error() string {
+	return fmt.Sprintf("file is too fragmented, %d extents don't fit into extent tree", t.Count)
+}
+
+func (i Inode) UsesExtents() bool {
+	return i.Flags&InodeFlagExtents != 0
+}
+
+func maxExtentsInLeaf(sb Superblock) int {
+	return int(VolumePtr(sb.ClusterSize) / VolumePtr(unsafe.Sizeof(Extent{})))
+}
+
+// readExtents returns all extents of the inode ordered by logical cluster
+func (i Inode) readExtents(volume ReadWriteVolume, sb Superblock) ([]Extent, error) {
+	extents := make([]Extent, 0, i.ExtentCount)
+	if i.ExtentDepth == 0 {
+		return append(extents, i.Extents[:i.ExtentCount]...), nil
+	}
+
+	for _, index := range i.Extents[:i.ExtentCount] {
+		leaf := make([]Extent, index.Length)
+		err := volume.ReadStruct(ClusterPtrToVolumePtr(sb, index.Start), leaf)
+		if err != nil {
+			return nil, err
+		}
+
+		extents = append(extents, leaf...)
+	}
+
+	return extents, nil
+}
+
+func (i Inode) extentLeafPtrs() []ClusterPtr {
+	leafPtrs := make([]ClusterPtr, 0)
+	if i.ExtentDepth == 0 {
+		return leafPtrs
+	}
+
+	for _, index := range i.Extents[:i.ExtentCount] {
+		leafPtrs = append(leafPtrs, index.Start)
+	}
+
+	return leafPtrs
+}
+
+// writeExtents stores extents into the inode. Leaf clusters are allocated,
+// reused or freed according to number of extents.
+func (i *Inode) writeExtents(volume ReadWriteVolume, sb Superblock, identity Identity, extents []Extent) error {
+	leafPtrs := i.extentLeafPtrs()
+	leafCount := 0
+	perLeaf := maxExtentsInLeaf(sb)
+	if len(extents) > InodeExtentCount {
+		leafCount = (len(extents) + perLeaf - 1) / perLeaf
+	}
+
+	if leafCount > InodeExtentCount {
+		return TooManyExtents{len(extents)}
+	}
+
+	oldLeafCount := len(leafPtrs)
+	for len(leafPtrs) < leafCount {
+		leafObjects, err := FindFreeClusters(volume, sb, identity, 1, true)
+		if err != nil {
+			// Leaves allocated by this call aren't stored anywhere yet
+			for _, leafPtr := range leafPtrs[oldLeafCount:] {
+				_ = FreeCluster(volume, sb, leafPtr)
+			}
+			return err
+		}
+		leafPtrs = append(leafPtrs, VolumePtrToClusterPtr(sb, leafObjects[0].VolumePtr))
+	}
+
+	for len(leafPtrs) > leafCount {
+		err := FreeCluster(volume, sb, leafPtrs[len(leafPtrs)-1])
+		if err != nil {
+			return err
+		}
+		leafPtrs = leafPtrs[:len(leafPtrs)-1]
+	}
+
+	i.Extents = [InodeExtentCount]Extent{}
+	if leafCount == 0 {
+		i.ExtentDepth = 0
+		i.ExtentCount = uint16(copy(i.Extents[:], extents))
+
+		return nil
+	}
+
+	for l, leafPtr := range leafPtrs {
+		leaf := extents[l*perLeaf:]
+		if len(leaf) > perLeaf {
+			leaf = leaf[:perLeaf]
+		}
+
+		err := volume.WriteStruct(ClusterPtrToVolumePtr(sb, leafPtr), leaf)
+		if err != nil {
+			return err
+		}
+
+		i.Extents[l] = Extent{
+			Logical: leaf[0].Logical,
+			Start:   leafPtr,
+			Length:  ClusterPtr(len(leaf)),
+		}
+	}
+	i.ExtentDepth = 1
+	i.ExtentCount = uint16(leafCount)
+
+	return nil
+}
+
+// resolveClusterInExtents returns Unused for cluster that isn't covered by any
+// extent, such cluster is a hole
+func resolveClusterInExtents(extents []Extent, index ClusterPtr) (ClusterPtr, error) {
+	for _, extent := range extents {
+		if index >= extent.Logical && index < extent.end() {
+			return extent.Start + (index - extent.Logical), nil
+		}
+	}
+
+	return Unused, nil
+}
+
+func (i Inode) resolveExtentClusterAddress(volume ReadWriteVolume, sb Superblock, index ClusterPtr) (ClusterPtr, error) {
+	extents := i.Extents[:i.ExtentCount]
+	if i.ExtentDepth == 0 {
+		return resolveClusterInExtents(extents, index)
+	}
+
+	// Only the leaf that can contain the cluster is read
+	leafIndex := -1
+	for j, extent := range extents {
+		if extent.Logical <= index {
+			leafIndex = j
+		}
+	}
+	if leafIndex == -1 {
+		return Unused, nil
+	}
+
+	leaf := make([]Extent, extents[leafIndex].Length)
+	err := volume.ReadStruct(ClusterPtrToVolumePtr(sb, extents[leafIndex].Start), leaf)
+	if err != nil {
+		return 0, err
+	}
+
+	return resolveClusterInExtents(leaf, index)
+}
+
+// insertClusterIntoExtents maps data cluster ptr as cluster logical of the
+// file. Neighbouring extents are extended or merged when they are contiguous.
+func insertClusterIntoExtents(extents []Extent, logical ClusterPtr, ptr ClusterPtr) []Extent {
+	position := sort.Search(len(extents), func(j int) bool {
+		return extents[j].Logical > logical
+	})
+
+	continuesNext := position < len(extents) &&
+		extents[position].Logical == logical+1 && extents[position].Start == ptr+1
+
+	if position > 0 {
+		previous := &extents[position-1]
+		if previous.end() == logical && previous.Start+previous.Length == ptr {
+			previous.Length++
+			if continuesNext {
+				previous.Length += extents[position].Length
+				extents = append(extents[:position], extents[position+1:]...)
+			}
+			return extents
+		}
+	}
+
+	if continuesNext {
+		extents[position].Logical--
+		extents[position].Start--
+		extents[position].Length++
+		return extents
+	}
+
+	extents = append(extents, Extent{})
+	copy(extents[position+1:], extents[position:])
+	extents[position] = Extent{Logical: logical, Start: ptr, Length: 1}
+
+	return extents
+}
+
+func allocateExtents(inode *Inode, volume ReadWriteVolume, sb Superblock, identity Identity, size VolumePtr) (VolumePtr, error) {
+	extents, err := inode.readExtents(volume, sb)
+	if err != nil {
+		return 0, err
+	}
+
+	neededClusters := NeededClusters(sb, size)
+	newPtrs := make([]ClusterPtr, 0, neededClusters)
+
+	// Clusters right after the last extent let it grow instead of adding
+	// a new one
+	if len(extents) > 0 {
+		last := extents[len(extents)-1]
+		for goal := last.Start + last.Length; ClusterPtr(len(newPtrs)) < neededClusters && goal < sb.ClusterCount; goal++ {
+			isFree, err := IsClusterFree(volume, sb, goal)
+			if err != nil {
+				return 0, err
+			}
+			if !isFree {
+				break
+			}
+
+			err = OccupyCluster(volume, sb, goal)
+			if err != nil {
+				return 0, err
+			}
+			newPtrs = append(newPtrs, goal)
+		}
+	}
+
+	if remainingClusters := neededClusters - ClusterPtr(len(newPtrs)); remainingClusters > 0 {
+		clusterObjects, err := FindFreeClusters(volume, sb, identity, remainingClusters, true)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, clusterObject := range clusterObjects {
+			newPtrs = append(newPtrs, VolumePtrToClusterPtr(sb, clusterObject.VolumePtr))
+		}
+	}
+
+	logical := inode.AllocatedClusters
+	for _, ptr := range newPtrs {
+		extents = insertClusterIntoExtents(extents, logical, ptr)
+		logical++
+	}
+
+	err = inode.writeExtents(volume, sb, identity, extents)
+	if err != nil {
+		for _, ptr := range newPtrs {
+			freeErr := FreeCluster(volume, sb, ptr)
+			if freeErr != nil {
+				return 0, freeErr
+			}
+		}
+
+		return 0, err
+	}
+
+	inode.AllocatedClusters = logical
+
+	return VolumePtr(len(newPtrs)) * VolumePtr(sb.ClusterSize), nil
+}
+
+func shrinkExtents(inode *Inode, volume ReadWriteVolume, sb Superblock, identity Identity, targetSize VolumePtr) (VolumePtr, error) {
+	allocatedSize := VolumePtr(inode.AllocatedClusters) * VolumePtr(sb.ClusterSize)
+
+	extents, err := inode.readExtents(volume, sb)
+	if err != nil {
+		return allocatedSize, err
+	}
+
+	targetClusters := NeededClusters(sb, targetSize)
+	for len(extents) > 0 {
+		last := &extents[len(extents)-1]
+		if last.end() <= targetClusters {
+			break
+		}
+
+		keptLength := targetClusters - last.Logical
+		if keptLength < 0 {
+			keptLength = 0
+		}
+
+		for ptr := last.Start + keptLength; ptr < last.Start+last.Length; ptr++ {
+			err = FreeCluster(volume, sb, ptr)
+			if err != nil {
+				return allocatedSize, err
+			}
+
+		}
+
+		last.Length = keptLength
+		if last.Length == 0 {
+			extents = extents[:len(extents)-1]
+		}
+	}
+
+	// Holes aren't covered by extents, but they are counted too
+	if inode.AllocatedClusters > targetClusters {
+		inode.AllocatedClusters = targetClusters
+	}
+	allocatedSize = VolumePtr(inode.AllocatedClusters) * VolumePtr(sb.ClusterSize)
+
+	return allocatedSize, inode.writeExtents(volume, sb, identity, extents)
+}
+
+// getUsedExtentPtrs returns data clusters in the same shape as GetUsedPtrs.
+// Clusters of extents stored in the inode are returned as direct pointers,
+// leaf clusters are returned as keys of the indirect1 map.
+func (i Inode) getUsedExtentPtrs(volume ReadWriteVolume, sb Superblock) (
+	[]ClusterPtr,
+	map[ClusterPtr][]ClusterPtr,
+	error) {
+
+	directPtrs := make([]ClusterPtr, 0)
+	leafPtrs := make(map[ClusterPtr][]ClusterPtr)
+
+	if i.ExtentDepth == 0 {
+		for _, extent := range i.Extents[:i.ExtentCount] {
+			directPtrs = append(directPtrs, extent.clusterPtrs()...)
+		}
+
+		return directPtrs, leafPtrs, nil
+	}
+
+	for _, index := range i.Extents[:i.ExtentCount] {
+		leaf := make([]Extent, index.Length)
+		err := volume.ReadStruct(ClusterPtrToVolumePtr(sb, index.Start), leaf)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		dataPtrs := make([]ClusterPtr, 0)
+		for _, extent := range leaf {
+			dataPtrs = append(dataPtrs, extent.clusterPtrs()...)
+		}
+		leafPtrs[index.Start] = dataPtrs
+	}
+
+	return directPtrs, leafPtrs, nil
+}
+
+func (e Extent) clusterPtrs() []ClusterPtr {
+	ptrs := make([]ClusterPtr, 0, e.Length)
+	for ptr := e.Start; ptr < e.Start+e.Length; ptr++ {
+		ptrs = append(ptrs, ptr)
+	}
+
+	return ptrs
+}
+
+// GetExtents returns all extents mapping data of the inode
+func (i Inode) GetExtents(volume ReadWriteVolume, sb Superblock) ([]Extent, error) {
+	if !i.UsesExtents() {
+		return []Extent{}, nil
+	}
+
+	return i.readExtents(volume, sb)
+}
@@ -0,0 +1,188 @@
+package vfs
+
+import (
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+const (
+	MinClusterSize = 512
+	MaxClusterSize = 16384
+	// MinBytesPerInode keeps inode table from taking most of the volume
+	MinBytesPerInode   = 1024
+	MaxSignatureLength = 9
+	MaxLabelLength     = 251
+	// MaxReservedPercentage of data clusters can be reserved for root
+	MaxReservedPercentage = 50
+)
+
+type InvalidFormatOptions struct {
+	Reason string
+}
+
+func (i InvalidFormatOptions) Error() string {
+	return fmt.Sprintf("invalid format options: %s", i.Reason)
+}
+
+// FormatOptions describe layout of newly created filesystem. Only one of
+// BytesPerInode and InodeCount can be set, when none of them is set,
+// metadata take 5 % of the volume.
+type FormatOptions struct {
+	ClusterSize   int16
+	BytesPerInode VolumePtr
+	InodeCount    VolumePtr
+	// Signature identifies author of the filesystem
+	Signature string
+	Label     string
+	// Percentage of data clusters that can be allocated only by root
+	ReservedPercentage int
+	// Content of files is verified on every read
+	DataChecksums bool
+	// New inodes map their data by extents instead of pointer tables
+	Extents bool
+}
+
+func DefaultFormatOptions() FormatOptions {
+	return FormatOptions{
+		ClusterSize: 4096,
+		Signature:   "janopa",
+		Label:       "kiv/zos",
+	}
+}
+
+// Validate checks options that don't depend on size of the volume
+func (o FormatOptions) Validate() error {
+	if o.ClusterSize < MinClusterSize || o.ClusterSize > MaxClusterSize || o.ClusterSize&(o.ClusterSize-1) != 0 {
+		return InvalidFormatOptions{fmt.Sprintf("cluster size must be power of two between %d and %d", MinClusterSize, MaxClusterSize)}
+	}
+
+	if o.BytesPerInode != 0 && o.InodeCount != 0 {
+		return InvalidFormatOptions{"bytes per inode and inode count can't be used together"}
+	}
+
+	if o.BytesPerInode < 0 || (o.BytesPerInode > 0 && o.BytesPerInode < MinBytesPerInode) {
+		return InvalidFormatOptions{fmt.Sprintf("bytes per inode must be at least %d", MinBytesPerInode)}
+	}
+
+	if o.InodeCount < 0 {
+		return InvalidFormatOptions{"inode count can't be negative"}
+	}
+
+	if len(o.Signature) > MaxSignatureLength {
+		return InvalidFormatOptions{fmt.Sprintf("signature can't be longer than %d bytes", MaxSignatureLength)}
+	}
+
+	if len(o.Label) > MaxLabelLength {
+		return InvalidFormatOptions{fmt.Sprintf("label can't be longer than %d bytes", MaxLabelLength)}
+	}
+
+	if o.ReservedPercentage < 0 || o.ReservedPercentage > MaxReservedPercentage {
+		return InvalidFormatOptions{fmt.Sprintf("reserved percentage must be between 0 and %d", MaxReservedPercentage)}
+	}
+
+	return nil
+}
+
+func NewFilesystemWithOptions(volume StorageVolume, options FormatOptions) (Filesystem, error) {
+	volumeSize, err := volume.Size()
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	sb, err := NewSuperblockWithOptions(volumeSize, options)
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	return Filesystem{
+		Volume:     volume,
+		Superblock: sb,
+	}, nil
+}
+
+// NewSuperblockWithOptions computes layout of volume of given size, so
+// options can be checked before anything is written
+func NewSuperblockWithOptions(volumeSize VolumePtr, options FormatOptions) (Superblock, error) {
+	err := options.Validate()
+	if err != nil {
+		return Superblock{}, err
+	}
+
+	clusterSize := options.ClusterSize
+	journalSize := VolumePtr(float64(volumeSize) * 0.01) // 1%
+
+	sb := NewPreparedSuperblock(options.Signature, options.Label, volumeSize, clusterSize)
+	sbSize := VolumePtr(unsafe.Sizeof(sb))
+	inodeSize := VolumePtr(unsafe.Sizeof(Inode{}))
+
+	var metadataSize, totalInodesCount VolumePtr
+	if options.InodeCount == 0 && options.BytesPerInode == 0 {
+		metadataSize = VolumePtr(float64(volumeSize) * 0.05) // 5%
+		sb.ClusterCount = ClusterPtr((volumeSize - metadataSize) / VolumePtr(clusterSize))
+		clusterBitmapSize := NeededMemoryForBitmap(VolumePtr(sb.ClusterCount))
+
+		totalInodesCount = VolumePtr(float64(metadataSize-sbSize-clusterBitmapSize-journalSize) / (float64(inodeSize) + 1.0/8)) // Just math
+	} else {
+		if options.InodeCount > 0 {
+			totalInodesCount = options.InodeCount
+		} else {
+			totalInodesCount = volumeSize / options.BytesPerInode
+		}
+
+		// Data never take the whole volume, so the bitmap and checksum table
+		// are large enough for every cluster
+		maxClusterCount := ClusterPtr(volumeSize / VolumePtr(clusterSize))
+		maxClusterBitmapSize := NeededMemoryForBitmap(VolumePtr(maxClusterCount))
+		inodeBitmapSize := NeededMemoryForBitmap(totalInodesCount)
+		maxChecksumTableSize := checksumTableSize(maxClusterCount, maxClusterBitmapSize, inodeBitmapSize)
+		metadataSize = sbSize + maxClusterBitmapSize + inodeBitmapSize + totalInodesCount*inodeSize + journalSize + maxChecksumTableSize
+		if metadataSize >= volumeSize {
+			return Superblock{}, InvalidFormatOptions{"metadata don't fit into volume, use less inodes"}
+		}
+		sb.ClusterCount = ClusterPtr((volumeSize - metadataSize) / VolumePtr(clusterSize))
+
+		// Exact bitmap and checksum table are smaller, data start right after
+		// inodes, journal and checksum table
+		clusterBitmapSize := NeededMemoryForBitmap(VolumePtr(sb.ClusterCount))
+		metadataSize -= maxClusterBitmapSize - clusterBitmapSize
+		metadataSize -= maxChecksumTableSize - checksumTableSize(sb.ClusterCount, clusterBitmapSize, inodeBitmapSize)
+	}
+
+	if totalInodesCount < 1 {
+		return Superblock{}, InvalidFormatOptions{"volume is too small for any inode"}
+	}
+	if totalInodesCount > math.MaxInt32 {
+		return Superblock{}, InvalidFormatOptions{"too many inodes"}
+	}
+	if sb.ClusterCount < 1 {
+		return Superblock{}, InvalidFormatOptions{"no space is left for data clusters, use less inodes"}
+	}
+	sb.ReservedClusters = ClusterPtr(VolumePtr(sb.ClusterCount) * VolumePtr(options.ReservedPercentage) / 100)
+
+	sb.ClusterBitmapStartAddress = sbSize
+	sb.InodeBitmapStartAddress = sb.ClusterBitmapStartAddress + NeededMemoryForBitmap(VolumePtr(sb.ClusterCount))
+	sb.InodesStartAddress = sb.InodeBitmapStartAddress + NeededMemoryForBitmap(totalInodesCount)
+
+	// In the default layout checksum table takes place of the last inodes
+	sb.ChecksumsStartAddress = metadataSize - checksumTableSize(
+		sb.ClusterCount,
+		sb.InodeBitmapStartAddress-sb.ClusterBitmapStartAddress,
+		sb.InodesStartAddress-sb.InodeBitmapStartAddress,
+	)
+	sb.JournalStartAddress = sb.ChecksumsStartAddress - journalSize
+	sb.JournalSize = journalSize
+	sb.DataStartAddress = metadataSize
+	if sb.JournalStartAddress < sb.InodesStartAddress+inodeSize {
+		return Superblock{}, InvalidFormatOptions{"volume is too small for any inode"}
+	}
+	sb.FeatureFlags |= FeatureJournal | FeatureLongNames | FeatureIndexedDirectories | FeatureInlineData
+	if options.DataChecksums {
+		sb.FeatureFlags |= FeatureDataChecksums
+	}
+	if options.Extents {
+		sb.FeatureFlags |= FeatureExtents
+	}
+
+	return sb, nil
+}
@@ -1,68 +1,176 @@
 package vfs
 
-import (
-	"math"
-	"unsafe"
-)
+import "time"
 
 type Filesystem struct {
-	Volume          Volume
+	Volume          StorageVolume
 	Superblock      Superblock
 	RootInodePtr    InodePtr
 	CurrentInodePtr InodePtr
+	// User performing operations, zero value is root
+	Identity Identity
 }
 
-func NewFilesystem(volume Volume, clusterSize int16) (Filesystem, error) {
-	volumeSize, err := volume.Size()
+// NewFilesystem creates filesystem with default options and given cluster size
+func NewFilesystem(volume StorageVolume, clusterSize int16) (Filesystem, error) {
+	options := DefaultFormatOptions()
+	options.ClusterSize = clusterSize
+
+	return NewFilesystemWithOptions(volume, options)
+}
+
+func NewFilesystemFromSuperblock(volume StorageVolume, sb Superblock) Filesystem {
+	return Filesystem{
+		Volume:          volume,
+		Superblock:      sb,
+		RootInodePtr:    sb.RootInodePtr,
+		CurrentInodePtr: sb.RootInodePtr,
+	}
+}
+
+// LoadFilesystem reads superblock from the beginning of the volume and
+// refuses volumes that were not created by compatible version.
+func LoadFilesystem(volume StorageVolume) (Filesystem, error) {
+	sb, err := ReadSuperblock(volume)
 	if err != nil {
 		return Filesystem{}, err
 	}
 
-	metadataSize := VolumePtr(float64(volumeSize) * 0.05) // 5%
-	dataSize := VolumePtr(float64(volumeSize) * 0.95)     // 95%
+	return NewFilesystemFromSuperblock(volume, sb), nil
+}
 
-	sb := NewPreparedSuperblock("janopa", "kiv/zos", volumeSize, clusterSize)
-	sbSize := VolumePtr(unsafe.Sizeof(sb))
+// ReadSuperblock reads superblock from the beginning of the volume and checks
+// its version and checksum
+func ReadSuperblock(volume ReadWriteVolume) (Superblock, error) {
+	return ReadSuperblockAt(volume, 0)
+}
+
+// ReadSuperblockAt reads superblock or its backup from given address
+func ReadSuperblockAt(volume ReadWriteVolume, address VolumePtr) (Superblock, error) {
+	var sb Superblock
+	err := volume.ReadStruct(address, &sb)
+	if err != nil {
+		return Superblock{}, err
+	}
+
+	err = sb.Validate()
+	if err != nil {
+		return Superblock{}, err
+	}
 
-	sb.ClusterCount = ClusterPtr((volumeSize - metadataSize) / VolumePtr(clusterSize))
+	expected, err := sb.computeChecksum()
+	if err != nil {
+		return Superblock{}, err
+	}
+	if sb.Checksum != expected {
+		return Superblock{}, SuperblockChecksumMismatch{}
+	}
 
-	clusterBitmapSize := VolumePtr(math.Ceil(float64(dataSize/VolumePtr(clusterSize)) / 8))
+	return sb, nil
+}
 
-	// Count inode bitmap size and total inodes size
-	inodeSize := VolumePtr(unsafe.Sizeof(Inode{}))
-	totalInodesCount := VolumePtr(float64(metadataSize-sbSize-clusterBitmapSize) / (float64(inodeSize) + 1.0/8)) // Just math
-	inodeBitmapSize := NeededMemoryForBitmap(totalInodesCount)
+func (f *Filesystem) WriteStructureToVolume() error {
+	err := f.Volume.Truncate()
+	if err != nil {
+		return err
+	}
 
-	sb.ClusterBitmapStartAddress = sbSize
-	sb.InodeBitmapStartAddress = sb.ClusterBitmapStartAddress + clusterBitmapSize
-	sb.InodesStartAddress = sb.InodeBitmapStartAddress + inodeBitmapSize
+	// Checksums of empty bitmaps aren't zero
+	err = UpdateBitmapChecksums(f.Volume, f.Superblock)
+	if err != nil {
+		return err
+	}
 
-	sb.DataStartAddress = metadataSize
+	err = OccupyClusters(f.Volume, f.Superblock, BackupSuperblockClusters(f.Superblock))
+	if err != nil {
+		return err
+	}
 
-	return Filesystem{
-		Volume:     volume,
-		Superblock: sb,
-	}, nil
+	err = f.updateFreeClusters()
+	if err != nil {
+		return err
+	}
+
+	return f.WriteSuperblock()
 }
 
-func NewFilesystemFromSuperblock(volume Volume, sb Superblock) Filesystem {
-	return Filesystem{
-		Volume:     volume,
-		Superblock: sb,
+// WriteSuperblock computes checksum of the superblock and writes it to volume
+// together with all its backups
+func (f *Filesystem) WriteSuperblock() error {
+	checksum, err := f.Superblock.computeChecksum()
+	if err != nil {
+		return err
 	}
+	f.Superblock.Checksum = checksum
+
+	for _, address := range append([]VolumePtr{0}, f.Superblock.BackupAddresses()...) {
+		err = f.Volume.WriteStruct(address, f.Superblock)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (f Filesystem) WriteStructureToVolume() error {
-	err := f.Volume.Truncate()
+// Mount marks volume as dirty until Unmount is called, it returns true when
+// the volume wasn't closed cleanly last time. Volume with interrupted resize
+// isn't mounted and keeps its state, so fsck still reports it.
+func (f *Filesystem) Mount() (bool, error) {
+	wasDirty := f.Superblock.State != StateClean
+	if f.Superblock.State == StateResizing {
+		return wasDirty, ResizeInterrupted{}
+	}
+
+	err := f.updateFreeClusters()
+	if err != nil {
+		return wasDirty, err
+	}
+
+	f.Superblock.State = StateDirty
+	f.Superblock.MountCount++
+	f.Superblock.LastMountTime = time.Now().UnixNano()
+	err = f.WriteSuperblock()
+	if err != nil {
+		return wasDirty, err
+	}
+
+	return wasDirty, f.Volume.Sync()
+}
+
+// Unmount marks volume as closed cleanly, volume with unfinished resize
+// stays in StateResizing
+func (f *Filesystem) Unmount() error {
+	if f.Superblock.State == StateResizing {
+		return f.Volume.Sync()
+	}
+
+	err := f.updateFreeClusters()
 	if err != nil {
 		return err
 	}
 
-	err = f.Volume.WriteStruct(0, f.Superblock)
+	f.Superblock.State = StateClean
+	err = f.WriteSuperblock()
 	if err != nil {
 		return err
 	}
 
+	return f.Volume.Sync()
+}
+
+// updateFreeClusters counts free clusters in the cluster bitmap. Damaged
+// bitmap is reported by fsck, the old count is kept until it's repaired.
+func (f *Filesystem) updateFreeClusters() error {
+	freeClusters, err := CountFreeClusters(f.Volume, f.Superblock)
+	if _, ok := err.(BitmapChecksumMismatch); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f.Superblock.FreeClusters = freeClusters
+
 	return nil
 }
 
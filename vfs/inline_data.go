@@ -0,0 +1,48 @@
+package vfs
+
+// InodeFlagInlineData marks inode whose data are stored in InlineData instead
+// of data clusters. Such inode has no allocated clusters, bytes of InlineData
+// behind Size are always zero.
+const InodeFlagInlineData = 2
+
+func (i Inode) HasInlineData() bool {
+	return i.Flags&InodeFlagInlineData != 0
+}
+
+func (i Inode) readInlineData(offset VolumePtr, data []byte) VolumePtr {
+	if offset >= i.Size {
+		return 0
+	}
+
+	return VolumePtr(copy(data, i.InlineData[offset:i.Size]))
+}
+
+func (mi MutableInode) writeInlineData(volume ReadWriteVolume, sb Superblock, offset VolumePtr, data []byte) (VolumePtr, error) {
+	copy(mi.Inode.InlineData[offset:], data)
+	if end := offset + VolumePtr(len(data)); end > mi.Inode.Size {
+		mi.Inode.Size = end
+	}
+
+	mi.Inode.Touch()
+
+	return VolumePtr(len(data)), mi.Save(volume, sb)
+}
+
+// moveInlineDataToClusters switches inode to data clusters, data stored in
+// the inode are written to the first cluster
+func (mi MutableInode) moveInlineDataToClusters(volume ReadWriteVolume, sb Superblock, identity Identity) error {
+	data := make([]byte, mi.Inode.Size)
+	copy(data, mi.Inode.InlineData[:mi.Inode.Size])
+
+	mi.Inode.Flags &^= InodeFlagInlineData
+	mi.Inode.InlineData = [InodeInlineDataSize]byte{}
+	mi.Inode.Size = 0
+
+	if len(data) == 0 {
+		return mi.Save(volume, sb)
+	}
+
+	_, err := mi.WriteData(volume, sb, identity, 0, data)
+
+	return err
+}
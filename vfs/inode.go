@@ -3,6 +3,7 @@ package vfs
 import (
 	"fmt"
 	"math"
+	"time"
 	"unsafe"
 )
 
@@ -20,8 +21,13 @@ const (
 	InodeFileType      = 0
 	InodeDirectoryType = 1
 	InodeRootInodeType = 2
+	InodeSymlinkType   = 3
 )
 
+// InodeInlineDataSize is size of the area in inode used for short symlink
+// targets and data of tiny files and directories
+const InodeInlineDataSize = 60
+
 type Inode struct {
 	Type              byte
 	Size              VolumePtr
@@ -33,27 +39,110 @@ type Inode struct {
 	Direct5           ClusterPtr
 	Indirect1         ClusterPtr
 	Indirect2         ClusterPtr
+	Indirect3         ClusterPtr
+	// Index head cluster of indexed directory, Unused for linear directories
+	DirectoryIndex ClusterPtr
+	// Timestamps in nanoseconds since Unix epoch
+	AccessTime   int64
+	ModifyTime   int64
+	ChangeTime   int64
+	CreationTime int64
+	// Permission bits together with setuid, setgid and sticky bit
+	Mode uint16
+	Uid  uint32
+	Gid  uint32
+	// Number of directory entries pointing to the inode, "." and ".." are
+	// not counted
+	LinkCount uint16
+	// Target of symlink that is not longer than InodeInlineDataSize or data
+	// when InodeFlagInlineData is set, see inline_data.go
+	InlineData [InodeInlineDataSize]byte
+	// Extended attributes, XattrCluster holds those that don't fit inline
+	XattrInline  [InodeXattrInlineSize]byte
+	XattrCluster ClusterPtr
+	Flags        byte
+	// Extent tree used instead of direct and indirect pointers when
+	// InodeFlagExtents is set, see extent.go
+	ExtentDepth byte
+	ExtentCount uint16
+	Extents     [InodeExtentCount]Extent
+	// CRC32C of the inode with zero in this field, it's computed by Save
+	Checksum uint32
 }
 
 func NewInode() Inode {
+	now := time.Now().UnixNano()
+
 	return Inode{
-		Direct1:   Unused,
-		Direct2:   Unused,
-		Direct3:   Unused,
-		Direct4:   Unused,
-		Direct5:   Unused,
-		Indirect1: Unused,
-		Indirect2: Unused,
+		Direct1:        Unused,
+		Direct2:        Unused,
+		Direct3:        Unused,
+		Direct4:        Unused,
+		Direct5:        Unused,
+		Indirect1:      Unused,
+		Indirect2:      Unused,
+		Indirect3:      Unused,
+		DirectoryIndex: Unused,
+		XattrCluster:   Unused,
+		AccessTime:     now,
+		ModifyTime:     now,
+		ChangeTime:     now,
+		CreationTime:   now,
+		Mode:           DefaultFileMode,
+		LinkCount:      1,
+	}
+}
+
+// Touch marks data of the inode as modified, which changes the inode too
+func (i *Inode) Touch() {
+	i.ModifyTime = time.Now().UnixNano()
+	i.ChangeTime = i.ModifyTime
+}
+
+// TouchChange marks only the inode itself (not its data) as changed
+func (i *Inode) TouchChange() {
+	i.ChangeTime = time.Now().UnixNano()
+}
+
+// TouchAccess updates access time only when the data were modified since the
+// last access, so reading doesn't write the inode every time
+func (i *Inode) TouchAccess() bool {
+	if i.AccessTime > i.ModifyTime {
+		return false
 	}
+
+	i.AccessTime = time.Now().UnixNano()
+	return true
 }
 
 func (i Inode) ReadData(volume ReadWriteVolume, sb Superblock, offset VolumePtr, data []byte) (VolumePtr, error) {
+	if i.HasInlineData() {
+		return i.readInlineData(offset, data), nil
+	}
+
 	clusterPtrOffset := ClusterPtr(offset / VolumePtr(sb.ClusterSize))
 	offsetInCluster := offset % VolumePtr(sb.ClusterSize)
 
+	resolve := func(index ClusterPtr) (ClusterPtr, error) {
+		return i.ResolveDataClusterAddress(volume, sb, index)
+	}
+	if i.UsesExtents() {
+		// Load the whole mapping once instead of reading leaf for every cluster
+		extents, err := i.readExtents(volume, sb)
+		if err != nil {
+			return 0, err
+		}
+		resolve = func(index ClusterPtr) (ClusterPtr, error) {
+			if index >= i.AllocatedClusters {
+				return 0, ClusterIndexOutOfRange{index}
+			}
+			return resolveClusterInExtents(extents, index)
+		}
+	}
+
 	dataOffset := VolumePtr(0)
 	for {
-		clusterPtr, err := i.ResolveDataClusterAddress(volume, sb, clusterPtrOffset)
+		clusterPtr, err := resolve(clusterPtrOffset)
 		if err != nil {
 			return dataOffset, err
 		}
@@ -76,10 +165,19 @@ func (i Inode) ReadData(volume ReadWriteVolume, sb Superblock, offset VolumePtr,
 			clusterDataLength = VolumePtr(len(data)) - dataOffset
 		}
 
+		// Hole reads as zeros
 		clusterData := make([]byte, clusterDataLength)
-		err = volume.ReadBytes(ClusterPtrToVolumePtr(sb, clusterPtr)+offsetInCluster, clusterData)
-		if err != nil {
-			return dataOffset, err
+		if clusterPtr != Unused && i.HasClusterChecksums(sb) {
+			verifiedData, err := readVerifiedCluster(volume, sb, clusterPtr)
+			if err != nil {
+				return dataOffset, err
+			}
+			copy(clusterData, verifiedData[offsetInCluster:])
+		} else if clusterPtr != Unused {
+			err = volume.ReadBytes(ClusterPtrToVolumePtr(sb, clusterPtr)+offsetInCluster, clusterData)
+			if err != nil {
+				return dataOffset, err
+			}
 		}
 
 		copy(data[dataOffset:], clusterData)
@@ -101,6 +199,10 @@ func (i Inode) ResolveDataClusterAddress(volume ReadWriteVolume, sb Superblock,
 		return 0, ClusterIndexOutOfRange{index}
 	}
 
+	if i.UsesExtents() {
+		return i.resolveExtentClusterAddress(volume, sb, index)
+	}
+
 	// Resolve direct
 	if index == 0 {
 		return i.Direct1, nil
@@ -126,6 +228,21 @@ func (i Inode) ResolveDataClusterAddress(volume ReadWriteVolume, sb Superblock,
 		}
 		dataClusterPtrs := GetClusterPtrsFromBinary(data)
 		return dataClusterPtrs[indexInIndirect1], nil
+	} else if index >= InodeDirectCount+ptrsPerCluster+ptrsPerCluster*ptrsPerCluster {
+		// Resolve indirect3
+		indexInIndirect3 := VolumePtr(index - (InodeDirectCount + ptrsPerCluster + ptrsPerCluster*ptrsPerCluster))
+
+		doublePtrTablePtr, err := readPtrFromTable(volume, sb, i.Indirect3, indexInIndirect3/VolumePtr(ptrsPerCluster*ptrsPerCluster))
+		if err != nil {
+			return 0, err
+		}
+
+		singlePtrTablePtr, err := readPtrFromTable(volume, sb, doublePtrTablePtr, (indexInIndirect3/VolumePtr(ptrsPerCluster))%VolumePtr(ptrsPerCluster))
+		if err != nil {
+			return 0, err
+		}
+
+		return readPtrFromTable(volume, sb, singlePtrTablePtr, indexInIndirect3%VolumePtr(ptrsPerCluster))
 	} else {
 		// Resolve indirect2
 		indexInIndirect2 := index - (InodeDirectCount + ptrsPerCluster)
@@ -155,20 +272,35 @@ func (i Inode) GetUsedPtrs(volume ReadWriteVolume, sb Superblock) (
 	[]ClusterPtr,
 	map[ClusterPtr][]ClusterPtr,
 	map[ClusterPtr]map[ClusterPtr][]ClusterPtr,
+	map[ClusterPtr]map[ClusterPtr]map[ClusterPtr][]ClusterPtr,
 	error) {
 
+	if i.HasInlineData() {
+		return []ClusterPtr{}, map[ClusterPtr][]ClusterPtr{}, map[ClusterPtr]map[ClusterPtr][]ClusterPtr{}, map[ClusterPtr]map[ClusterPtr]map[ClusterPtr][]ClusterPtr{}, nil
+	}
+
+	if i.UsesExtents() {
+		directPtrs, leafPtrs, err := i.getUsedExtentPtrs(volume, sb)
+		return directPtrs, leafPtrs, map[ClusterPtr]map[ClusterPtr][]ClusterPtr{}, map[ClusterPtr]map[ClusterPtr]map[ClusterPtr][]ClusterPtr{}, err
+	}
+
 	directPtrs := i.GetUsedDirectPtrs()
 	indirect1Ptrs, err := i.GetUsedIndirect1Ptrs(volume, sb)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	indirect2Ptrs, err := i.GetUsedIndirect2Ptrs(volume, sb)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
+	}
+
+	indirect3Ptrs, err := i.GetUsedIndirect3Ptrs(volume, sb)
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
 
-	return directPtrs, indirect1Ptrs, indirect2Ptrs, nil
+	return directPtrs, indirect1Ptrs, indirect2Ptrs, indirect3Ptrs, nil
 }
 
 func (i Inode) GetUsedDirectPtrs() []ClusterPtr {
@@ -200,7 +332,7 @@ func (i Inode) GetUsedIndirect1Ptrs(volume ReadWriteVolume, sb Superblock) (map[
 		return nil, err
 	}
 
-	out[i.Indirect1] = ptrs[:allocatedDataClustersInIndirect1(i, sb)]
+	out[i.Indirect1] = withoutHoles(ptrs[:allocatedDataClustersInIndirect1(i, sb)])
 
 	return out, nil
 }
@@ -229,7 +361,7 @@ func (i Inode) GetUsedIndirect2Ptrs(volume ReadWriteVolume, sb Superblock) (map[
 			return nil, err
 		}
 
-		out[i.Indirect2][doublePtr] = singlePtrs
+		out[i.Indirect2][doublePtr] = withoutHoles(singlePtrs)
 
 		remainingIndirect2DataPtrsCount -= ClusterPtr(len(singlePtrs))
 		if remainingIndirect2DataPtrsCount <= 0 {
@@ -240,6 +372,60 @@ func (i Inode) GetUsedIndirect2Ptrs(volume ReadWriteVolume, sb Superblock) (map[
 	return out, nil
 }
 
+func (i Inode) GetUsedIndirect3Ptrs(volume ReadWriteVolume, sb Superblock) (map[ClusterPtr]map[ClusterPtr]map[ClusterPtr][]ClusterPtr, error) {
+	out := make(map[ClusterPtr]map[ClusterPtr]map[ClusterPtr][]ClusterPtr)
+	if i.Indirect3 == Unused {
+		return out, nil
+	}
+
+	ptrsPerCluster := getPtrsPerCluster(sb)
+	remainingDataPtrsCount := VolumePtr(allocatedDataClustersInIndirect3(i, sb))
+
+	out[i.Indirect3] = make(map[ClusterPtr]map[ClusterPtr][]ClusterPtr)
+	for doubleIndex := VolumePtr(0); remainingDataPtrsCount > 0; doubleIndex++ {
+		doublePtr, err := readPtrFromTable(volume, sb, i.Indirect3, doubleIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		out[i.Indirect3][doublePtr] = make(map[ClusterPtr][]ClusterPtr)
+		for singleIndex := VolumePtr(0); singleIndex < ptrsPerCluster && remainingDataPtrsCount > 0; singleIndex++ {
+			singlePtr, err := readPtrFromTable(volume, sb, doublePtr, singleIndex)
+			if err != nil {
+				return nil, err
+			}
+
+			singlePtrsCount := ptrsPerCluster
+			if singlePtrsCount > remainingDataPtrsCount {
+				singlePtrsCount = remainingDataPtrsCount
+			}
+
+			singlePtrs := make([]ClusterPtr, singlePtrsCount)
+			err = volume.ReadStruct(ClusterPtrToVolumePtr(sb, singlePtr), singlePtrs)
+			if err != nil {
+				return nil, err
+			}
+
+			out[i.Indirect3][doublePtr][singlePtr] = withoutHoles(singlePtrs)
+			remainingDataPtrsCount -= singlePtrsCount
+		}
+	}
+
+	return out, nil
+}
+
+// withoutHoles filters out Unused pointers of holes
+func withoutHoles(ptrs []ClusterPtr) []ClusterPtr {
+	out := make([]ClusterPtr, 0, len(ptrs))
+	for _, ptr := range ptrs {
+		if ptr != Unused {
+			out = append(out, ptr)
+		}
+	}
+
+	return out
+}
+
 func (i Inode) IsFile() bool {
 	return i.Type == InodeFileType
 }
@@ -252,6 +438,10 @@ func (i Inode) IsRootDir() bool {
 	return i.Type == InodeRootInodeType
 }
 
+func (i Inode) IsSymlink() bool {
+	return i.Type == InodeSymlinkType
+}
+
 func GetClusterPtrsFromBinary(p []byte) []ClusterPtr {
 	var cp ClusterPtr
 	clusterPtrSize := int(unsafe.Sizeof(cp))
@@ -277,24 +467,43 @@ type MutableInode struct {
 	InodePtr InodePtr
 }
 
+// LoadMutableInode reads inode and verifies its checksum. Inode is returned
+// together with InodeChecksumMismatch error, so it can be repaired.
 func LoadMutableInode(volume ReadWriteVolume, sb Superblock, inodePtr InodePtr) (MutableInode, error) {
-	inode := Inode{}
-	err := volume.ReadStruct(InodePtrToVolumePtr(sb, inodePtr), &inode)
+	mutableInode := MutableInode{
+		Inode:    &Inode{},
+		InodePtr: inodePtr,
+	}
+
+	err := mutableInode.Reload(volume, sb)
 	if err != nil {
+		if _, ok := err.(InodeChecksumMismatch); ok {
+			return mutableInode, err
+		}
+
 		return MutableInode{}, err
 	}
 
-	return MutableInode{
-		Inode:    &inode,
-		InodePtr: inodePtr,
-	}, nil
+	return mutableInode, nil
 }
 
-func (mi MutableInode) AppendData(volume ReadWriteVolume, sb Superblock, data []byte) (n VolumePtr, err error) {
-	return mi.WriteData(volume, sb, mi.Inode.Size, data)
+func (mi MutableInode) AppendData(volume ReadWriteVolume, sb Superblock, identity Identity, data []byte) (n VolumePtr, err error) {
+	return mi.WriteData(volume, sb, identity, mi.Inode.Size, data)
 }
 
-func (mi MutableInode) WriteData(volume ReadWriteVolume, sb Superblock, offset VolumePtr, data []byte) (n VolumePtr, err error) {
+func (mi MutableInode) WriteData(volume ReadWriteVolume, sb Superblock, identity Identity, offset VolumePtr, data []byte) (n VolumePtr, err error) {
+	if mi.Inode.HasInlineData() {
+		if offset+VolumePtr(len(data)) <= InodeInlineDataSize {
+			return mi.writeInlineData(volume, sb, offset, data)
+		}
+
+		// Data don't fit into the inode anymore
+		err = mi.moveInlineDataToClusters(volume, sb, identity)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	clusterIndex := ClusterPtr(offset / VolumePtr(sb.ClusterSize))
 	indexInCluster := offset % VolumePtr(sb.ClusterSize)
 
@@ -302,14 +511,29 @@ func (mi MutableInode) WriteData(volume ReadWriteVolume, sb Superblock, offset V
 	writableSize := VolumePtr(math.Min(float64(remainingDataLength), float64(VolumePtr(sb.ClusterSize)-indexInCluster)))
 	writtenData := VolumePtr(0)
 	startIndex := VolumePtr(0)
+
+	if offset > mi.Inode.Size {
+		err = mi.zeroTail(volume, sb, offset)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	for {
 		dataToWrite := make([]byte, writableSize)
+		newCluster := false
 		clusterPtr, err := mi.Inode.ResolveDataClusterAddress(volume, sb, clusterIndex)
 		if err != nil {
 			switch err.(type) {
 			case ClusterIndexOutOfRange:
+				// Clusters between the end of data and offset are left as holes
+				err = mi.appendHoles(volume, sb, identity, clusterIndex-mi.Inode.AllocatedClusters)
+				if err != nil {
+					return 0, err
+				}
+
 				// We need to allocate more space
-				_, err = Allocate(mi, volume, sb, VolumePtr(sb.ClusterSize))
+				_, err = Allocate(mi, volume, sb, identity, VolumePtr(sb.ClusterSize))
 				if err != nil {
 					return 0, err
 				}
@@ -317,9 +541,24 @@ func (mi MutableInode) WriteData(volume ReadWriteVolume, sb Superblock, offset V
 				if err != nil {
 					return 0, err
 				}
+				newCluster = true
 			default:
 				return 0, err
 			}
+		} else if clusterPtr == Unused {
+			clusterPtr, err = mi.fillHole(volume, sb, identity, clusterIndex)
+			if err != nil {
+				return 0, err
+			}
+			newCluster = true
+		}
+
+		if newCluster && writableSize < VolumePtr(sb.ClusterSize) {
+			// Rest of the cluster must read as zeros, it may be inside the file
+			err = volume.WriteStruct(ClusterPtrToVolumePtr(sb, clusterPtr), make([]byte, sb.ClusterSize))
+			if err != nil {
+				return 0, err
+			}
 		}
 		copy(dataToWrite, data[startIndex:startIndex+writableSize])
 		err = volume.WriteStruct(ClusterPtrToVolumePtr(sb, clusterPtr)+indexInCluster, dataToWrite)
@@ -327,6 +566,13 @@ func (mi MutableInode) WriteData(volume ReadWriteVolume, sb Superblock, offset V
 			return 0, err
 		}
 
+		if mi.Inode.HasClusterChecksums(sb) {
+			err = updateClusterChecksum(volume, sb, clusterPtr)
+			if err != nil {
+				return 0, err
+			}
+		}
+
 		indexInCluster = 0
 		startIndex += writableSize
 		writtenData += writableSize
@@ -339,6 +585,7 @@ func (mi MutableInode) WriteData(volume ReadWriteVolume, sb Superblock, offset V
 		clusterIndex++
 
 		if remainingDataLength <= 0 {
+			mi.Inode.Touch()
 			err = mi.Save(volume, sb)
 			if err != nil {
 				return writtenData, err
@@ -350,10 +597,43 @@ func (mi MutableInode) WriteData(volume ReadWriteVolume, sb Superblock, offset V
 
 }
 
+// Unlink decrements link count of the inode. True is returned when the last
+// link was removed and the inode with its data should be freed.
+func (mi MutableInode) Unlink(volume ReadWriteVolume, sb Superblock) (bool, error) {
+	if mi.Inode.LinkCount <= 1 {
+		mi.Inode.LinkCount = 0
+		return true, nil
+	}
+
+	mi.Inode.LinkCount--
+	mi.Inode.TouchChange()
+
+	return false, mi.Save(volume, sb)
+}
+
 func (mi MutableInode) Save(volume ReadWriteVolume, sb Superblock) error {
+	checksum, err := mi.Inode.computeChecksum()
+	if err != nil {
+		return err
+	}
+	mi.Inode.Checksum = checksum
+
 	return volume.WriteStruct(InodePtrToVolumePtr(sb, mi.InodePtr), mi.Inode)
 }
 
 func (mi MutableInode) Reload(volume ReadWriteVolume, sb Superblock) error {
-	return volume.ReadStruct(InodePtrToVolumePtr(sb, mi.InodePtr), mi.Inode)
+	err := volume.ReadStruct(InodePtrToVolumePtr(sb, mi.InodePtr), mi.Inode)
+	if err != nil {
+		return err
+	}
+
+	expected, err := mi.Inode.computeChecksum()
+	if err != nil {
+		return err
+	}
+	if mi.Inode.Checksum != expected {
+		return InodeChecksumMismatch{mi.InodePtr}
+	}
+
+	return nil
 }
@@ -0,0 +1,310 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+const (
+	JournalEmpty     = 0
+	JournalCommitted = 1
+)
+
+type JournalFull struct {
+	needed    VolumePtr
+	available VolumePtr
+}
+
+func (j JournalFull) Error() string {
+	return fmt.Sprintf("transaction needs %d bytes of journal, but only %d bytes are available", j.needed, j.available)
+}
+
+type TornJournalRecord struct {
+	Record int32
+}
+
+func (t TornJournalRecord) Error() string {
+	return fmt.Sprintf("journal record %d is incomplete, committed transaction was discarded", t.Record)
+}
+
+type journalHeader struct {
+	State       byte
+	RecordCount int32
+	Length      VolumePtr
+}
+
+type journalRecordHeader struct {
+	VolumePtr VolumePtr
+	Length    int32
+}
+
+type journalRecord struct {
+	volumePtr VolumePtr
+	data      []byte
+}
+
+func (jr journalRecord) end() VolumePtr {
+	return jr.volumePtr + VolumePtr(len(jr.data))
+}
+
+// Transaction buffers all writes in memory until Commit is called. Reads are
+// served from the underlying volume with the buffered writes applied on top,
+// so code running inside the transaction sees its own changes.
+type Transaction struct {
+	volume  ReadWriteVolume
+	sb      Superblock
+	records []journalRecord
+}
+
+func BeginTransaction(volume ReadWriteVolume, sb Superblock) *Transaction {
+	return &Transaction{
+		volume:  volume,
+		sb:      sb,
+		records: make([]journalRecord, 0),
+	}
+}
+
+func (t *Transaction) write(volumePtr VolumePtr, data []byte) {
+	if len(t.records) > 0 {
+		// Merge with the last record if the new write overlaps it or directly follows it
+		last := &t.records[len(t.records)-1]
+		if volumePtr >= last.volumePtr && volumePtr <= last.end() {
+			offset := volumePtr - last.volumePtr
+			if offset+VolumePtr(len(data)) > VolumePtr(len(last.data)) {
+				last.data = append(last.data[:offset], data...)
+			} else {
+				copy(last.data[offset:], data)
+			}
+
+			return
+		}
+	}
+
+	record := journalRecord{
+		volumePtr: volumePtr,
+		data:      make([]byte, len(data)),
+	}
+	copy(record.data, data)
+	t.records = append(t.records, record)
+}
+
+func (t *Transaction) WriteStruct(volumePtr VolumePtr, data interface{}) error {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, data)
+	if err != nil {
+		return err
+	}
+
+	t.write(volumePtr, buf.Bytes())
+
+	return nil
+}
+
+func (t *Transaction) WriteByteAt(volumePtr VolumePtr, data byte) error {
+	t.write(volumePtr, []byte{data})
+
+	return nil
+}
+
+func (t *Transaction) ReadByteAt(volumePtr VolumePtr) (byte, error) {
+	data := make([]byte, 1)
+	err := t.ReadBytes(volumePtr, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return data[0], nil
+}
+
+func (t *Transaction) ReadBytes(volumePtr VolumePtr, data []byte) error {
+	err := t.volume.ReadBytes(volumePtr, data)
+	if err != nil {
+		return err
+	}
+
+	// Apply buffered writes in the order they were made
+	end := volumePtr + VolumePtr(len(data))
+	for _, record := range t.records {
+		if record.end() <= volumePtr || record.volumePtr >= end {
+			continue
+		}
+
+		if record.volumePtr >= volumePtr {
+			copy(data[record.volumePtr-volumePtr:], record.data)
+		} else {
+			copy(data, record.data[volumePtr-record.volumePtr:])
+		}
+	}
+
+	return nil
+}
+
+func (t *Transaction) ReadStruct(volumePtr VolumePtr, data interface{}) error {
+	size := binary.Size(data)
+	if size < 0 {
+		return fmt.Errorf("cannot read %T inside transaction, size is not fixed", data)
+	}
+
+	dataBytes := make([]byte, size)
+	err := t.ReadBytes(volumePtr, dataBytes)
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(bytes.NewReader(dataBytes), binary.LittleEndian, data)
+}
+
+func (t *Transaction) ReadObject(volumePtr VolumePtr, data interface{}) (VolumeObject, error) {
+	err := t.ReadStruct(volumePtr, data)
+	if err != nil {
+		return VolumeObject{}, err
+	}
+
+	return NewVolumeObject(volumePtr, t, data), nil
+}
+
+// Commit writes all buffered records to the journal, marks the journal as
+// committed, applies the records to their final location and finally clears
+// the journal. A crash at any point leaves either the old state or a
+// committed journal that is replayed by ReplayJournal.
+func (t *Transaction) Commit() error {
+	if len(t.records) == 0 {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	for _, record := range t.records {
+		err := binary.Write(buf, binary.LittleEndian, journalRecordHeader{
+			VolumePtr: record.volumePtr,
+			Length:    int32(len(record.data)),
+		})
+		if err != nil {
+			return err
+		}
+
+		buf.Write(record.data)
+	}
+
+	headerSize := VolumePtr(unsafe.Sizeof(journalHeader{}))
+	if headerSize+VolumePtr(buf.Len()) > t.sb.JournalSize {
+		return JournalFull{headerSize + VolumePtr(buf.Len()), t.sb.JournalSize}
+	}
+
+	// Write records and then the header that makes them valid
+	err := t.volume.WriteStruct(t.sb.JournalStartAddress+headerSize, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	err = syncVolume(t.volume)
+	if err != nil {
+		return err
+	}
+
+	err = t.volume.WriteStruct(t.sb.JournalStartAddress, journalHeader{
+		State:       JournalCommitted,
+		RecordCount: int32(len(t.records)),
+		Length:      VolumePtr(buf.Len()),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = syncVolume(t.volume)
+	if err != nil {
+		return err
+	}
+
+	// Checkpoint
+	for _, record := range t.records {
+		err = t.volume.WriteStruct(record.volumePtr, record.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.records = t.records[:0]
+
+	err = syncVolume(t.volume)
+	if err != nil {
+		return err
+	}
+
+	return clearJournal(t.volume, t.sb)
+}
+
+// Rollback throws away all buffered writes, nothing is written to the volume.
+func (t *Transaction) Rollback() {
+	t.records = t.records[:0]
+}
+
+// ReplayJournal applies a committed but not yet checkpointed transaction. It
+// must be called before the filesystem is used after it has been loaded.
+func ReplayJournal(volume ReadWriteVolume, sb Superblock) (bool, error) {
+	if !sb.HasFeature(FeatureJournal) {
+		// Volume was created without journal
+		return false, nil
+	}
+
+	header := journalHeader{}
+	err := volume.ReadStruct(sb.JournalStartAddress, &header)
+	if err != nil {
+		return false, err
+	}
+
+	if header.State != JournalCommitted {
+		return false, nil
+	}
+
+	headerSize := VolumePtr(unsafe.Sizeof(journalHeader{}))
+	if headerSize+header.Length > sb.JournalSize {
+		return false, JournalFull{headerSize + header.Length, sb.JournalSize}
+	}
+
+	recordsBytes := make([]byte, header.Length)
+	err = volume.ReadBytes(sb.JournalStartAddress+headerSize, recordsBytes)
+	if err != nil {
+		return false, err
+	}
+
+	// All records are read before anything is applied, so torn transaction
+	// isn't applied partially
+	records := make([]journalRecord, 0, header.RecordCount)
+	reader := bytes.NewReader(recordsBytes)
+	for i := int32(0); i < header.RecordCount; i++ {
+		recordHeader := journalRecordHeader{}
+		err = binary.Read(reader, binary.LittleEndian, &recordHeader)
+		if err == nil {
+			data := make([]byte, recordHeader.Length)
+			_, err = io.ReadFull(reader, data)
+			records = append(records, journalRecord{recordHeader.VolumePtr, data})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Nothing was applied, the transaction is lost
+			err = clearJournal(volume, sb)
+			if err != nil {
+				return false, err
+			}
+
+			return false, TornJournalRecord{i}
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	for _, record := range records {
+		err = volume.WriteStruct(record.volumePtr, record.data)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, clearJournal(volume, sb)
+}
+
+func clearJournal(volume ReadWriteVolume, sb Superblock) error {
+	return volume.WriteStruct(sb.JournalStartAddress, journalHeader{State: JournalEmpty})
+}
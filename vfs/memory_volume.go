@@ -0,0 +1,154 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type memoryBuffer struct {
+	size VolumePtr
+	data []byte
+}
+
+// MemoryVolume keeps the whole volume in memory. Backing slice grows only up
+// to the highest written address, bytes between the end of the slice and the
+// size of the volume are read as zeros.
+type MemoryVolume struct {
+	buffer     *memoryBuffer
+	endianness binary.ByteOrder
+}
+
+func NewMemoryVolume(size VolumePtr) MemoryVolume {
+	return MemoryVolume{
+		buffer: &memoryBuffer{
+			size: size,
+			data: make([]byte, 0),
+		},
+		endianness: binary.LittleEndian,
+	}
+}
+
+func (mv MemoryVolume) writeBytes(volumePtr VolumePtr, data []byte) {
+	end := volumePtr + VolumePtr(len(data))
+	if end > VolumePtr(len(mv.buffer.data)) {
+		mv.buffer.data = append(mv.buffer.data, make([]byte, end-VolumePtr(len(mv.buffer.data)))...)
+	}
+
+	copy(mv.buffer.data[volumePtr:], data)
+
+	if end > mv.buffer.size {
+		mv.buffer.size = end
+	}
+}
+
+func (mv MemoryVolume) WriteStruct(volumePtr VolumePtr, data interface{}) error {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, mv.endianness, data)
+	if err != nil {
+		return err
+	}
+
+	mv.writeBytes(volumePtr, buf.Bytes())
+
+	return nil
+}
+
+func (mv MemoryVolume) WriteByteAt(volumePtr VolumePtr, data byte) error {
+	mv.writeBytes(volumePtr, []byte{data})
+
+	return nil
+}
+
+func (mv MemoryVolume) ReadByteAt(volumePtr VolumePtr) (byte, error) {
+	data := make([]byte, 1)
+	err := mv.ReadBytes(volumePtr, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return data[0], nil
+}
+
+func (mv MemoryVolume) ReadBytes(volumePtr VolumePtr, data []byte) error {
+	// Behave like a file, reading at the end of volume is an error
+	if volumePtr >= mv.buffer.size {
+		return io.EOF
+	}
+
+	for i := range data {
+		data[i] = 0
+	}
+
+	if volumePtr < VolumePtr(len(mv.buffer.data)) {
+		copy(data, mv.buffer.data[volumePtr:])
+	}
+
+	return nil
+}
+
+func (mv MemoryVolume) ReadStruct(volumePtr VolumePtr, data interface{}) error {
+	size := binary.Size(data)
+	if size < 0 {
+		return fmt.Errorf("cannot read %T from memory volume, size is not fixed", data)
+	}
+
+	dataBytes := make([]byte, size)
+	if volumePtr+VolumePtr(size) > mv.buffer.size {
+		if volumePtr >= mv.buffer.size {
+			return io.EOF
+		}
+
+		return io.ErrUnexpectedEOF
+	}
+
+	err := mv.ReadBytes(volumePtr, dataBytes)
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(bytes.NewReader(dataBytes), mv.endianness, data)
+}
+
+func (mv MemoryVolume) ReadObject(volumePtr VolumePtr, data interface{}) (VolumeObject, error) {
+	err := mv.ReadStruct(volumePtr, data)
+	if err != nil {
+		return VolumeObject{}, err
+	}
+
+	return NewVolumeObject(volumePtr, mv, data), nil
+}
+
+func (mv MemoryVolume) Size() (VolumePtr, error) {
+	return mv.buffer.size, nil
+}
+
+func (mv MemoryVolume) Resize(size VolumePtr) error {
+	mv.buffer.size = size
+
+	return mv.Truncate()
+}
+
+func (mv MemoryVolume) Truncate() error {
+	if VolumePtr(len(mv.buffer.data)) > mv.buffer.size {
+		mv.buffer.data = mv.buffer.data[:mv.buffer.size]
+	}
+
+	return nil
+}
+
+func (mv MemoryVolume) Sync() error {
+	return nil
+}
+
+func (mv MemoryVolume) Close() error {
+	return nil
+}
+
+func (mv MemoryVolume) Destroy() error {
+	mv.buffer.size = 0
+	mv.buffer.data = nil
+
+	return nil
+}
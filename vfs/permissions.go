@@ -0,0 +1,91 @@
+package vfs
+
+import "fmt"
+
+const (
+	ModeSetuid = 04000
+	ModeSetgid = 02000
+	ModeSticky = 01000
+	ModePerm   = 0777
+	// ModeMask contains all bits that can be set by chmod
+	ModeMask = ModeSetuid | ModeSetgid | ModeSticky | ModePerm
+
+	DefaultFileMode      = 0644
+	DefaultDirectoryMode = 0755
+)
+
+const (
+	PermissionRead    = 4
+	PermissionWrite   = 2
+	PermissionExecute = 1
+)
+
+const RootUid = 0
+
+type PermissionDenied struct {
+	Name string
+}
+
+func (p PermissionDenied) Error() string {
+	return fmt.Sprintf("permission denied: %s", p.Name)
+}
+
+// Identity is user on whose behalf filesystem operations are performed
+type Identity struct {
+	Uid uint32
+	Gid uint32
+}
+
+func (id Identity) IsRoot() bool {
+	return id.Uid == RootUid
+}
+
+// CanAccess checks that identity has all given permissions (combination of
+// PermissionRead, PermissionWrite and PermissionExecute). Owner bits are used
+// for owner, group bits for members of the group and other bits for the rest.
+func (i Inode) CanAccess(identity Identity, permissions uint16) bool {
+	if identity.IsRoot() {
+		return true
+	}
+
+	var granted uint16
+	if identity.Uid == i.Uid {
+		granted = (i.Mode >> 6) & 7
+	} else if identity.Gid == i.Gid {
+		granted = (i.Mode >> 3) & 7
+	} else {
+		granted = i.Mode & 7
+	}
+
+	return granted&permissions == permissions
+}
+
+// CanRemoveFrom checks that identity can remove or rename inode in given
+// directory. Sticky directory allows that only to owner of the inode or the
+// directory.
+func (i Inode) CanRemoveFrom(identity Identity, directory Inode) bool {
+	if !directory.CanAccess(identity, PermissionWrite|PermissionExecute) {
+		return false
+	}
+
+	if directory.Mode&ModeSticky == 0 || identity.IsRoot() {
+		return true
+	}
+
+	return identity.Uid == i.Uid || identity.Uid == directory.Uid
+}
+
+// SetOwnership makes identity owner of newly created inode. Group is
+// inherited from parent directory with setgid bit set, such subdirectories
+// get setgid bit too.
+func (i *Inode) SetOwnership(identity Identity, parent Inode) {
+	i.Uid = identity.Uid
+	i.Gid = identity.Gid
+
+	if parent.Mode&ModeSetgid != 0 {
+		i.Gid = parent.Gid
+		if i.IsDir() {
+			i.Mode |= ModeSetgid
+		}
+	}
+}
@@ -0,0 +1,679 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+type VolumeTooSmall struct {
+	Size    VolumePtr
+	MinSize VolumePtr
+}
+
+func (v VolumeTooSmall) Error() string {
+	return fmt.Sprintf("volume of %d bytes is too small, at least %d bytes are needed", v.Size, v.MinSize)
+}
+
+// ResizeInterrupted is returned by Mount when the volume is in StateResizing
+type ResizeInterrupted struct{}
+
+func (r ResizeInterrupted) Error() string {
+	return "resize was interrupted, volume should be restored from a copy"
+}
+
+type VolumeIsReadOnly struct{}
+
+func (v VolumeIsReadOnly) Error() string {
+	return "volume is read-only"
+}
+
+// readOnlyVolume is put in front of volume whose resize failed, so the
+// superblock with the old layout isn't written over moved regions
+type readOnlyVolume struct {
+	StorageVolume
+}
+
+func (r readOnlyVolume) WriteStruct(volumePtr VolumePtr, data interface{}) error {
+	return VolumeIsReadOnly{}
+}
+
+func (r readOnlyVolume) WriteByteAt(volumePtr VolumePtr, data byte) error {
+	return VolumeIsReadOnly{}
+}
+
+func (r readOnlyVolume) Resize(size VolumePtr) error {
+	return VolumeIsReadOnly{}
+}
+
+func (r readOnlyVolume) Truncate() error {
+	return VolumeIsReadOnly{}
+}
+
+func (r readOnlyVolume) Destroy() error {
+	return VolumeIsReadOnly{}
+}
+
+// resizeChunkSize is number of bytes copied at once while regions are moved
+const resizeChunkSize = 64 * 1024
+
+// Resize grows or shrinks volume with the filesystem. Number of inodes and
+// size of journal don't change, only number of data clusters does. Cluster
+// bitmap and checksum table change their size, so inode bitmap, inode table,
+// journal, checksum table and data clusters are moved. Cluster and inode
+// pointers are relative to start of their regions, so they stay valid. Used
+// clusters behind the end of shrunk volume are moved to free clusters in
+// front of it first.
+//
+// Nothing of that goes through the journal, regions are too large for it.
+// A moved cluster is freed only after its inode points to the new copy, so
+// crash during relocation leaves at most orphaned clusters. Crash while the
+// regions are moved leaves volume that can't be repaired, so superblock is in
+// StateResizing until the resize finishes and fsck reports it. When moving of
+// regions fails, the volume becomes read-only and keeps StateResizing.
+func Resize(fs *Filesystem, newSize VolumePtr) error {
+	sb := fs.Superblock
+	oldSize, err := fs.Volume.Size()
+	if err != nil {
+		return err
+	}
+
+	// Inode bitmap, inodes and journal
+	fixedRegionSize := sb.ChecksumsStartAddress - sb.InodeBitmapStartAddress
+	inodeBitmapSize := sb.InodesStartAddress - sb.InodeBitmapStartAddress
+
+	newClusterCount := clusterCountForSize(sb, newSize, fixedRegionSize, inodeBitmapSize)
+
+	// State of the volume is restored when the new superblock is written
+	newSb := sb
+	newSb.DiskSize = newSize
+	newSb.ClusterCount = newClusterCount
+	newSb.ReservedClusters = ClusterPtr(VolumePtr(sb.ReservedClusters) * VolumePtr(newClusterCount) / VolumePtr(sb.ClusterCount))
+	newSb.InodeBitmapStartAddress = sb.ClusterBitmapStartAddress + NeededMemoryForBitmap(VolumePtr(newClusterCount))
+	shift := newSb.InodeBitmapStartAddress - sb.InodeBitmapStartAddress
+	newSb.InodesStartAddress += shift
+	newSb.JournalStartAddress += shift
+	newSb.ChecksumsStartAddress += shift
+	newSb.DataStartAddress = newSb.ChecksumsStartAddress + checksumTableSize(
+		newClusterCount,
+		newSb.InodeBitmapStartAddress-newSb.ClusterBitmapStartAddress,
+		inodeBitmapSize,
+	)
+	newBackupClusters := BackupSuperblockClusters(newSb)
+
+	limit := ClusterPtr(math.Min(float64(sb.ClusterCount), float64(newClusterCount)))
+	neededClusters, err := resizeNeededClusters(fs.Volume, sb, newSb, limit)
+	if err != nil {
+		return err
+	}
+	if newClusterCount < 1 || neededClusters > limit {
+		if newClusterCount > sb.ClusterCount {
+			// Grown volume gets its space only after relocation
+			return NoFreeClusterAvailableError{}
+		}
+
+		minClusters := ClusterPtr(math.Max(float64(neededClusters), 1))
+		return VolumeTooSmall{
+			Size:    newSize,
+			MinSize: sizeForClusterCount(sb, minClusters, fixedRegionSize, inodeBitmapSize),
+		}
+	}
+
+	fs.Superblock.State = StateResizing
+	err = fs.WriteSuperblock()
+	if err != nil {
+		return err
+	}
+	err = fs.Volume.Sync()
+	if err != nil {
+		return err
+	}
+
+	// Nothing is moved until here, so the old layout stays valid when
+	// relocation fails
+	vacated, err := vacateClusters(fs.Volume, sb, fs.Identity, newBackupClusters, limit)
+	if err == nil && newSize > oldSize {
+		err = fs.Volume.Resize(newSize)
+	}
+	if err != nil {
+		abortResize(fs, sb, vacated)
+		return err
+	}
+
+	err = moveRegions(fs.Volume, sb, newSb, newBackupClusters)
+	if err == nil {
+		// Clusters were added or cut off together with their bits
+		fs.Superblock = newSb
+		err = fs.updateFreeClusters()
+	}
+	if err == nil {
+		err = fs.WriteSuperblock()
+	}
+	if err != nil {
+		// Superblock with the old layout mustn't be written over partly
+		// moved regions, so it stays in StateResizing
+		fs.Volume = readOnlyVolume{fs.Volume}
+		return err
+	}
+
+	if newSize < oldSize {
+		return fs.Volume.Resize(newSize)
+	}
+
+	return nil
+}
+
+// resizeNeededClusters returns number of clusters in front of limit that are
+// used while clusters are relocated. Old backup superblock stays occupied
+// until regions are moved and clusters of the new one can't hold data.
+func resizeNeededClusters(volume ReadWriteVolume, sb, newSb Superblock, limit ClusterPtr) (ClusterPtr, error) {
+	freeClusters, err := CountFreeClusters(volume, sb)
+	if err != nil {
+		return 0, err
+	}
+	neededClusters := sb.ClusterCount - freeClusters
+
+	oldBackup := make(map[ClusterPtr]bool)
+	for _, ptr := range BackupSuperblockClusters(sb) {
+		oldBackup[ptr] = true
+		if ptr >= limit {
+			neededClusters--
+		}
+	}
+	for _, ptr := range BackupSuperblockClusters(newSb) {
+		if ptr < limit && !oldBackup[ptr] {
+			neededClusters++
+		}
+	}
+
+	return neededClusters, nil
+}
+
+// vacateClusters occupies clusters of the new backup superblock and moves
+// used clusters behind limit and used clusters of the backup in front of
+// limit. Returned clusters of the backup aren't used by any inode, they are
+// returned even with error.
+func vacateClusters(volume ReadWriteVolume, sb Superblock, identity Identity, newBackupClusters []ClusterPtr, limit ClusterPtr) ([]ClusterPtr, error) {
+	vacated := make([]ClusterPtr, 0)
+	reserved := make(map[ClusterPtr]bool)
+	for _, ptr := range newBackupClusters {
+		if ptr >= sb.ClusterCount {
+			continue
+		}
+
+		isFree, err := IsClusterFree(volume, sb, ptr)
+		if err != nil {
+			return vacated, err
+		}
+		if isFree {
+			err = OccupyCluster(volume, sb, ptr)
+			if err != nil {
+				return vacated, err
+			}
+			vacated = append(vacated, ptr)
+		}
+		reserved[ptr] = true
+	}
+
+	relocated, err := relocateClusters(volume, sb, identity, limit, reserved)
+
+	return append(vacated, relocated...), err
+}
+
+// abortResize frees clusters reserved for the new backup superblock and
+// restores state of the volume. Errors are ignored, superblock that can't be
+// written stays in StateResizing.
+func abortResize(fs *Filesystem, sb Superblock, vacated []ClusterPtr) {
+	for _, ptr := range vacated {
+		_ = FreeCluster(fs.Volume, sb, ptr)
+	}
+
+	fs.Superblock.State = sb.State
+	_ = fs.WriteSuperblock()
+}
+
+// moveRegions moves regions of the volume to places described by newSb,
+// volume has to be large enough for both layouts
+func moveRegions(volume StorageVolume, sb, newSb Superblock, newBackupClusters []ClusterPtr) error {
+	fixedRegionSize := sb.ChecksumsStartAddress - sb.InodeBitmapStartAddress
+	shift := newSb.InodeBitmapStartAddress - sb.InodeBitmapStartAddress
+
+	var err error
+	if newSb.ClusterCount > sb.ClusterCount {
+		// Later regions are moved first, so they aren't overwritten
+		err = moveRegion(volume, sb.DataStartAddress, newSb.DataStartAddress, VolumePtr(sb.ClusterCount)*VolumePtr(sb.ClusterSize))
+		if err != nil {
+			return err
+		}
+
+		err = moveRegion(volume, sb.ChecksumsStartAddress, newSb.ChecksumsStartAddress, checksumSize*VolumePtr(sb.ClusterCount))
+		if err != nil {
+			return err
+		}
+
+		err = moveRegion(volume, sb.InodeBitmapStartAddress, newSb.InodeBitmapStartAddress, fixedRegionSize)
+		if err != nil {
+			return err
+		}
+
+		// New part of cluster bitmap, all new clusters are free
+		err = zeroRegion(volume, sb.InodeBitmapStartAddress, shift)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = moveRegion(volume, sb.InodeBitmapStartAddress, newSb.InodeBitmapStartAddress, fixedRegionSize)
+		if err != nil {
+			return err
+		}
+
+		err = moveRegion(volume, sb.ChecksumsStartAddress, newSb.ChecksumsStartAddress, checksumSize*VolumePtr(newSb.ClusterCount))
+		if err != nil {
+			return err
+		}
+
+		err = moveRegion(volume, sb.DataStartAddress, newSb.DataStartAddress, VolumePtr(newSb.ClusterCount)*VolumePtr(newSb.ClusterSize))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Blocks of cluster bitmap changed and checksums of bitmaps moved
+	err = UpdateBitmapChecksums(volume, newSb)
+	if err != nil {
+		return err
+	}
+
+	// Old backup superblock stayed occupied until now, so relocation couldn't
+	// use its clusters
+	newBackup := make(map[ClusterPtr]bool)
+	for _, ptr := range newBackupClusters {
+		newBackup[ptr] = true
+	}
+	for _, ptr := range BackupSuperblockClusters(sb) {
+		if ptr < newSb.ClusterCount && !newBackup[ptr] {
+			err = FreeCluster(volume, newSb, ptr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = OccupyClusters(volume, newSb, newBackupClusters)
+	if err != nil {
+		return err
+	}
+
+	if newSb.JournalSize > 0 {
+		// Journal is empty between transactions, only its header matters
+		return clearJournal(volume, newSb)
+	}
+
+	return nil
+}
+
+// sizeForClusterCount returns size of volume with given number of clusters
+func sizeForClusterCount(sb Superblock, count ClusterPtr, fixedRegionSize, inodeBitmapSize VolumePtr) VolumePtr {
+	clusterBitmapSize := NeededMemoryForBitmap(VolumePtr(count))
+
+	return sb.ClusterBitmapStartAddress + clusterBitmapSize + fixedRegionSize +
+		checksumTableSize(count, clusterBitmapSize, inodeBitmapSize) + VolumePtr(count)*VolumePtr(sb.ClusterSize)
+}
+
+// clusterCountForSize returns the highest number of clusters that fit into
+// volume together with their bitmap, checksums and fixed size metadata
+func clusterCountForSize(sb Superblock, size VolumePtr, fixedRegionSize, inodeBitmapSize VolumePtr) ClusterPtr {
+	if size <= sizeForClusterCount(sb, 0, fixedRegionSize, inodeBitmapSize) {
+		return 0
+	}
+
+	// Every cluster needs a bit in bitmap and a checksum
+	clusterSize := VolumePtr(sb.ClusterSize)
+	count := (size - sb.ClusterBitmapStartAddress - fixedRegionSize) * 8 / (8*clusterSize + 1 + 8*checksumSize)
+	if count > math.MaxInt32 {
+		count = math.MaxInt32
+	}
+	for count > 0 && sizeForClusterCount(sb, ClusterPtr(count), fixedRegionSize, inodeBitmapSize) > size {
+		count--
+	}
+	for count < math.MaxInt32 && sizeForClusterCount(sb, ClusterPtr(count+1), fixedRegionSize, inodeBitmapSize) <= size {
+		count++
+	}
+
+	return ClusterPtr(count)
+}
+
+// moveRegion copies length bytes from one address to another, regions may
+// overlap
+func moveRegion(volume ReadWriteVolume, from, to, length VolumePtr) error {
+	if from == to {
+		return nil
+	}
+
+	chunk := make([]byte, resizeChunkSize)
+	for done := VolumePtr(0); done < length; {
+		n := VolumePtr(math.Min(float64(length-done), resizeChunkSize))
+
+		// Moving towards the end starts from the end
+		offset := done
+		if to > from {
+			offset = length - done - n
+		}
+
+		err := volume.ReadBytes(from+offset, chunk[:n])
+		if err != nil {
+			return err
+		}
+
+		err = volume.WriteStruct(to+offset, chunk[:n])
+		if err != nil {
+			return err
+		}
+
+		done += n
+	}
+
+	return nil
+}
+
+func zeroRegion(volume ReadWriteVolume, from, length VolumePtr) error {
+	zeros := make([]byte, resizeChunkSize)
+	for done := VolumePtr(0); done < length; {
+		n := VolumePtr(math.Min(float64(length-done), resizeChunkSize))
+
+		err := volume.WriteStruct(from+done, zeros[:n])
+		if err != nil {
+			return err
+		}
+
+		done += n
+	}
+
+	return nil
+}
+
+// relocateClusters moves all used clusters with pointer equal or greater than
+// limit and reserved clusters to free clusters in front of limit. Reserved
+// clusters that were vacated are returned.
+func relocateClusters(volume ReadWriteVolume, sb Superblock, identity Identity, limit ClusterPtr, reserved map[ClusterPtr]bool) ([]ClusterPtr, error) {
+	r := relocator{
+		volume:   volume,
+		sb:       sb,
+		identity: identity,
+		limit:    limit,
+		reserved: reserved,
+	}
+
+	for inodePtr := InodePtr(0); InodePtrToVolumePtr(sb, inodePtr+1) <= inodesEndAddress(sb); inodePtr++ {
+		isFree, err := IsInodeFree(volume, sb, inodePtr)
+		if err != nil {
+			return r.vacated, err
+		}
+		if isFree {
+			continue
+		}
+
+		mutableInode, err := LoadMutableInode(volume, sb, inodePtr)
+		if err != nil {
+			return r.vacated, err
+		}
+
+		err = r.relocateInode(mutableInode)
+		if err != nil {
+			return r.vacated, err
+		}
+	}
+
+	return r.vacated, nil
+}
+
+type relocator struct {
+	volume   ReadWriteVolume
+	sb       Superblock
+	identity Identity
+	limit    ClusterPtr
+	// Clusters in front of limit that have to be vacated too
+	reserved map[ClusterPtr]bool
+	// Old clusters are freed after the inode no longer points to them
+	moved []ClusterPtr
+	// Reserved clusters that no inode points to anymore
+	vacated []ClusterPtr
+}
+
+func (r *relocator) relocateInode(mutableInode MutableInode) error {
+	inode := mutableInode.Inode
+
+	var err error
+	switch {
+	case inode.HasInlineData():
+		// Data are in the inode
+	case inode.UsesExtents():
+		err = r.relocateExtents(inode)
+	default:
+		err = r.relocatePtrs(inode)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = r.relocate(&inode.XattrCluster)
+	if err != nil {
+		return err
+	}
+
+	if len(r.moved) > 0 {
+		err = mutableInode.Save(r.volume, r.sb)
+		if err != nil {
+			return err
+		}
+
+		for _, ptr := range r.moved {
+			// Reserved clusters stay occupied, so they aren't given to
+			// another inode before backup superblock is written there
+			if r.reserved[ptr] {
+				r.vacated = append(r.vacated, ptr)
+				continue
+			}
+
+			err = FreeCluster(r.volume, r.sb, ptr)
+			if err != nil {
+				return err
+			}
+		}
+		r.moved = r.moved[:0]
+	}
+
+	// Index nodes point to each other, building the index again is simpler
+	// than fixing the pointers
+	indexPtrs, err := inode.GetDirectoryIndexPtrs(r.volume, r.sb)
+	if err != nil {
+		return err
+	}
+	for _, indexPtr := range indexPtrs {
+		if r.mustMove(indexPtr) {
+			err = freeDirectoryIndex(inode, r.volume, r.sb)
+			if err != nil {
+				return err
+			}
+			err = r.occupyReserved(indexPtrs)
+			if err != nil {
+				return err
+			}
+
+			return buildDirectoryIndex(r.volume, r.sb, r.identity, mutableInode)
+		}
+	}
+
+	return nil
+}
+
+// occupyReserved marks reserved clusters among ptrs as used again after they
+// were freed together with the other ones
+func (r *relocator) occupyReserved(ptrs []ClusterPtr) error {
+	for _, ptr := range ptrs {
+		if r.reserved[ptr] {
+			err := OccupyCluster(r.volume, r.sb, ptr)
+			if err != nil {
+				return err
+			}
+			r.vacated = append(r.vacated, ptr)
+		}
+	}
+
+	return nil
+}
+
+func (r *relocator) mustMove(ptr ClusterPtr) bool {
+	return ptr >= r.limit || r.reserved[ptr]
+}
+
+// relocate moves content of cluster to free cluster when the cluster is
+// behind limit or reserved and updates ptr
+func (r *relocator) relocate(ptr *ClusterPtr) error {
+	if !r.mustMove(*ptr) {
+		return nil
+	}
+
+	clusterObjects, err := FindFreeClusters(r.volume, r.sb, r.identity, 1, true)
+	if err != nil {
+		return err
+	}
+	newPtr := VolumePtrToClusterPtr(r.sb, clusterObjects[0].VolumePtr)
+	if r.reserved[newPtr] {
+		return errors.New("reserved cluster is marked as free")
+	}
+	if newPtr >= r.limit {
+		return errors.New("no free cluster is available in front of the new end of volume")
+	}
+
+	data := make([]byte, r.sb.ClusterSize)
+	err = r.volume.ReadBytes(ClusterPtrToVolumePtr(r.sb, *ptr), data)
+	if err != nil {
+		return err
+	}
+
+	err = r.volume.WriteStruct(ClusterPtrToVolumePtr(r.sb, newPtr), data)
+	if err != nil {
+		return err
+	}
+
+	err = copyClusterChecksum(r.volume, r.sb, *ptr, newPtr)
+	if err != nil {
+		return err
+	}
+
+	r.moved = append(r.moved, *ptr)
+	*ptr = newPtr
+
+	return nil
+}
+
+func (r *relocator) relocatePtrs(inode *Inode) error {
+	remaining := VolumePtr(inode.AllocatedClusters)
+
+	ptrs := []*ClusterPtr{&inode.Direct1, &inode.Direct2, &inode.Direct3, &inode.Direct4, &inode.Direct5}
+	for _, ptr := range ptrs {
+		err := r.relocateTree(ptr, 0, &remaining)
+		if err != nil {
+			return err
+		}
+	}
+
+	tables := []*ClusterPtr{&inode.Indirect1, &inode.Indirect2, &inode.Indirect3}
+	for depth, ptr := range tables {
+		err := r.relocateTree(ptr, depth+1, &remaining)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// relocateTree relocates data cluster (depth 0) or pointer table together with
+// clusters it points to. Remaining is number of data pointers that weren't
+// visited yet, entries behind them aren't valid.
+func (r *relocator) relocateTree(ptr *ClusterPtr, depth int, remaining *VolumePtr) error {
+	if depth == 0 {
+		if *remaining <= 0 {
+			return nil
+		}
+		*remaining--
+
+		return r.relocate(ptr)
+	}
+
+	if *ptr == Unused {
+		return nil
+	}
+
+	err := r.relocate(ptr)
+	if err != nil {
+		return err
+	}
+
+	table := make([]ClusterPtr, getPtrsPerCluster(r.sb))
+	err = r.volume.ReadStruct(ClusterPtrToVolumePtr(r.sb, *ptr), table)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for j := range table {
+		if *remaining <= 0 {
+			break
+		}
+
+		oldPtr := table[j]
+		err = r.relocateTree(&table[j], depth-1, remaining)
+		if err != nil {
+			return err
+		}
+		changed = changed || table[j] != oldPtr
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return r.volume.WriteStruct(ClusterPtrToVolumePtr(r.sb, *ptr), table)
+}
+
+func (r *relocator) relocateExtents(inode *Inode) error {
+	if inode.ExtentDepth > 0 {
+		for j := range inode.Extents[:inode.ExtentCount] {
+			err := r.relocate(&inode.Extents[j].Start)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	extents, err := inode.readExtents(r.volume, r.sb)
+	if err != nil {
+		return err
+	}
+
+	relocated := make([]Extent, 0, len(extents))
+	moved := false
+	for _, extent := range extents {
+		for k := ClusterPtr(0); k < extent.Length; k++ {
+			ptr := extent.Start + k
+			if r.mustMove(ptr) {
+				err = r.relocate(&ptr)
+				if err != nil {
+					return err
+				}
+				moved = true
+			}
+
+			relocated = insertClusterIntoExtents(relocated, extent.Logical+k, ptr)
+		}
+	}
+
+	if !moved {
+		return nil
+	}
+
+	return inode.writeExtents(r.volume, r.sb, r.identity, relocated)
+}
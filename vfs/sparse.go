@@ -0,0 +1,251 @@
+package vfs
+
+// Holes are clusters inside the mapping of the inode that have no data
+// cluster. Pointer mapped inodes store Unused in place of the data cluster
+// pointer (pointer tables are still allocated), extent mapped inodes simply
+// have no extent covering the cluster. Holes read as zeros.
+
+type Hole struct {
+	Logical ClusterPtr
+	Length  ClusterPtr
+}
+
+// appendHoles extends mapping of the inode by count clusters without data
+func (mi MutableInode) appendHoles(volume ReadWriteVolume, sb Superblock, identity Identity, count ClusterPtr) error {
+	if count <= 0 {
+		return nil
+	}
+
+	if mi.Inode.UsesExtents() {
+		mi.Inode.AllocatedClusters += count
+		return mi.Save(volume, sb)
+	}
+
+	allocatedClusters := VolumePtr(mi.Inode.AllocatedClusters) + VolumePtr(count)
+	if allocatedClusters > maxFileClusters(sb) {
+		return FileTooLarge{
+			Size:    allocatedClusters * VolumePtr(sb.ClusterSize),
+			MaxSize: maxFileClusters(sb) * VolumePtr(sb.ClusterSize),
+		}
+	}
+
+	// Pointer tables are modified many times, keep them in memory
+	cachedVolume := NewCachedVolume(volume)
+	var err error
+	for j := ClusterPtr(0); j < count && err == nil; j++ {
+		err = appendDataClusterPtr(mi.Inode, cachedVolume, sb, identity, Unused)
+	}
+	flushErr := cachedVolume.Flush()
+	if err != nil {
+		return err
+	}
+	if flushErr != nil {
+		return flushErr
+	}
+
+	return mi.Save(volume, sb)
+}
+
+// fillHole allocates data cluster for hole at index of the mapping
+func (mi MutableInode) fillHole(volume ReadWriteVolume, sb Superblock, identity Identity, index ClusterPtr) (ClusterPtr, error) {
+	clusterObjects, err := FindFreeClusters(volume, sb, identity, 1, true)
+	if err != nil {
+		return 0, err
+	}
+	clusterPtr := VolumePtrToClusterPtr(sb, clusterObjects[0].VolumePtr)
+
+	if mi.Inode.UsesExtents() {
+		extents, err := mi.Inode.readExtents(volume, sb)
+		if err != nil {
+			return 0, err
+		}
+
+		err = mi.Inode.writeExtents(volume, sb, identity, insertClusterIntoExtents(extents, index, clusterPtr))
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		err = setDataClusterPtr(mi.Inode, volume, sb, index, clusterPtr)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return clusterPtr, mi.Save(volume, sb)
+}
+
+// zeroTail clears stale bytes between the end of data and offset in the last
+// cluster of the file, so they read as zeros after writing past the end
+func (mi MutableInode) zeroTail(volume ReadWriteVolume, sb Superblock, offset VolumePtr) error {
+	indexInCluster := mi.Inode.Size % VolumePtr(sb.ClusterSize)
+	if indexInCluster == 0 {
+		return nil
+	}
+
+	clusterIndex := ClusterPtr(mi.Inode.Size / VolumePtr(sb.ClusterSize))
+	clusterPtr, err := mi.Inode.ResolveDataClusterAddress(volume, sb, clusterIndex)
+	if err != nil {
+		switch err.(type) {
+		case ClusterIndexOutOfRange:
+			return nil
+		default:
+			return err
+		}
+	}
+	if clusterPtr == Unused {
+		return nil
+	}
+
+	end := VolumePtr(clusterIndex+1) * VolumePtr(sb.ClusterSize)
+	if offset < end {
+		end = offset
+	}
+
+	err = volume.WriteStruct(ClusterPtrToVolumePtr(sb, clusterPtr)+indexInCluster, make([]byte, end-mi.Inode.Size))
+	if err != nil {
+		return err
+	}
+
+	if mi.Inode.HasClusterChecksums(sb) {
+		return updateClusterChecksum(volume, sb, clusterPtr)
+	}
+
+	return nil
+}
+
+// appendDataClusterPtr adds ptr to the end of pointer mapping, pointer tables
+// are allocated when ptr is the first one stored in them
+func appendDataClusterPtr(inode *Inode, volume ReadWriteVolume, sb Superblock, identity Identity, ptr ClusterPtr) error {
+	ptrsPerCluster := getPtrsPerCluster(sb)
+	index := VolumePtr(inode.AllocatedClusters)
+
+	var err error
+	if index >= InodeDirectCount && index < InodeDirectCount+ptrsPerCluster {
+		if inode.Indirect1 == Unused {
+			inode.Indirect1, err = newPtrTable(volume, sb, identity)
+		}
+	} else if index >= InodeDirectCount+ptrsPerCluster && index < InodeDirectCount+ptrsPerCluster+ptrsPerCluster*ptrsPerCluster {
+		indexInIndirect2 := index - (InodeDirectCount + ptrsPerCluster)
+
+		if inode.Indirect2 == Unused {
+			inode.Indirect2, err = newPtrTable(volume, sb, identity)
+		}
+		if err == nil && indexInIndirect2%ptrsPerCluster == 0 {
+			_, err = getOrAllocatePtrTable(volume, sb, identity, inode.Indirect2, indexInIndirect2/ptrsPerCluster, true)
+		}
+	} else if index >= InodeDirectCount+ptrsPerCluster+ptrsPerCluster*ptrsPerCluster {
+		indexInIndirect3 := index - (InodeDirectCount + ptrsPerCluster + ptrsPerCluster*ptrsPerCluster)
+
+		if inode.Indirect3 == Unused {
+			inode.Indirect3, err = newPtrTable(volume, sb, identity)
+		}
+
+		var doublePtrTablePtr ClusterPtr
+		if err == nil {
+			doublePtrTablePtr, err = getOrAllocatePtrTable(volume, sb, identity, inode.Indirect3, indexInIndirect3/(ptrsPerCluster*ptrsPerCluster), indexInIndirect3%(ptrsPerCluster*ptrsPerCluster) == 0)
+		}
+		if err == nil && indexInIndirect3%ptrsPerCluster == 0 {
+			_, err = getOrAllocatePtrTable(volume, sb, identity, doublePtrTablePtr, (indexInIndirect3/ptrsPerCluster)%ptrsPerCluster, true)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	inode.AllocatedClusters++
+
+	return setDataClusterPtr(inode, volume, sb, ClusterPtr(index), ptr)
+}
+
+// setDataClusterPtr replaces pointer to data cluster at index of the mapping,
+// all pointer tables on the way must already exist
+func setDataClusterPtr(inode *Inode, volume ReadWriteVolume, sb Superblock, index ClusterPtr, ptr ClusterPtr) error {
+	ptrsPerCluster := getPtrsPerCluster(sb)
+	i := VolumePtr(index)
+
+	if i < InodeDirectCount {
+		directPtrs := []*ClusterPtr{
+			&inode.Direct1,
+			&inode.Direct2,
+			&inode.Direct3,
+			&inode.Direct4,
+			&inode.Direct5,
+		}
+		*directPtrs[i] = ptr
+
+		return nil
+	}
+
+	if i < InodeDirectCount+ptrsPerCluster {
+		return writePtrToTable(volume, sb, inode.Indirect1, i-InodeDirectCount, ptr)
+	}
+
+	if i < InodeDirectCount+ptrsPerCluster+ptrsPerCluster*ptrsPerCluster {
+		indexInIndirect2 := i - (InodeDirectCount + ptrsPerCluster)
+
+		singlePtrTablePtr, err := readPtrFromTable(volume, sb, inode.Indirect2, indexInIndirect2/ptrsPerCluster)
+		if err != nil {
+			return err
+		}
+
+		return writePtrToTable(volume, sb, singlePtrTablePtr, indexInIndirect2%ptrsPerCluster, ptr)
+	}
+
+	indexInIndirect3 := i - (InodeDirectCount + ptrsPerCluster + ptrsPerCluster*ptrsPerCluster)
+
+	doublePtrTablePtr, err := readPtrFromTable(volume, sb, inode.Indirect3, indexInIndirect3/(ptrsPerCluster*ptrsPerCluster))
+	if err != nil {
+		return err
+	}
+
+	singlePtrTablePtr, err := readPtrFromTable(volume, sb, doublePtrTablePtr, (indexInIndirect3/ptrsPerCluster)%ptrsPerCluster)
+	if err != nil {
+		return err
+	}
+
+	return writePtrToTable(volume, sb, singlePtrTablePtr, indexInIndirect3%ptrsPerCluster, ptr)
+}
+
+// GetHoles returns runs of clusters inside the mapping that have no data
+func (i Inode) GetHoles(volume ReadWriteVolume, sb Superblock) ([]Hole, error) {
+	holes := make([]Hole, 0)
+
+	if i.UsesExtents() {
+		extents, err := i.readExtents(volume, sb)
+		if err != nil {
+			return nil, err
+		}
+
+		logical := ClusterPtr(0)
+		for _, extent := range extents {
+			if extent.Logical > logical {
+				holes = append(holes, Hole{Logical: logical, Length: extent.Logical - logical})
+			}
+			logical = extent.end()
+		}
+		if i.AllocatedClusters > logical {
+			holes = append(holes, Hole{Logical: logical, Length: i.AllocatedClusters - logical})
+		}
+
+		return holes, nil
+	}
+
+	for index := ClusterPtr(0); index < i.AllocatedClusters; index++ {
+		clusterPtr, err := i.ResolveDataClusterAddress(volume, sb, index)
+		if err != nil {
+			return nil, err
+		}
+
+		if clusterPtr != Unused {
+			continue
+		}
+
+		if len(holes) > 0 && holes[len(holes)-1].Logical+holes[len(holes)-1].Length == index {
+			holes[len(holes)-1].Length++
+		} else {
+			holes = append(holes, Hole{Logical: index, Length: 1})
+		}
+	}
+
+	return holes, nil
+}
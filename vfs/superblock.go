@@ -1,5 +1,75 @@
 package vfs
 
+import "fmt"
+
+const (
+	SuperblockMagic = 0x5a4f534b // "KSOZ"
+	// FormatVersion is increased every time the on-disk layout changes
+	FormatVersion = 15
+	// MinFormatVersion is the oldest on-disk layout that can be upgraded by
+	// UpgradeFilesystem
+	MinFormatVersion = 1
+)
+
+// Feature flags describe optional parts of the on-disk format. Volume with
+// a flag that isn't listed in SupportedFeatures can't be loaded.
+const (
+	FeatureJournal = 1 << iota
+	FeatureLongNames
+	FeatureIndexedDirectories
+	// New inodes map their data by extents
+	FeatureExtents
+	// Tiny files and directories are stored in the inode
+	FeatureInlineData
+	// Data clusters of files have checksums, not only those of directories
+	FeatureDataChecksums
+)
+
+const SupportedFeatures = FeatureJournal | FeatureLongNames | FeatureIndexedDirectories | FeatureExtents |
+	FeatureInlineData | FeatureDataChecksums
+
+// Volume is dirty while it's in use, so volume that wasn't closed cleanly can
+// be recognized
+const (
+	StateClean = iota
+	StateDirty
+	// Regions of the volume are being moved by Resize, they can't be trusted
+	// when the resize doesn't finish
+	StateResizing
+)
+
+type UnknownVolumeFormat struct{}
+
+func (u UnknownVolumeFormat) Error() string {
+	return "volume doesn't contain known filesystem"
+}
+
+type UnsupportedFormatVersion struct {
+	Version uint16
+}
+
+func (u UnsupportedFormatVersion) Error() string {
+	return fmt.Sprintf("format version %d is not supported, supported versions are %d-%d", u.Version, MinFormatVersion, FormatVersion)
+}
+
+// OutdatedFormatVersion is returned for volume that has to be upgraded by
+// UpgradeFilesystem before it's loaded
+type OutdatedFormatVersion struct {
+	Version uint16
+}
+
+func (o OutdatedFormatVersion) Error() string {
+	return fmt.Sprintf("volume has format version %d, it has to be upgraded to version %d", o.Version, FormatVersion)
+}
+
+type UnsupportedFeatures struct {
+	Features uint32
+}
+
+func (u UnsupportedFeatures) Error() string {
+	return fmt.Sprintf("volume uses unsupported features %#x", u.Features)
+}
+
 type Superblock struct {
 	Signature                 [9]byte
 	VolumeDescriptor          [251]byte
@@ -10,6 +80,26 @@ type Superblock struct {
 	InodeBitmapStartAddress   VolumePtr
 	InodesStartAddress        VolumePtr
 	DataStartAddress          VolumePtr
+	JournalStartAddress       VolumePtr
+	JournalSize               VolumePtr
+	Magic                     uint32
+	FormatVersion             uint16
+	FeatureFlags              uint32
+	RootInodePtr              InodePtr
+	// Free data clusters that can be allocated only by root
+	ReservedClusters ClusterPtr
+	// Table of checksums placed between journal and data clusters, see
+	// checksum.go
+	ChecksumsStartAddress VolumePtr
+	State                 uint8
+	MountCount            uint32
+	// Nanoseconds since Unix epoch
+	LastMountTime int64
+	// Number of free data clusters when the superblock was written, Mount
+	// counts them again because allocations don't update it
+	FreeClusters ClusterPtr
+	// CRC32C of the superblock with zero in this field
+	Checksum uint32
 }
 
 func NewPreparedSuperblock(signature, volumeDescriptor string, diskSize VolumePtr, clusterSize int16) Superblock {
@@ -28,5 +118,37 @@ func NewPreparedSuperblock(signature, volumeDescriptor string, diskSize VolumePt
 		ClusterBitmapStartAddress: 0,
 		InodesStartAddress:        0,
 		DataStartAddress:          0,
+		JournalStartAddress:       0,
+		JournalSize:               0,
+		Magic:                     SuperblockMagic,
+		FormatVersion:             FormatVersion,
+		FeatureFlags:              0,
+		RootInodePtr:              0,
+	}
+}
+
+// Validate checks that superblock was written by compatible version of the
+// filesystem.
+func (sb Superblock) Validate() error {
+	if sb.Magic != SuperblockMagic {
+		return UnknownVolumeFormat{}
+	}
+
+	if sb.FormatVersion < MinFormatVersion || sb.FormatVersion > FormatVersion {
+		return UnsupportedFormatVersion{sb.FormatVersion}
+	}
+
+	if sb.FeatureFlags&^SupportedFeatures != 0 {
+		return UnsupportedFeatures{sb.FeatureFlags &^ SupportedFeatures}
+	}
+
+	if sb.FormatVersion < FormatVersion {
+		return OutdatedFormatVersion{sb.FormatVersion}
 	}
+
+	return nil
+}
+
+func (sb Superblock) HasFeature(feature uint32) bool {
+	return sb.FeatureFlags&feature != 0
 }
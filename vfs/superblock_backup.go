@@ -0,0 +1,84 @@
+package vfs
+
+import "unsafe"
+
+// Backups of superblock are stored in the middle and at the end of the volume,
+// so they can be found only from size of the volume. Data clusters that hold
+// a backup are always occupied. The middle one is left out when metadata take
+// more than half of the volume.
+
+var superblockSize = VolumePtr(unsafe.Sizeof(Superblock{}))
+
+type NoValidBackupSuperblock struct{}
+
+func (n NoValidBackupSuperblock) Error() string {
+	return "volume doesn't contain any valid backup of superblock"
+}
+
+// BackupSuperblockAddresses returns all addresses where backups of superblock
+// can be stored on volume of given size
+func BackupSuperblockAddresses(volumeSize VolumePtr) []VolumePtr {
+	return []VolumePtr{volumeSize / 2, volumeSize - superblockSize}
+}
+
+// BackupAddresses returns addresses of backups used by the superblock
+func (sb Superblock) BackupAddresses() []VolumePtr {
+	addresses := BackupSuperblockAddresses(sb.DiskSize)
+	if addresses[0] < sb.DataStartAddress {
+		return addresses[1:]
+	}
+
+	return addresses
+}
+
+// BackupSuperblockClusters returns data clusters that hold backups of
+// superblock
+func BackupSuperblockClusters(sb Superblock) []ClusterPtr {
+	clusterPtrs := make([]ClusterPtr, 0, 2)
+	for _, address := range sb.BackupAddresses() {
+		// Backup at the end may lie behind the last cluster
+		last := VolumePtrToClusterPtr(sb, address+superblockSize-1)
+		if last >= sb.ClusterCount {
+			last = sb.ClusterCount - 1
+		}
+
+		for ptr := VolumePtrToClusterPtr(sb, address); ptr <= last; ptr++ {
+			clusterPtrs = append(clusterPtrs, ptr)
+		}
+	}
+
+	return clusterPtrs
+}
+
+// ReadBackupSuperblock returns the first valid backup of superblock that
+// belongs to volume of this size
+func ReadBackupSuperblock(volume StorageVolume) (Superblock, error) {
+	size, err := volume.Size()
+	if err != nil {
+		return Superblock{}, err
+	}
+
+	for _, address := range BackupSuperblockAddresses(size) {
+		if address < superblockSize {
+			continue
+		}
+
+		sb, err := ReadSuperblockAt(volume, address)
+		if err == nil && sb.DiskSize == size {
+			return sb, nil
+		}
+	}
+
+	return Superblock{}, NoValidBackupSuperblock{}
+}
+
+// LoadFilesystemFromBackup is used when superblock at the beginning of the
+// volume is damaged, it stays damaged until superblock is written
+func LoadFilesystemFromBackup(volume StorageVolume) (Filesystem, error) {
+	sb, err := ReadBackupSuperblock(volume)
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	return NewFilesystemFromSuperblock(volume, sb), nil
+}
@@ -0,0 +1,72 @@
+package vfs
+
+import "fmt"
+
+const (
+	// MaxSymlinkHops limits number of symlinks followed during resolution of
+	// one path, so symlink loops can't hang the lookup
+	MaxSymlinkHops = 40
+	// MaxSymlinkTargetLength is maximal length of path stored in symlink
+	MaxSymlinkTargetLength = 4096
+)
+
+type TooManySymlinks struct {
+	Path string
+}
+
+func (t TooManySymlinks) Error() string {
+	return fmt.Sprintf("too many levels of symbolic links: %s", t.Path)
+}
+
+type NotSymlink struct {
+	Name string
+}
+
+func (n NotSymlink) Error() string {
+	return fmt.Sprintf("%s is not a symbolic link", n.Name)
+}
+
+type InvalidSymlinkTarget struct {
+	Target string
+}
+
+func (i InvalidSymlinkTarget) Error() string {
+	return fmt.Sprintf("invalid symlink target \"%s\"", i.Target)
+}
+
+// WriteSymlinkTarget stores target into newly created symlink inode. Short
+// targets are kept in the inode itself, longer ones in data clusters.
+func (mi MutableInode) WriteSymlinkTarget(volume ReadWriteVolume, sb Superblock, identity Identity, target string) error {
+	if len(target) == 0 || len(target) > MaxSymlinkTargetLength {
+		return InvalidSymlinkTarget{target}
+	}
+
+	if len(target) <= InodeInlineDataSize {
+		copy(mi.Inode.InlineData[:], target)
+		mi.Inode.Size = VolumePtr(len(target))
+
+		return mi.Save(volume, sb)
+	}
+
+	_, err := mi.WriteData(volume, sb, identity, 0, []byte(target))
+
+	return err
+}
+
+func (i Inode) ReadSymlinkTarget(volume ReadWriteVolume, sb Superblock) (string, error) {
+	if !i.IsSymlink() {
+		return "", NotSymlink{}
+	}
+
+	if i.Size <= InodeInlineDataSize {
+		return string(i.InlineData[:i.Size]), nil
+	}
+
+	data := make([]byte, i.Size)
+	_, err := i.ReadData(volume, sb, 0, data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
@@ -0,0 +1,447 @@
+package vfs
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"unsafe"
+)
+
+// Volume with older format version is upgraded by copying all its inodes to
+// new filesystem with the same cluster size and number of inodes. Older
+// layouts differ only in fields appended to superblock and inode, in missing
+// checksum table and in header of directory index, which isn't needed to read
+// directory entries. Everything else is read by the current code from
+// a translated copy of the old volume. Inode numbers don't change, so
+// directory entries are copied as they are.
+
+// superblockFieldVersions are format versions that added fields to
+// superblock, fields that aren't listed are present since version 1
+var superblockFieldVersions = map[string]uint16{
+	"ReservedClusters":      11,
+	"ChecksumsStartAddress": 12,
+	"Checksum":              12,
+	"State":                 14,
+	"MountCount":            14,
+	"LastMountTime":         14,
+	"FreeClusters":          15,
+}
+
+// inodeFieldVersions are format versions that added fields to inode
+var inodeFieldVersions = map[string]uint16{
+	"DirectoryIndex": 2,
+	"AccessTime":     4,
+	"ModifyTime":     4,
+	"ChangeTime":     4,
+	"CreationTime":   4,
+	"Mode":           5,
+	"Uid":            5,
+	"Gid":            5,
+	"LinkCount":      6,
+	"InlineData":     7,
+	"XattrInline":    8,
+	"XattrCluster":   8,
+	"Flags":          9,
+	"ExtentDepth":    9,
+	"ExtentCount":    9,
+	"Extents":        9,
+	"Indirect3":      10,
+	"Checksum":       12,
+}
+
+// checksumsFormatVersion is the first version with checksum table
+const checksumsFormatVersion = 12
+
+const upgradeChunkSize = 64 * 1024
+
+// legacyLayout is layout of superblock or inode in older format version
+type legacyLayout struct {
+	structType reflect.Type
+}
+
+func newLegacyLayout(current interface{}, fieldVersions map[string]uint16, version uint16) legacyLayout {
+	currentType := reflect.TypeOf(current)
+	fields := make([]reflect.StructField, 0, currentType.NumField())
+	for i := 0; i < currentType.NumField(); i++ {
+		field := currentType.Field(i)
+		if fieldVersions[field.Name] <= version {
+			fields = append(fields, field)
+		}
+	}
+
+	return legacyLayout{reflect.StructOf(fields)}
+}
+
+// size is space taken by the struct on volume, it's padded the same way as
+// the struct was padded by the older version
+func (l legacyLayout) size() VolumePtr {
+	return VolumePtr(l.structType.Size())
+}
+
+// read decodes struct at given address into fields of the current struct
+// pointed by target, fields that the layout doesn't have are kept. False is
+// returned when the layout has checksum and it doesn't match.
+func (l legacyLayout) read(volume ReadWriteVolume, volumePtr VolumePtr, target interface{}) (bool, error) {
+	value := reflect.New(l.structType)
+	err := volume.ReadStruct(volumePtr, value.Interface())
+	if err != nil {
+		return false, err
+	}
+
+	targetValue := reflect.ValueOf(target).Elem()
+	for i := 0; i < l.structType.NumField(); i++ {
+		targetValue.FieldByName(l.structType.Field(i).Name).Set(value.Elem().Field(i))
+	}
+
+	checksumField := value.Elem().FieldByName("Checksum")
+	if !checksumField.IsValid() {
+		return true, nil
+	}
+	expected := uint32(checksumField.Uint())
+	checksumField.SetUint(0)
+
+	actual, err := structChecksum(value.Interface())
+
+	return actual == expected, err
+}
+
+// UpgradeFilesystem converts volume with older format version to the current
+// one, volume that is already current is only loaded. New filesystem is built
+// in memory, the volume is overwritten after the whole content was copied.
+func UpgradeFilesystem(volume StorageVolume) (Filesystem, error) {
+	var sb Superblock
+	err := volume.ReadStruct(0, &sb)
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	err = sb.Validate()
+	if _, ok := err.(OutdatedFormatVersion); !ok {
+		if err != nil {
+			return Filesystem{}, err
+		}
+
+		return LoadFilesystem(volume)
+	}
+
+	old, inodeCount, err := openLegacyFilesystem(volume, sb.FormatVersion)
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	size, err := volume.Size()
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	image := NewMemoryVolume(size)
+	fs, err := NewFilesystemWithOptions(image, upgradeFormatOptions(old.Superblock, inodeCount))
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	err = fs.WriteStructureToVolume()
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	usedInodePtrs := make([]InodePtr, 0)
+	for inodePtr := InodePtr(0); inodePtr < inodeCount; inodePtr++ {
+		isFree, err := IsInodeFree(old.Volume, old.Superblock, inodePtr)
+		if err != nil {
+			return Filesystem{}, err
+		}
+		if isFree {
+			continue
+		}
+
+		// All inodes are occupied first, so none of them is taken by index
+		// or overflow cluster of another one
+		err = OccupyInode(fs.Volume, fs.Superblock, inodePtr)
+		if err != nil {
+			return Filesystem{}, err
+		}
+		usedInodePtrs = append(usedInodePtrs, inodePtr)
+	}
+
+	for _, inodePtr := range usedInodePtrs {
+		err = upgradeInode(old, fs, inodePtr)
+		if err != nil {
+			return Filesystem{}, err
+		}
+	}
+
+	fs.Superblock.RootInodePtr = old.Superblock.RootInodePtr
+	err = fs.updateFreeClusters()
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	err = fs.WriteSuperblock()
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	err = copyVolume(image, volume, size)
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	err = volume.Sync()
+	if err != nil {
+		return Filesystem{}, err
+	}
+
+	return LoadFilesystem(volume)
+}
+
+// openLegacyFilesystem copies volume with older format version to memory and
+// translates it to the current format. Bitmaps and inodes are moved behind the
+// end of the old volume and checksums are computed when the version didn't
+// have them. Number of inodes of the old volume is returned too.
+func openLegacyFilesystem(volume StorageVolume, version uint16) (Filesystem, InodePtr, error) {
+	size, err := volume.Size()
+	if err != nil {
+		return Filesystem{}, 0, err
+	}
+
+	view := NewMemoryVolume(size)
+	err = copyVolume(volume, view, size)
+	if err != nil {
+		return Filesystem{}, 0, err
+	}
+
+	var sb Superblock
+	valid, err := newLegacyLayout(Superblock{}, superblockFieldVersions, version).read(view, 0, &sb)
+	if err != nil {
+		return Filesystem{}, 0, err
+	}
+	if !valid {
+		return Filesystem{}, 0, SuperblockChecksumMismatch{}
+	}
+
+	// Journal records point to the old layout, torn transaction is dropped
+	// like when the volume is loaded
+	_, err = ReplayJournal(view, sb)
+	if _, ok := err.(TornJournalRecord); !ok && err != nil {
+		return Filesystem{}, 0, err
+	}
+
+	inodeLayout := newLegacyLayout(Inode{}, inodeFieldVersions, version)
+	inodeCount := InodePtr((inodesEndAddress(sb) - sb.InodesStartAddress) / inodeLayout.size())
+
+	// End of each bitmap is given by start of the following region, so they
+	// are moved together with inodes
+	viewSb := sb
+	viewSb.FormatVersion = FormatVersion
+	viewSb.ClusterBitmapStartAddress = size
+	viewSb.InodeBitmapStartAddress = size + sb.InodeBitmapStartAddress - sb.ClusterBitmapStartAddress
+	viewSb.InodesStartAddress = size + sb.InodesStartAddress - sb.ClusterBitmapStartAddress
+	end := viewSb.InodesStartAddress + VolumePtr(inodeCount)*VolumePtr(unsafe.Sizeof(Inode{}))
+	if version < checksumsFormatVersion {
+		viewSb.ChecksumsStartAddress = end
+		end += checksumTableSize(
+			sb.ClusterCount,
+			sb.InodeBitmapStartAddress-sb.ClusterBitmapStartAddress,
+			sb.InodesStartAddress-sb.InodeBitmapStartAddress,
+		)
+	}
+
+	err = view.Resize(end)
+	if err != nil {
+		return Filesystem{}, 0, err
+	}
+
+	err = moveRegion(view, sb.ClusterBitmapStartAddress, viewSb.ClusterBitmapStartAddress, sb.InodesStartAddress-sb.ClusterBitmapStartAddress)
+	if err != nil {
+		return Filesystem{}, 0, err
+	}
+
+	if version < checksumsFormatVersion {
+		err = UpdateBitmapChecksums(view, viewSb)
+		if err != nil {
+			return Filesystem{}, 0, err
+		}
+
+		for ptr := ClusterPtr(0); ptr < viewSb.ClusterCount; ptr++ {
+			err = updateClusterChecksum(view, viewSb, ptr)
+			if err != nil {
+				return Filesystem{}, 0, err
+			}
+		}
+	}
+
+	for inodePtr := InodePtr(0); inodePtr < inodeCount; inodePtr++ {
+		isFree, err := IsInodeFree(view, viewSb, inodePtr)
+		if err != nil {
+			return Filesystem{}, 0, err
+		}
+		if isFree {
+			continue
+		}
+
+		inode := NewInode()
+		valid, err := inodeLayout.read(view, sb.InodesStartAddress+VolumePtr(inodePtr)*inodeLayout.size(), &inode)
+		if err != nil {
+			return Filesystem{}, 0, err
+		}
+		if !valid {
+			return Filesystem{}, 0, InodeChecksumMismatch{inodePtr}
+		}
+		if version < 5 && inode.IsDir() {
+			inode.Mode = DefaultDirectoryMode
+		}
+
+		err = MutableInode{Inode: &inode, InodePtr: inodePtr}.Save(view, viewSb)
+		if err != nil {
+			return Filesystem{}, 0, err
+		}
+	}
+
+	return NewFilesystemFromSuperblock(view, viewSb), inodeCount, nil
+}
+
+// upgradeFormatOptions keeps cluster size, number of inodes, signature, label,
+// reserved space and optional features of the old volume
+func upgradeFormatOptions(sb Superblock, inodeCount InodePtr) FormatOptions {
+	options := FormatOptions{
+		ClusterSize:   sb.ClusterSize,
+		InodeCount:    VolumePtr(inodeCount),
+		Signature:     string(bytes.TrimRight(sb.Signature[:], "\x00")),
+		Label:         string(bytes.TrimRight(sb.VolumeDescriptor[:], "\x00")),
+		DataChecksums: sb.HasFeature(FeatureDataChecksums),
+		Extents:       sb.HasFeature(FeatureExtents),
+	}
+
+	clusterCount := VolumePtr(sb.ClusterCount)
+	options.ReservedPercentage = int((VolumePtr(sb.ReservedClusters)*100 + clusterCount/2) / clusterCount)
+
+	return options
+}
+
+// upgradeInode copies inode with its data, symlink target or directory
+// entries and extended attributes to the new filesystem
+func upgradeInode(old, fs Filesystem, inodePtr InodePtr) error {
+	oldMutableInode, err := LoadMutableInode(old.Volume, old.Superblock, inodePtr)
+	if err != nil {
+		return err
+	}
+	oldInode := *oldMutableInode.Inode
+
+	inode := NewInode()
+	inode.Type = oldInode.Type
+	if fs.Superblock.HasFeature(FeatureExtents) {
+		inode.Flags |= InodeFlagExtents
+	}
+	if fs.Superblock.HasFeature(FeatureInlineData) {
+		inode.Flags |= InodeFlagInlineData
+	}
+	mutableInode := MutableInode{Inode: &inode, InodePtr: inodePtr}
+
+	if oldInode.IsDir() {
+		directoryEntries, err := ReadAllDirectoryEntries(old.Volume, old.Superblock, oldInode)
+		if err != nil {
+			return err
+		}
+
+		err = AppendDirectoryEntries(fs.Volume, fs.Superblock, fs.Identity, mutableInode, directoryEntries...)
+		if err != nil {
+			return err
+		}
+	} else if oldInode.IsSymlink() {
+		target, err := oldInode.ReadSymlinkTarget(old.Volume, old.Superblock)
+		if err != nil {
+			return err
+		}
+
+		err = mutableInode.WriteSymlinkTarget(fs.Volume, fs.Superblock, fs.Identity, target)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = upgradeData(old, oldInode, fs, mutableInode)
+		if err != nil {
+			return err
+		}
+	}
+
+	xattrs, err := oldMutableInode.ReadXattrs(old.Volume, old.Superblock)
+	if err != nil {
+		return err
+	}
+	if len(xattrs) > 0 {
+		err = mutableInode.WriteXattrs(fs.Volume, fs.Superblock, fs.Identity, xattrs)
+		if err != nil {
+			return err
+		}
+	}
+
+	inode.AccessTime = oldInode.AccessTime
+	inode.ModifyTime = oldInode.ModifyTime
+	inode.ChangeTime = oldInode.ChangeTime
+	inode.CreationTime = oldInode.CreationTime
+	inode.Mode = oldInode.Mode
+	inode.Uid = oldInode.Uid
+	inode.Gid = oldInode.Gid
+	inode.LinkCount = oldInode.LinkCount
+
+	return mutableInode.Save(fs.Volume, fs.Superblock)
+}
+
+// upgradeData copies content of file cluster by cluster, holes aren't
+// allocated
+func upgradeData(old Filesystem, oldInode Inode, fs Filesystem, mutableInode MutableInode) error {
+	clusterSize := VolumePtr(old.Superblock.ClusterSize)
+	for offset := VolumePtr(0); offset < oldInode.Size; offset += clusterSize {
+		if !oldInode.HasInlineData() {
+			ptr, err := oldInode.ResolveDataClusterAddress(old.Volume, old.Superblock, ClusterPtr(offset/clusterSize))
+			if err != nil {
+				return err
+			}
+			if ptr == Unused {
+				continue
+			}
+		}
+
+		data := make([]byte, VolumePtr(math.Min(float64(clusterSize), float64(oldInode.Size-offset))))
+		_, err := oldInode.ReadData(old.Volume, old.Superblock, offset, data)
+		if err != nil {
+			return err
+		}
+
+		_, err = mutableInode.WriteData(fs.Volume, fs.Superblock, fs.Identity, offset, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if mutableInode.Inode.Size < oldInode.Size {
+		// File ends with a hole, only its last byte is written
+		_, err := mutableInode.WriteData(fs.Volume, fs.Superblock, fs.Identity, oldInode.Size-1, []byte{0})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyVolume copies the first length bytes of one volume to another
+func copyVolume(from, to ReadWriteVolume, length VolumePtr) error {
+	chunk := make([]byte, upgradeChunkSize)
+	for offset := VolumePtr(0); offset < length; offset += upgradeChunkSize {
+		n := VolumePtr(math.Min(float64(length-offset), upgradeChunkSize))
+
+		err := from.ReadBytes(offset, chunk[:n])
+		if err != nil {
+			return err
+		}
+
+		err = to.WriteStruct(offset, chunk[:n])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -12,7 +12,7 @@ type ClusterPtr int32
 type InodePtr int32
 
 type ReadableVolume interface {
-	ReadByte(volumePtr VolumePtr) (byte, error)
+	ReadByteAt(volumePtr VolumePtr) (byte, error)
 	ReadBytes(volumePtr VolumePtr, data []byte) error
 	ReadStruct(volumePtr VolumePtr, data interface{}) error
 	ReadObject(volumePtr VolumePtr, data interface{}) (VolumeObject, error)
@@ -20,7 +20,7 @@ type ReadableVolume interface {
 
 type WritableVolume interface {
 	WriteStruct(volumePtr VolumePtr, data interface{}) error
-	WriteByte(volumePtr VolumePtr, data byte) error
+	WriteByteAt(volumePtr VolumePtr, data byte) error
 }
 
 type ReadWriteVolume interface {
@@ -28,6 +28,29 @@ type ReadWriteVolume interface {
 	ReadableVolume
 }
 
+// StorageVolume is a complete volume backend that can hold a filesystem.
+// Volume stores data in a host file, MemoryVolume in memory and CachedVolume
+// can be put in front of any other backend.
+type StorageVolume interface {
+	ReadWriteVolume
+	Size() (VolumePtr, error)
+	// Resize extends volume with zeros or cuts off its end
+	Resize(size VolumePtr) error
+	Truncate() error
+	Sync() error
+	Close() error
+	Destroy() error
+}
+
+func syncVolume(volume ReadWriteVolume) error {
+	storageVolume, ok := volume.(StorageVolume)
+	if !ok {
+		return nil
+	}
+
+	return storageVolume.Sync()
+}
+
 type Volume struct {
 	file       *os.File
 	endianness binary.ByteOrder
@@ -98,7 +121,7 @@ func (v Volume) WriteStruct(volumePtr VolumePtr, data interface{}) error {
 	return nil
 }
 
-func (v Volume) WriteByte(volumePtr VolumePtr, data byte) error {
+func (v Volume) WriteByteAt(volumePtr VolumePtr, data byte) error {
 	err := v.goToAddress(volumePtr)
 	if err != nil {
 		return err
@@ -112,7 +135,7 @@ func (v Volume) WriteByte(volumePtr VolumePtr, data byte) error {
 	return nil
 }
 
-func (v Volume) ReadByte(volumePtr VolumePtr) (byte, error) {
+func (v Volume) ReadByteAt(volumePtr VolumePtr) (byte, error) {
 	err := v.goToAddress(volumePtr)
 	if err != nil {
 		return 0, err
@@ -127,7 +150,7 @@ func (v Volume) ReadByte(volumePtr VolumePtr) (byte, error) {
 	return data[0], nil
 }
 
-func(v Volume) ReadBytes(volumePtr VolumePtr, data []byte) error {
+func (v Volume) ReadBytes(volumePtr VolumePtr, data []byte) error {
 	err := v.goToAddress(volumePtr)
 	if err != nil {
 		return err
@@ -177,6 +200,10 @@ func (v Volume) Size() (VolumePtr, error) {
 	return 0, errors.New("missing volume file")
 }
 
+func (v Volume) Resize(size VolumePtr) error {
+	return v.file.Truncate(int64(size))
+}
+
 func (v Volume) Truncate() error {
 	size, err := v.Size()
 	if err != nil {
@@ -190,6 +217,10 @@ func (v Volume) Truncate() error {
 	return nil
 }
 
+func (v Volume) Sync() error {
+	return v.file.Sync()
+}
+
 func (v Volume) Close() error {
 	return v.file.Close()
 }
@@ -0,0 +1,182 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// InodeXattrInlineSize is size of the area in inode used for extended
+// attributes, attributes that don't fit there continue in overflow cluster
+const InodeXattrInlineSize = 64
+
+// Header of encoded attribute is name length (1 byte) and value length
+// (2 bytes), zero name length terminates the list
+const xattrHeaderSize = 3
+
+const MaxXattrNameLength = 255
+
+type XattrNotFound struct {
+	Name string
+}
+
+func (x XattrNotFound) Error() string {
+	return fmt.Sprintf("extended attribute %s was not found", x.Name)
+}
+
+type InvalidXattrName struct {
+	Name string
+}
+
+func (i InvalidXattrName) Error() string {
+	return fmt.Sprintf("invalid extended attribute name \"%s\"", i.Name)
+}
+
+type NoXattrSpace struct {
+	Name string
+}
+
+func (n NoXattrSpace) Error() string {
+	return fmt.Sprintf("not enough space for extended attribute %s", n.Name)
+}
+
+type CorruptedXattrs struct {
+	InodePtr InodePtr
+}
+
+func (c CorruptedXattrs) Error() string {
+	return fmt.Sprintf("extended attributes of inode %d are corrupted", c.InodePtr)
+}
+
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+func ValidateXattrName(name string) error {
+	if len(name) == 0 || len(name) > MaxXattrNameLength {
+		return InvalidXattrName{name}
+	}
+
+	return nil
+}
+
+// maxXattrsSize returns number of bytes available for all encoded attributes
+// of one inode
+func maxXattrsSize(sb Superblock) int {
+	return InodeXattrInlineSize + int(sb.ClusterSize)
+}
+
+func encodeXattrs(xattrs []Xattr) []byte {
+	data := make([]byte, 0)
+	for _, xattr := range xattrs {
+		header := make([]byte, xattrHeaderSize)
+		header[0] = byte(len(xattr.Name))
+		binary.LittleEndian.PutUint16(header[1:], uint16(len(xattr.Value)))
+
+		data = append(data, header...)
+		data = append(data, xattr.Name...)
+		data = append(data, xattr.Value...)
+	}
+
+	return data
+}
+
+func decodeXattrs(data []byte) ([]Xattr, bool) {
+	xattrs := make([]Xattr, 0)
+	for offset := 0; offset+xattrHeaderSize <= len(data); {
+		nameLength := int(data[offset])
+		if nameLength == 0 {
+			break
+		}
+		valueLength := int(binary.LittleEndian.Uint16(data[offset+1:]))
+		offset += xattrHeaderSize
+
+		if offset+nameLength+valueLength > len(data) {
+			return nil, false
+		}
+
+		value := make([]byte, valueLength)
+		copy(value, data[offset+nameLength:])
+		xattrs = append(xattrs, Xattr{
+			Name:  string(data[offset : offset+nameLength]),
+			Value: value,
+		})
+		offset += nameLength + valueLength
+	}
+
+	return xattrs, true
+}
+
+func (mi MutableInode) ReadXattrs(volume ReadWriteVolume, sb Superblock) ([]Xattr, error) {
+	data := append([]byte{}, mi.Inode.XattrInline[:]...)
+
+	if mi.Inode.XattrCluster != Unused {
+		clusterData := make([]byte, sb.ClusterSize)
+		err := volume.ReadBytes(ClusterPtrToVolumePtr(sb, mi.Inode.XattrCluster), clusterData)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, clusterData...)
+	}
+
+	xattrs, ok := decodeXattrs(data)
+	if !ok {
+		return nil, CorruptedXattrs{mi.InodePtr}
+	}
+
+	return xattrs, nil
+}
+
+// WriteXattrs replaces all extended attributes of the inode. Overflow cluster
+// is allocated only when attributes don't fit into the inode.
+func (mi MutableInode) WriteXattrs(volume ReadWriteVolume, sb Superblock, identity Identity, xattrs []Xattr) error {
+	data := encodeXattrs(xattrs)
+	if len(data) > maxXattrsSize(sb) {
+		return NoXattrSpace{xattrs[len(xattrs)-1].Name}
+	}
+
+	mi.Inode.XattrInline = [InodeXattrInlineSize]byte{}
+	copy(mi.Inode.XattrInline[:], data)
+
+	if len(data) > InodeXattrInlineSize {
+		if mi.Inode.XattrCluster == Unused {
+			clusterObjects, err := FindFreeClusters(volume, sb, identity, 1, true)
+			if err != nil {
+				return err
+			}
+			mi.Inode.XattrCluster = VolumePtrToClusterPtr(sb, clusterObjects[0].VolumePtr)
+		}
+
+		clusterData := make([]byte, sb.ClusterSize)
+		copy(clusterData, data[InodeXattrInlineSize:])
+		err := volume.WriteStruct(ClusterPtrToVolumePtr(sb, mi.Inode.XattrCluster), clusterData)
+		if err != nil {
+			return err
+		}
+	} else if mi.Inode.XattrCluster != Unused {
+		err := FreeCluster(volume, sb, mi.Inode.XattrCluster)
+		if err != nil {
+			return err
+		}
+		mi.Inode.XattrCluster = Unused
+	}
+
+	mi.Inode.TouchChange()
+
+	return mi.Save(volume, sb)
+}
+
+// FreeXattrs drops all extended attributes, it's used when inode is freed
+func (mi MutableInode) FreeXattrs(volume ReadWriteVolume, sb Superblock) error {
+	if mi.Inode.XattrCluster != Unused {
+		err := FreeCluster(volume, sb, mi.Inode.XattrCluster)
+		if err != nil {
+			return err
+		}
+	}
+
+	mi.Inode.XattrCluster = Unused
+	mi.Inode.XattrInline = [InodeXattrInlineSize]byte{}
+
+	return mi.Save(volume, sb)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/PapiCZ/kiv_zos/vfs"
 	"io"
+	"math"
 	"strings"
 )
 
@@ -50,20 +51,47 @@ func Open(fs vfs.Filesystem, path string, create bool) (*File, error) {
 				return nil, err
 			}
 
+			err = vfs.ValidateName(fs.Superblock, name)
+			if err != nil {
+				return nil, err
+			}
+
 			// Path doesn't exist, we want to create directory entry in parent inode
 			parentMutableInode, err := getInodeByPathRecursively(fs, joinString(parentPath, "/"))
 			if err != nil {
 				return nil, err
 			}
 
+			err = checkAccess(fs, parentMutableInode, vfs.PermissionWrite|vfs.PermissionExecute, path)
+			if err != nil {
+				return nil, err
+			}
+
+			// Entry can exist when it is symlink pointing to nonexistent target
+			_, _, err = vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, *parentMutableInode.Inode, name)
+			if err == nil {
+				return nil, vfs.DuplicateDirectoryEntry{}
+			}
+
 			// Create new file
-			vo, err := vfs.FindFreeInode(fs.Volume, fs.Superblock, true)
+			tx := vfs.BeginTransaction(fs.Volume, fs.Superblock)
+			vo, err := vfs.FindFreeInode(tx, fs.Superblock, true)
+			if err != nil {
+				return nil, err
+			}
+			newInode := vo.Object.(vfs.Inode)
+			newInode.SetOwnership(fs.Identity, *parentMutableInode.Inode)
+			err = vfs.MutableInode{
+				Inode:    &newInode,
+				InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, vo.VolumePtr),
+			}.Save(tx, fs.Superblock)
 			if err != nil {
 				return nil, err
 			}
 			err = vfs.AppendDirectoryEntries(
-				fs.Volume,
+				tx,
 				fs.Superblock,
+				fs.Identity,
 				parentMutableInode,
 				vfs.NewDirectoryEntry(
 					name,
@@ -73,6 +101,11 @@ func Open(fs vfs.Filesystem, path string, create bool) (*File, error) {
 				return nil, err
 			}
 
+			err = tx.Commit()
+			if err != nil {
+				return nil, err
+			}
+
 			mutableInode, err = getInodeByPathRecursively(fs, path)
 			if err != nil {
 				return nil, err
@@ -96,11 +129,21 @@ func Mkdir(fs vfs.Filesystem, path string) error {
 	parentPath := pathFragments[:len(pathFragments)-1]
 	name := pathFragments[len(pathFragments)-1]
 
+	err := vfs.ValidateName(fs.Superblock, name)
+	if err != nil {
+		return err
+	}
+
 	parentMutableInode, err := getInodeByPathRecursively(fs, joinString(parentPath, "/"))
 	if err != nil {
 		return err
 	}
 
+	err = checkAccess(fs, parentMutableInode, vfs.PermissionWrite|vfs.PermissionExecute, path)
+	if err != nil {
+		return err
+	}
+
 	// Check for duplicate entry
 	_, _, err = vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, *parentMutableInode.Inode, name)
 	if err == nil {
@@ -108,22 +151,28 @@ func Mkdir(fs vfs.Filesystem, path string) error {
 		return vfs.DuplicateDirectoryEntry{}
 	}
 
-	newDirInodeObj, err := vfs.FindFreeInode(fs.Volume, fs.Superblock, true)
+	tx := vfs.BeginTransaction(fs.Volume, fs.Superblock)
+	newDirInodeObj, err := vfs.FindFreeInode(tx, fs.Superblock, true)
 	if err != nil {
 		return err
 	}
 	newDirInode := newDirInodeObj.Object.(vfs.Inode)
 	newDirInode.Type = vfs.InodeDirectoryType
-	newDirInodeObj.Object = newDirInode
-	err = newDirInodeObj.Save()
+	newDirInode.Mode = vfs.DefaultDirectoryMode
+	newDirInode.SetOwnership(fs.Identity, *parentMutableInode.Inode)
+	err = vfs.MutableInode{
+		Inode:    &newDirInode,
+		InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, newDirInodeObj.VolumePtr),
+	}.Save(tx, fs.Superblock)
 	if err != nil {
 		return err
 	}
 
 	// Create new directory in parent newDirInode
 	err = vfs.AppendDirectoryEntries(
-		fs.Volume,
+		tx,
 		fs.Superblock,
+		fs.Identity,
 		parentMutableInode,
 		vfs.NewDirectoryEntry(
 			name,
@@ -135,8 +184,9 @@ func Mkdir(fs vfs.Filesystem, path string) error {
 
 	// Initialize newly created directory (add . and ..)
 	err = vfs.AppendDirectoryEntries(
-		fs.Volume,
+		tx,
 		fs.Superblock,
+		fs.Identity,
 		vfs.MutableInode{
 			Inode:    &newDirInode,
 			InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, newDirInodeObj.VolumePtr),
@@ -152,24 +202,10 @@ func Mkdir(fs vfs.Filesystem, path string) error {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func Remove(fs vfs.Filesystem, path string) error {
-	cwd, err := Abs(fs, ".")
-	if err != nil {
-		return err
-	}
-
-	abs, err := Abs(fs, path)
-	if err != nil {
-		return err
-	}
-
-	if abs == cwd {
-		return errors.New("can't delete current working directory")
-	}
-
 	pathFragments := splitString(path, "/")
 	parentPath := pathFragments[:len(pathFragments)-1]
 	name := pathFragments[len(pathFragments)-1]
@@ -183,15 +219,24 @@ func Remove(fs vfs.Filesystem, path string) error {
 		return err
 	}
 
-	fileMutableInode, err := getInodeByPathRecursively(fs, path)
+	// Symlink is removed itself, not its target
+	fileMutableInode, err := getInodeByPathRecursivelyNoFollow(fs, path)
 	if err != nil {
 		return err
 	}
 
+	if fileMutableInode.InodePtr == fs.CurrentInodePtr {
+		return errors.New("can't delete current working directory")
+	}
+
 	if fileMutableInode.Inode.IsRootDir() {
 		return errors.New("cannot remove root directory")
 	}
 
+	if !fileMutableInode.Inode.CanRemoveFrom(fs.Identity, *parentMutableInode.Inode) {
+		return vfs.PermissionDenied{Name: path}
+	}
+
 	// Check if file is dir and empty
 	if fileMutableInode.Inode.IsDir() {
 		directoryEntries, err := vfs.ReadAllDirectoryEntries(fs.Volume, fs.Superblock, *fileMutableInode.Inode)
@@ -205,25 +250,39 @@ func Remove(fs vfs.Filesystem, path string) error {
 		}
 	}
 
-	// Free clusters
-	_, err = vfs.Shrink(fileMutableInode, fs.Volume, fs.Superblock, 0)
+	tx := vfs.BeginTransaction(fs.Volume, fs.Superblock)
+
+	unused, err := fileMutableInode.Unlink(tx, fs.Superblock)
 	if err != nil {
 		return err
 	}
 
-	// Free inode
-	err = vfs.FreeInode(fs.Volume, fs.Superblock, fileMutableInode.InodePtr)
-	if err != nil {
-		return err
+	if unused {
+		// Free clusters
+		_, err = vfs.Shrink(fileMutableInode, tx, fs.Superblock, fs.Identity, 0)
+		if err != nil {
+			return err
+		}
+
+		err = fileMutableInode.FreeXattrs(tx, fs.Superblock)
+		if err != nil {
+			return err
+		}
+
+		// Free inode
+		err = vfs.FreeInode(tx, fs.Superblock, fileMutableInode.InodePtr)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Remove directory entry
-	_, err = vfs.RemoveDirectoryEntry(fs.Volume, fs.Superblock, parentMutableInode, name)
+	_, err = vfs.RemoveDirectoryEntry(tx, fs.Superblock, fs.Identity, parentMutableInode, name)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func BadRemove(fs vfs.Filesystem, path string) error {
@@ -236,7 +295,7 @@ func BadRemove(fs vfs.Filesystem, path string) error {
 		return err
 	}
 
-	fileMutableInode, err := getInodeByPathRecursively(fs, path)
+	fileMutableInode, err := getInodeByPathRecursivelyNoFollow(fs, path)
 	if err != nil {
 		return err
 	}
@@ -258,14 +317,9 @@ func BadRemove(fs vfs.Filesystem, path string) error {
 		}
 	}
 
-	// Free clusters
-	_, err = vfs.Shrink(fileMutableInode, fs.Volume, fs.Superblock, 0)
-	if err != nil {
-		return err
-	}
-
-	// Remove directory entry
-	_, err = vfs.RemoveDirectoryEntry(fs.Volume, fs.Superblock, parentMutableInode, name)
+	// Only directory entry is removed, inode stays allocated together with
+	// its data, so fsck can reattach it to lost+found
+	_, err = vfs.RemoveDirectoryEntry(fs.Volume, fs.Superblock, fs.Identity, parentMutableInode, name)
 	if err != nil {
 		return err
 	}
@@ -280,12 +334,22 @@ func Rename(fs vfs.Filesystem, oldPath, newPath string) error {
 	newParentPath := newPathFragments[:len(newPathFragments)-1]
 	newName := newPathFragments[len(newPathFragments)-1]
 
+	err := vfs.ValidateName(fs.Superblock, newName)
+	if err != nil {
+		return err
+	}
+
 	// Find new parent inode
 	newParentMutableInode, err := getInodeByPathRecursively(fs, joinString(newParentPath, "/"))
 	if err != nil {
 		return err
 	}
 
+	err = checkAccess(fs, newParentMutableInode, vfs.PermissionWrite|vfs.PermissionExecute, newPath)
+	if err != nil {
+		return err
+	}
+
 	// Check for duplicate entry
 	_, _, err = vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, *newParentMutableInode.Inode, newName)
 	if err == nil {
@@ -308,25 +372,107 @@ func Rename(fs vfs.Filesystem, oldPath, newPath string) error {
 		return err
 	}
 
+	oldMutableInode, err := getInodeByPathRecursivelyNoFollow(fs, oldPath)
+	if err != nil {
+		return err
+	}
+
+	if !oldMutableInode.Inode.CanRemoveFrom(fs.Identity, *oldParentMutableInode.Inode) {
+		return vfs.PermissionDenied{Name: oldPath}
+	}
+
+	tx := vfs.BeginTransaction(fs.Volume, fs.Superblock)
+
 	// Remove directory entry from parent inode
-	directoryEntry, err := vfs.RemoveDirectoryEntry(fs.Volume, fs.Superblock, oldParentMutableInode, oldName)
+	directoryEntry, err := vfs.RemoveDirectoryEntry(tx, fs.Superblock, fs.Identity, oldParentMutableInode, oldName)
 	if err != nil {
 		return err
 	}
 
-	err = newParentMutableInode.Reload(fs.Volume, fs.Superblock)
+	err = newParentMutableInode.Reload(tx, fs.Superblock)
 	if err != nil {
 		return err
 	}
 
 	directoryEntry.Name = vfs.StringNameToBytes(newName)
 
-	err = vfs.AppendDirectoryEntries(fs.Volume, fs.Superblock, newParentMutableInode, directoryEntry)
+	err = vfs.AppendDirectoryEntries(tx, fs.Superblock, fs.Identity, newParentMutableInode, directoryEntry)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// Renamed inode itself is changed too
+	renamedMutableInode, err := vfs.LoadMutableInode(tx, fs.Superblock, directoryEntry.InodePtr)
+	if err != nil {
+		return err
+	}
+
+	renamedMutableInode.Inode.TouchChange()
+	err = renamedMutableInode.Save(tx, fs.Superblock)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Link creates new directory entry newPath pointing to the same inode as
+// oldPath. Directories can't be linked.
+func Link(fs vfs.Filesystem, oldPath, newPath string) error {
+	newPathFragments := splitString(newPath, "/")
+	newParentPath := newPathFragments[:len(newPathFragments)-1]
+	newName := newPathFragments[len(newPathFragments)-1]
+
+	err := vfs.ValidateName(fs.Superblock, newName)
+	if err != nil {
+		return err
+	}
+
+	oldMutableInode, err := getInodeByPathRecursivelyNoFollow(fs, oldPath)
+	if err != nil {
+		return err
+	}
+
+	if oldMutableInode.Inode.IsDir() {
+		return errors.New("hard link to directory is not allowed")
+	}
+
+	if oldMutableInode.Inode.LinkCount == math.MaxUint16 {
+		return errors.New("too many links")
+	}
+
+	newParentMutableInode, err := getInodeByPathRecursively(fs, joinString(newParentPath, "/"))
+	if err != nil {
+		return err
+	}
+
+	err = checkAccess(fs, newParentMutableInode, vfs.PermissionWrite|vfs.PermissionExecute, newPath)
+	if err != nil {
+		return err
+	}
+
+	// Check for duplicate entry
+	_, _, err = vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, *newParentMutableInode.Inode, newName)
+	if err == nil {
+		return vfs.DuplicateDirectoryEntry{}
+	}
+
+	tx := vfs.BeginTransaction(fs.Volume, fs.Superblock)
+
+	err = vfs.AppendDirectoryEntries(tx, fs.Superblock, fs.Identity, newParentMutableInode,
+		vfs.NewDirectoryEntry(newName, oldMutableInode.InodePtr))
+	if err != nil {
+		return err
+	}
+
+	oldMutableInode.Inode.LinkCount++
+	oldMutableInode.Inode.TouchChange()
+	err = oldMutableInode.Save(tx, fs.Superblock)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func ChangeDirectory(fs *vfs.Filesystem, path string) error {
@@ -397,16 +543,38 @@ func Abs(fs vfs.Filesystem, path string) (string, error) {
 func DataClustersInfo(fs vfs.Filesystem, path string) ([]vfs.ClusterPtr,
 	map[vfs.ClusterPtr][]vfs.ClusterPtr,
 	map[vfs.ClusterPtr]map[vfs.ClusterPtr][]vfs.ClusterPtr,
+	map[vfs.ClusterPtr]map[vfs.ClusterPtr]map[vfs.ClusterPtr][]vfs.ClusterPtr,
 	error) {
 
 	mutableInode, err := getInodeByPathRecursively(fs, path)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	return mutableInode.Inode.GetUsedPtrs(fs.Volume, fs.Superblock)
 }
 
+// ExtentsInfo returns extents of the file, the list is empty for files
+// mapped by pointers
+func ExtentsInfo(fs vfs.Filesystem, path string) ([]vfs.Extent, error) {
+	mutableInode, err := getInodeByPathRecursively(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return mutableInode.Inode.GetExtents(fs.Volume, fs.Superblock)
+}
+
+// HolesInfo returns runs of clusters of the file that have no data
+func HolesInfo(fs vfs.Filesystem, path string) ([]vfs.Hole, error) {
+	mutableInode, err := getInodeByPathRecursively(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return mutableInode.Inode.GetHoles(fs.Volume, fs.Superblock)
+}
+
 func (f File) ReadDir() ([]FileInfo, error) {
 	if !f.IsDir() {
 		return nil, errors.New("file is not a directory")
@@ -414,6 +582,11 @@ func (f File) ReadDir() ([]FileInfo, error) {
 
 	fileInfos := make([]FileInfo, 0)
 
+	err := checkAccess(f.filesystem, f.mutableInode, vfs.PermissionRead, f.name)
+	if err != nil {
+		return fileInfos, err
+	}
+
 	directoryEntries, err := vfs.ReadAllDirectoryEntries(f.filesystem.Volume, f.filesystem.Superblock, *f.mutableInode.Inode)
 	if err != nil {
 		return fileInfos, err
@@ -424,12 +597,7 @@ func (f File) ReadDir() ([]FileInfo, error) {
 		if err != nil {
 			return fileInfos, err
 		}
-		fileInfos = append(fileInfos, FileInfo{
-			name:     cToGoString(directoryEntry.Name[:]),
-			size:     int(mutableInode.Inode.Size),
-			inodePtr: int(mutableInode.InodePtr),
-			isDir:    mutableInode.Inode.IsDir(),
-		})
+		fileInfos = append(fileInfos, newFileInfo(cToGoString(directoryEntry.Name[:]), mutableInode))
 	}
 
 	return fileInfos, nil
@@ -440,9 +608,20 @@ func (f *File) Write(data []byte) (int, error) {
 		return 0, errors.New("you can't write to directory")
 	}
 
+	err := checkAccess(f.filesystem, f.mutableInode, vfs.PermissionWrite, f.name)
+	if err != nil {
+		return 0, err
+	}
+
+	if !f.filesystem.Identity.IsRoot() {
+		// Modified file must not keep privileges of its owner
+		f.mutableInode.Inode.Mode &^= vfs.ModeSetuid | vfs.ModeSetgid
+	}
+
 	n, err := f.mutableInode.WriteData(
 		f.filesystem.Volume,
 		f.filesystem.Superblock,
+		f.filesystem.Identity,
 		vfs.VolumePtr(f.offset),
 		data,
 	)
@@ -460,6 +639,11 @@ func (f *File) Read(data []byte) (int, error) {
 		return 0, errors.New("you can't read from directory")
 	}
 
+	err := checkAccess(f.filesystem, f.mutableInode, vfs.PermissionRead, f.name)
+	if err != nil {
+		return 0, err
+	}
+
 	if f.offset >= int(f.mutableInode.Inode.Size) {
 		return 0, io.EOF
 	}
@@ -476,6 +660,13 @@ func (f *File) Read(data []byte) (int, error) {
 
 	f.offset += int(n)
 
+	if f.mutableInode.Inode.TouchAccess() {
+		err = f.mutableInode.Save(f.filesystem.Volume, f.filesystem.Superblock)
+		if err != nil {
+			return int(n), err
+		}
+	}
+
 	if n == 0 && f.offset >= int(f.mutableInode.Inode.Size) {
 		return int(n), io.EOF
 	}
@@ -483,6 +674,28 @@ func (f *File) Read(data []byte) (int, error) {
 	return int(n), nil
 }
 
+// Seek sets offset for the next Read or Write. Offset past the end of the
+// file is allowed, writing there leaves a hole in the file.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(f.offset)
+	case io.SeekEnd:
+		offset += int64(f.mutableInode.Inode.Size)
+	default:
+		return int64(f.offset), errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return int64(f.offset), errors.New("negative offset")
+	}
+
+	f.offset = int(offset)
+
+	return offset, nil
+}
+
 func (f *File) ReadAll() (int, []byte, error) {
 	data := make([]byte, f.mutableInode.Inode.Size)
 	n, err := f.Read(data)
@@ -505,3 +718,7 @@ func (f File) Size() int64 {
 func (f File) InodePtr() int64 {
 	return int64(f.mutableInode.InodePtr)
 }
+
+func (f File) Stat() FileInfo {
+	return newFileInfo(f.name, f.mutableInode)
+}
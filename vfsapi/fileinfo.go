@@ -1,10 +1,44 @@
 package vfsapi
 
+import (
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"time"
+)
+
 type FileInfo struct {
-	name     string
-	size     int
-	inodePtr int
-	isDir    bool
+	name         string
+	size         int
+	inodePtr     int
+	isDir        bool
+	isSymlink    bool
+	isInline     bool
+	mode         uint16
+	uid          uint32
+	gid          uint32
+	linkCount    uint16
+	accessTime   time.Time
+	modTime      time.Time
+	changeTime   time.Time
+	creationTime time.Time
+}
+
+func newFileInfo(name string, mutableInode vfs.MutableInode) FileInfo {
+	return FileInfo{
+		name:         name,
+		size:         int(mutableInode.Inode.Size),
+		inodePtr:     int(mutableInode.InodePtr),
+		isDir:        mutableInode.Inode.IsDir(),
+		isSymlink:    mutableInode.Inode.IsSymlink(),
+		isInline:     mutableInode.Inode.HasInlineData(),
+		mode:         mutableInode.Inode.Mode,
+		uid:          mutableInode.Inode.Uid,
+		gid:          mutableInode.Inode.Gid,
+		linkCount:    mutableInode.Inode.LinkCount,
+		accessTime:   time.Unix(0, mutableInode.Inode.AccessTime),
+		modTime:      time.Unix(0, mutableInode.Inode.ModifyTime),
+		changeTime:   time.Unix(0, mutableInode.Inode.ChangeTime),
+		creationTime: time.Unix(0, mutableInode.Inode.CreationTime),
+	}
 }
 
 func (fi FileInfo) Name() string {
@@ -18,3 +52,47 @@ func (fi FileInfo) Size() int {
 func (fi FileInfo) IsDir() bool {
 	return fi.isDir
 }
+
+func (fi FileInfo) IsSymlink() bool {
+	return fi.isSymlink
+}
+
+// IsInline reports whether data are stored in the inode instead of clusters
+func (fi FileInfo) IsInline() bool {
+	return fi.isInline
+}
+
+// Mode returns permission bits together with setuid, setgid and sticky bit
+func (fi FileInfo) Mode() uint16 {
+	return fi.mode
+}
+
+func (fi FileInfo) Uid() uint32 {
+	return fi.uid
+}
+
+func (fi FileInfo) Gid() uint32 {
+	return fi.gid
+}
+
+func (fi FileInfo) LinkCount() uint16 {
+	return fi.linkCount
+}
+
+// ModTime returns time of the last modification of file data
+func (fi FileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi FileInfo) AccessTime() time.Time {
+	return fi.accessTime
+}
+
+// ChangeTime returns time of the last change of the inode, including renames
+func (fi FileInfo) ChangeTime() time.Time {
+	return fi.changeTime
+}
+
+func (fi FileInfo) CreationTime() time.Time {
+	return fi.creationTime
+}
@@ -2,166 +2,762 @@ package vfsapi
 
 import (
 	"errors"
+	"fmt"
 	"github.com/PapiCZ/kiv_zos/vfs"
+	"path"
+	"sort"
 )
 
-func FsCheck(fs vfs.Filesystem) error {
-	inodePtrs := make(map[vfs.InodePtr]bool)
-	err := readAllInodePtrsRecursively(fs, fs.RootInodePtr, inodePtrs)
+type FsCheckProblemKind int
+
+const (
+	// Inode is reachable from root directory, but it's free in inode bitmap
+	FreeInodeInUse FsCheckProblemKind = iota
+	// Inode is occupied in inode bitmap, but it isn't reachable from root,
+	// repair reattaches it to lost+found
+	ZombieInode
+	// Cluster is used by inode, but it's free in cluster bitmap
+	FreeClusterInUse
+	// Cluster is occupied in cluster bitmap, but no inode uses it
+	OrphanedCluster
+	// Cluster is used more than once
+	DuplicateCluster
+	// Pointer points behind the last cluster of volume
+	InvalidClusterPtr
+	WrongLinkCount
+	InvalidInlineData
+	CorruptedXattrs
+	// Checksum of superblock, bitmap block, inode or directory cluster
+	// doesn't match, repair computes it again
+	BadChecksum
+	// Superblock or its backup is damaged or differs from the one in use,
+	// repair writes all copies again
+	BadSuperblock
+	// Resize didn't finish, regions of the volume may be moved only partly
+	// and it can't be repaired
+	InterruptedResize
+)
+
+func (k FsCheckProblemKind) String() string {
+	switch k {
+	case FreeInodeInUse:
+		return "inode is used but marked as free"
+	case ZombieInode:
+		return "zombie inode isn't reachable from root"
+	case FreeClusterInUse:
+		return "cluster is used but marked as free"
+	case OrphanedCluster:
+		return "orphaned cluster isn't used by any inode"
+	case DuplicateCluster:
+		return "cluster is used more than once"
+	case InvalidClusterPtr:
+		return "cluster pointer is out of volume"
+	case WrongLinkCount:
+		return "wrong link count"
+	case InvalidInlineData:
+		return "invalid inline data"
+	case CorruptedXattrs:
+		return "corrupted extended attributes"
+	case BadChecksum:
+		return "bad checksum"
+	case BadSuperblock:
+		return "bad copy of superblock"
+	case InterruptedResize:
+		return "resize was interrupted"
+	default:
+		return "unknown problem"
+	}
+}
+
+// LostFoundPath is directory where unreachable inodes are reattached by fsck
+const LostFoundPath = "/lost+found"
+
+// CreateLostFound creates lost+found directory accessible only by its owner
+func CreateLostFound(fs vfs.Filesystem) error {
+	err := Mkdir(fs, LostFoundPath)
 	if err != nil {
 		return err
 	}
 
-	// Check all used inodes
-	inodeBytes := make([]byte, fs.Superblock.InodesStartAddress-fs.Superblock.InodeBitmapStartAddress)
-	err = fs.Volume.ReadBytes(fs.Superblock.InodeBitmapStartAddress, inodeBytes)
+	return Chmod(fs, LostFoundPath, 0700)
+}
+
+// NoInode is used in FsCheckProblem that isn't related to any inode
+const NoInode = vfs.InodePtr(-1)
+
+// FsCheckProblem describes single inconsistency, InodePtr is NoInode and
+// ClusterPtr is vfs.Unused when they aren't related to the problem
+type FsCheckProblem struct {
+	Kind       FsCheckProblemKind
+	InodePtr   vfs.InodePtr
+	ClusterPtr vfs.ClusterPtr
+	Path       string
+	Detail     string
+	Repaired   bool
+}
+
+func (p FsCheckProblem) String() string {
+	s := p.Kind.String()
+	if p.InodePtr != NoInode {
+		s += fmt.Sprintf(", inode %d", p.InodePtr)
+	}
+	if p.ClusterPtr != vfs.Unused {
+		s += fmt.Sprintf(", cluster %d", p.ClusterPtr)
+	}
+	if p.Path != "" {
+		s += fmt.Sprintf(", path %s", p.Path)
+	}
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+
+	return s
+}
+
+type FsCheckReport struct {
+	Problems []FsCheckProblem
+}
+
+// FsCheckFailed is returned by FsCheck when filesystem isn't consistent
+type FsCheckFailed struct {
+	Problems []FsCheckProblem
+}
+
+func (f FsCheckFailed) Error() string {
+	return fmt.Sprintf("filesystem has %d problems, the first one is: %s", len(f.Problems), f.Problems[0])
+}
+
+// FsCheck checks filesystem without repairing it
+func FsCheck(fs vfs.Filesystem) error {
+	report, err := CheckFilesystem(fs, false)
 	if err != nil {
 		return err
 	}
 
-	inodeBitmap := vfs.Bitmap(inodeBytes)
-	for i := vfs.VolumePtr(0); i < vfs.VolumePtr(inodeBitmap.Len()); i++ {
-		value, err := inodeBitmap.GetBit(i)
+	if len(report.Problems) > 0 {
+		return FsCheckFailed{report.Problems}
+	}
+
+	return nil
+}
+
+type checker struct {
+	fs     vfs.Filesystem
+	repair bool
+	// Reachable inodes with path of the first entry pointing to them
+	paths      map[vfs.InodePtr]string
+	linkCounts map[vfs.InodePtr]uint16
+	// Clusters with backup of superblock are used by NoInode
+	usedClusters map[vfs.ClusterPtr]vfs.InodePtr
+	// Inodes with wrong checksum that were already reported
+	badInodes map[vfs.InodePtr]bool
+	report    FsCheckReport
+}
+
+// CheckFilesystem looks for all inconsistencies of the filesystem. Problems
+// that can be fixed are repaired when repair is true.
+func CheckFilesystem(fs vfs.Filesystem, repair bool) (FsCheckReport, error) {
+	c := checker{
+		fs:     fs,
+		repair: repair,
+		// Root is marked as visited, so it isn't walked again through its "." entry
+		paths:        map[vfs.InodePtr]string{fs.RootInodePtr: "/"},
+		linkCounts:   make(map[vfs.InodePtr]uint16),
+		usedClusters: make(map[vfs.ClusterPtr]vfs.InodePtr),
+		badInodes:    make(map[vfs.InodePtr]bool),
+		report:       FsCheckReport{Problems: make([]FsCheckProblem, 0)},
+	}
+
+	err := c.checkSuperblocks()
+	if err != nil {
+		return c.report, err
+	}
+
+	// Bitmaps have to be readable before any of their bits is repaired
+	err = c.checkChecksums()
+	if err != nil {
+		return c.report, err
+	}
+
+	err = c.checkBackupClusters()
+	if err != nil {
+		return c.report, err
+	}
+
+	err = c.walk(fs.RootInodePtr, "/")
+	if err != nil {
+		return c.report, err
+	}
+
+	// Root directory has no entry in parent, but it's linked by the filesystem
+	c.linkCounts[fs.RootInodePtr]++
+
+	err = c.checkInodeBitmap()
+	if err != nil {
+		return c.report, err
+	}
+
+	// Inodes are checked in stable order, so the report is the same every time
+	inodePtrs := make([]vfs.InodePtr, 0, len(c.paths))
+	for inodePtr := range c.paths {
+		inodePtrs = append(inodePtrs, inodePtr)
+	}
+	sort.Slice(inodePtrs, func(i, j int) bool {
+		return inodePtrs[i] < inodePtrs[j]
+	})
+
+	for _, inodePtr := range inodePtrs {
+		err = c.checkInode(inodePtr)
+		if err != nil {
+			return c.report, err
+		}
+	}
+
+	err = c.checkClusterBitmap()
+	if err != nil {
+		return c.report, err
+	}
+
+	return c.report, nil
+}
+
+func (c *checker) addProblem(problem FsCheckProblem, repair func() error) error {
+	if c.repair && repair != nil {
+		err := repair()
+		if err != nil {
+			return err
+		}
+		problem.Repaired = true
+	}
+
+	c.report.Problems = append(c.report.Problems, problem)
+
+	return nil
+}
+
+// checkSuperblocks compares superblock and its backups on volume with the
+// superblock filesystem was loaded with, it may come from a backup
+func (c *checker) checkSuperblocks() error {
+	if c.fs.Superblock.State == vfs.StateResizing {
+		err := c.addProblem(FsCheckProblem{
+			Kind:       InterruptedResize,
+			InodePtr:   NoInode,
+			ClusterPtr: vfs.Unused,
+			Detail:     "volume should be restored from a copy",
+		}, nil)
 		if err != nil {
 			return err
 		}
+	}
+
+	for _, address := range append([]vfs.VolumePtr{0}, c.fs.Superblock.BackupAddresses()...) {
+		problem := FsCheckProblem{
+			Kind:       BadSuperblock,
+			InodePtr:   NoInode,
+			ClusterPtr: vfs.Unused,
+		}
 
-		_, ok := inodePtrs[vfs.InodePtr(i)]
-		if value == 0 && ok {
-			return errors.New("inode is actively used by filesystem, but it should be free")
-		} else if value == 1 && !ok {
-			return errors.New("found zombie inode that isn't used by filesystem")
+		sb, err := vfs.ReadSuperblockAt(c.fs.Volume, address)
+		if mismatch, ok := err.(vfs.SuperblockChecksumMismatch); ok && address == 0 {
+			problem.Kind = BadChecksum
+			problem.Detail = mismatch.Error()
+		} else if err != nil {
+			problem.Detail = fmt.Sprintf("copy at address %d can't be read: %s", address, err)
+		} else if sb != c.fs.Superblock {
+			problem.Detail = fmt.Sprintf("copy at address %d differs from superblock in use", address)
+		} else {
+			continue
+		}
+
+		err = c.addProblem(problem, c.fs.WriteSuperblock)
+		if err != nil {
+			return err
 		}
 	}
 
-	// Check all used data clusters
-	clusterBytes := make([]byte, fs.Superblock.InodeBitmapStartAddress-fs.Superblock.ClusterBitmapStartAddress)
-	err = fs.Volume.ReadBytes(fs.Superblock.ClusterBitmapStartAddress, clusterBytes)
+	return nil
+}
+
+// checkChecksums checks blocks of bitmaps
+func (c *checker) checkChecksums() error {
+	mismatches, err := vfs.VerifyBitmapChecksums(c.fs.Volume, c.fs.Superblock)
 	if err != nil {
 		return err
 	}
 
-	clusterBitmap := vfs.Bitmap(clusterBytes)
-	for inodePtr, _ := range inodePtrs {
-		mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, inodePtr)
+	for _, mismatch := range mismatches {
+		err = c.addProblem(FsCheckProblem{
+			Kind:       BadChecksum,
+			InodePtr:   NoInode,
+			ClusterPtr: vfs.Unused,
+			Detail:     mismatch.Error(),
+		}, func() error {
+			// Wrong bits are found by following checks
+			return vfs.UpdateBitmapChecksums(c.fs.Volume, c.fs.Superblock)
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		directPtrs, indirect1Ptrs, indirect2Ptrs, err := mutableInode.Inode.GetUsedPtrs(fs.Volume, fs.Superblock)
-		if err != nil {
+	return nil
+}
+
+// checkBackupClusters marks clusters with backup of superblock as used
+func (c *checker) checkBackupClusters() error {
+	for _, clusterPtr := range vfs.BackupSuperblockClusters(c.fs.Superblock) {
+		c.usedClusters[clusterPtr] = NoInode
+
+		isFree, err := vfs.IsClusterFree(c.fs.Volume, c.fs.Superblock, clusterPtr)
+		if _, ok := err.(vfs.BitmapChecksumMismatch); ok {
+			// Damaged bitmap block was already reported
+			continue
+		} else if err != nil {
 			return err
 		}
 
-		// Check direct pointers
-		for _, directPtr := range directPtrs {
-			value, err := clusterBitmap.GetBit(vfs.VolumePtr(directPtr))
+		if isFree {
+			err = c.addProblem(FsCheckProblem{
+				Kind:       FreeClusterInUse,
+				InodePtr:   NoInode,
+				ClusterPtr: clusterPtr,
+				Detail:     "it holds backup of superblock",
+			}, func() error {
+				return vfs.OccupyCluster(c.fs.Volume, c.fs.Superblock, clusterPtr)
+			})
 			if err != nil {
 				return err
 			}
+		}
+	}
 
-			if value != 1 {
-				return errors.New("data cluster should be free but it's used by inode")
-			}
+	return nil
+}
+
+// loadInode loads inode even when its checksum doesn't match, the mismatch is
+// reported only once
+func (c *checker) loadInode(inodePtr vfs.InodePtr) (vfs.MutableInode, error) {
+	mutableInode, err := vfs.LoadMutableInode(c.fs.Volume, c.fs.Superblock, inodePtr)
+	if mismatch, ok := err.(vfs.InodeChecksumMismatch); ok {
+		if c.badInodes[inodePtr] {
+			return mutableInode, nil
 		}
+		c.badInodes[inodePtr] = true
 
-		// Check indirect1 pointers
-		for k, singlePtrTable := range indirect1Ptrs {
-			if k == vfs.Unused {
-				break
-			}
+		err = c.addProblem(FsCheckProblem{
+			Kind:       BadChecksum,
+			InodePtr:   inodePtr,
+			ClusterPtr: vfs.Unused,
+			Path:       c.paths[inodePtr],
+			Detail:     mismatch.Error(),
+		}, func() error {
+			return mutableInode.Save(c.fs.Volume, c.fs.Superblock)
+		})
+	}
+
+	return mutableInode, err
+}
+
+func (c *checker) walk(inodePtr vfs.InodePtr, dirPath string) error {
+	parentMutableInode, err := c.loadInode(inodePtr)
+	if err != nil {
+		return err
+	}
+
+	directoryEntries, err := vfs.ReadAllDirectoryEntries(c.fs.Volume, c.fs.Superblock, *parentMutableInode.Inode)
+	if mismatch, ok := err.(vfs.ClusterChecksumMismatch); ok {
+		err = c.addProblem(FsCheckProblem{
+			Kind:       BadChecksum,
+			InodePtr:   inodePtr,
+			ClusterPtr: mismatch.ClusterPtr,
+			Path:       dirPath,
+			Detail:     mismatch.Error(),
+		}, func() error {
+			return vfs.UpdateDataChecksums(c.fs.Volume, c.fs.Superblock, *parentMutableInode.Inode)
+		})
+		if err != nil {
+			return err
+		}
+
+		if !c.repair {
+			// Entries of the directory can't be trusted
+			return nil
+		}
+
+		directoryEntries, err = vfs.ReadAllDirectoryEntries(c.fs.Volume, c.fs.Superblock, *parentMutableInode.Inode)
+	}
+	if err != nil {
+		return err
+	}
 
-			value, err := clusterBitmap.GetBit(vfs.VolumePtr(k))
+	for _, directoryEntry := range directoryEntries {
+		name := string(directoryEntry.NameBytes())
+		if name != "." && name != ".." {
+			c.linkCounts[directoryEntry.InodePtr]++
+		}
+
+		_, ok := c.paths[directoryEntry.InodePtr]
+		if ok {
+			// We already visited this inode, let's skip it
+			continue
+		}
+
+		entryPath := path.Join(dirPath, name)
+		c.paths[directoryEntry.InodePtr] = entryPath
+
+		// Check if directory entry is directory
+		mutableInode, err := c.loadInode(directoryEntry.InodePtr)
+		if err != nil {
+			return err
+		}
+
+		if mutableInode.Inode.IsDir() {
+			err = c.walk(directoryEntry.InodePtr, entryPath)
 			if err != nil {
 				return err
 			}
+		}
+	}
 
-			if value != 1 {
-				return errors.New("data cluster should be free but it's used by inode")
-			}
+	return nil
+}
 
-			for _, dataPtr := range singlePtrTable {
-				value, err := clusterBitmap.GetBit(vfs.VolumePtr(dataPtr))
-				if err != nil {
-					return err
-				}
+func (c *checker) checkInodeBitmap() error {
+	sb := c.fs.Superblock
+	inodeBytes := make([]byte, sb.InodesStartAddress-sb.InodeBitmapStartAddress)
+	err := c.fs.Volume.ReadBytes(sb.InodeBitmapStartAddress, inodeBytes)
+	if err != nil {
+		return err
+	}
 
-				if value != 1 {
-					return errors.New("data cluster should be free but it's used by inode")
-				}
-			}
+	inodeBitmap := vfs.Bitmap(inodeBytes)
+	zombies := make([]vfs.InodePtr, 0)
+	for i := vfs.VolumePtr(0); i < vfs.VolumePtr(inodeBitmap.Len()); i++ {
+		value, err := inodeBitmap.GetBit(i)
+		if err != nil {
+			return err
 		}
 
-		// Check indirect2 pointers
-		for k, doublePtrTable := range indirect2Ptrs {
-			if k == vfs.Unused {
-				break
-			}
+		inodePtr := vfs.InodePtr(i)
+		inodePath, ok := c.paths[inodePtr]
+		if value == vfs.Free && ok {
+			err = c.addProblem(FsCheckProblem{
+				Kind:       FreeInodeInUse,
+				InodePtr:   inodePtr,
+				ClusterPtr: vfs.Unused,
+				Path:       inodePath,
+			}, func() error {
+				return vfs.OccupyInode(c.fs.Volume, sb, inodePtr)
+			})
+		} else if value == vfs.Occupied && !ok {
+			zombies = append(zombies, inodePtr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.reattachZombies(zombies)
+}
 
-			value, err := clusterBitmap.GetBit(vfs.VolumePtr(k))
+// reattachZombies links unreachable inodes to lost+found, empty files are
+// freed instead
+func (c *checker) reattachZombies(zombies []vfs.InodePtr) error {
+	if !c.repair {
+		// Clusters of zombie inodes are reported as orphaned later
+		for _, inodePtr := range zombies {
+			err := c.addProblem(FsCheckProblem{
+				Kind:       ZombieInode,
+				InodePtr:   inodePtr,
+				ClusterPtr: vfs.Unused,
+			}, nil)
 			if err != nil {
 				return err
 			}
+		}
 
-			if value != 1 {
-				return errors.New("data cluster should be free but it's used by inode")
-			}
+		return nil
+	}
+
+	// Zombies linked from zombie directories are reattached together with
+	// them, so they go last
+	linked := make(map[vfs.InodePtr]bool)
+	for _, inodePtr := range zombies {
+		mutableInode, err := c.loadInode(inodePtr)
+		if err != nil {
+			return err
+		}
 
-			for k2, singlePtrTable := range doublePtrTable {
-				value, err := clusterBitmap.GetBit(vfs.VolumePtr(k2))
-				if err != nil {
-					return err
-				}
-
-				if value != 1 {
-					return errors.New("data cluster should be free but it's used by inode")
-				}
-
-				for _, dataPtr := range singlePtrTable {
-					value, err := clusterBitmap.GetBit(vfs.VolumePtr(dataPtr))
-					if err != nil {
-						return err
-					}
-
-					if value != 1 {
-						return errors.New("data cluster should be free but it's used by inode")
-					}
-				}
+		if !mutableInode.Inode.IsDir() {
+			continue
+		}
+
+		directoryEntries, err := vfs.ReadAllDirectoryEntries(c.fs.Volume, c.fs.Superblock, *mutableInode.Inode)
+		if _, ok := err.(vfs.ClusterChecksumMismatch); ok {
+			// Checksum is repaired when the directory is walked
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, directoryEntry := range directoryEntries {
+			name := string(directoryEntry.NameBytes())
+			if name != "." && name != ".." {
+				linked[directoryEntry.InodePtr] = true
 			}
 		}
 	}
 
+	sortedZombies := make([]vfs.InodePtr, 0, len(zombies))
+	for _, inodePtr := range zombies {
+		if !linked[inodePtr] {
+			sortedZombies = append(sortedZombies, inodePtr)
+		}
+	}
+	for _, inodePtr := range zombies {
+		if linked[inodePtr] {
+			sortedZombies = append(sortedZombies, inodePtr)
+		}
+	}
+
+	for _, inodePtr := range sortedZombies {
+		problem := FsCheckProblem{
+			Kind:       ZombieInode,
+			InodePtr:   inodePtr,
+			ClusterPtr: vfs.Unused,
+		}
+
+		if inodePath, ok := c.paths[inodePtr]; ok {
+			problem.Path = inodePath
+			problem.Detail = "reattached together with parent directory"
+			problem.Repaired = true
+			c.report.Problems = append(c.report.Problems, problem)
+			continue
+		}
+
+		mutableInode, err := c.loadInode(inodePtr)
+		if err != nil {
+			return err
+		}
+
+		xattrs, err := mutableInode.ReadXattrs(c.fs.Volume, c.fs.Superblock)
+		if err == nil && len(xattrs) == 0 && !mutableInode.Inode.IsDir() && mutableInode.Inode.Size == 0 {
+			// There is nothing to save in empty file
+			problem.Detail = "empty inode was freed"
+			err = c.addProblem(problem, func() error {
+				return vfs.FreeInode(c.fs.Volume, c.fs.Superblock, inodePtr)
+			})
+		} else {
+			inodePath := path.Join(LostFoundPath, fmt.Sprintf("#%d", inodePtr))
+			problem.Path = inodePath
+			problem.Detail = "reattached to lost+found"
+			err = c.addProblem(problem, func() error {
+				return c.reattach(mutableInode, inodePath)
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func readAllInodePtrsRecursively(fs vfs.Filesystem, inodePtr vfs.InodePtr, out map[vfs.InodePtr]bool) error {
-	parentMutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, inodePtr)
+func (c *checker) reattach(mutableInode vfs.MutableInode, inodePath string) error {
+	lostFound, err := c.lostFound()
 	if err != nil {
 		return err
 	}
 
-	directoryEntries, err := vfs.ReadAllDirectoryEntries(fs.Volume, fs.Superblock, *parentMutableInode.Inode)
+	err = vfs.AppendDirectoryEntries(c.fs.Volume, c.fs.Superblock, c.fs.Identity, lostFound,
+		vfs.NewDirectoryEntry(path.Base(inodePath), mutableInode.InodePtr))
 	if err != nil {
 		return err
 	}
+	c.paths[mutableInode.InodePtr] = inodePath
+	c.linkCounts[mutableInode.InodePtr]++
 
-	for _, directoryEntry := range directoryEntries {
-		_, ok := out[directoryEntry.InodePtr]
-		if ok {
-			// We already have this inode pointer in map, let's skip it
-			continue
+	if !mutableInode.Inode.IsDir() {
+		return nil
+	}
+
+	// Fix parent of reattached directory
+	_, err = vfs.RemoveDirectoryEntry(c.fs.Volume, c.fs.Superblock, c.fs.Identity, mutableInode, "..")
+	if _, ok := err.(vfs.DirectoryEntryNotFound); err != nil && !ok {
+		return err
+	}
+
+	err = vfs.AppendDirectoryEntries(c.fs.Volume, c.fs.Superblock, c.fs.Identity, mutableInode,
+		vfs.NewDirectoryEntry("..", lostFound.InodePtr))
+	if err != nil {
+		return err
+	}
+
+	// Content of directory is reachable now
+	return c.walk(mutableInode.InodePtr, inodePath)
+}
+
+// lostFound returns lost+found directory, it's created when it's missing
+func (c *checker) lostFound() (vfs.MutableInode, error) {
+	mutableInode, err := getInodeByPathRecursivelyNoFollow(c.fs, LostFoundPath)
+	if _, ok := err.(vfs.DirectoryEntryNotFound); ok {
+		err = CreateLostFound(c.fs)
+		if err != nil {
+			return vfs.MutableInode{}, err
 		}
 
-		out[directoryEntry.InodePtr] = true
+		mutableInode, err = getInodeByPathRecursivelyNoFollow(c.fs, LostFoundPath)
+		if err != nil {
+			return vfs.MutableInode{}, err
+		}
 
-		// Check if directory entry is directory
-		mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, directoryEntry.InodePtr)
+		c.paths[mutableInode.InodePtr] = LostFoundPath
+		c.linkCounts[mutableInode.InodePtr]++
+	}
+	if err != nil {
+		return vfs.MutableInode{}, err
+	}
+
+	if !mutableInode.Inode.IsDir() {
+		return vfs.MutableInode{}, errors.New(LostFoundPath + " isn't a directory")
+	}
+
+	return mutableInode, nil
+}
+
+func (c *checker) checkInode(inodePtr vfs.InodePtr) error {
+	mutableInode, err := c.loadInode(inodePtr)
+	if err != nil {
+		return err
+	}
+	inode := mutableInode.Inode
+	inodePath := c.paths[inodePtr]
+
+	if inode.LinkCount != c.linkCounts[inodePtr] {
+		linkCount := c.linkCounts[inodePtr]
+		err = c.addProblem(FsCheckProblem{
+			Kind:       WrongLinkCount,
+			InodePtr:   inodePtr,
+			ClusterPtr: vfs.Unused,
+			Path:       inodePath,
+			Detail:     fmt.Sprintf("link count is %d, but %d directory entries point to it", inode.LinkCount, linkCount),
+		}, func() error {
+			inode.LinkCount = linkCount
+			return mutableInode.Save(c.fs.Volume, c.fs.Superblock)
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		if mutableInode.Inode.IsDir() {
-			err = readAllInodePtrsRecursively(fs, directoryEntry.InodePtr, out)
+	if inode.HasInlineData() && (inode.Size > vfs.InodeInlineDataSize || inode.AllocatedClusters != 0) {
+		err = c.addProblem(FsCheckProblem{
+			Kind:       InvalidInlineData,
+			InodePtr:   inodePtr,
+			ClusterPtr: vfs.Unused,
+			Path:       inodePath,
+			Detail:     fmt.Sprintf("size is %d and %d clusters are allocated", inode.Size, inode.AllocatedClusters),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = mutableInode.ReadXattrs(c.fs.Volume, c.fs.Superblock)
+	if err != nil {
+		err = c.addProblem(FsCheckProblem{
+			Kind:       CorruptedXattrs,
+			InodePtr:   inodePtr,
+			ClusterPtr: vfs.Unused,
+			Path:       inodePath,
+			Detail:     err.Error(),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	clusterPtrs, err := inodeClusterPtrs(c.fs, *inode)
+	if err != nil {
+		return err
+	}
+
+	for _, clusterPtr := range clusterPtrs {
+		err = c.checkUsedCluster(inodePtr, inodePath, clusterPtr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkUsedCluster checks cluster used by inode
+func (c *checker) checkUsedCluster(inodePtr vfs.InodePtr, inodePath string, clusterPtr vfs.ClusterPtr) error {
+	problem := FsCheckProblem{
+		InodePtr:   inodePtr,
+		ClusterPtr: clusterPtr,
+		Path:       inodePath,
+	}
+
+	if clusterPtr < 0 || clusterPtr >= c.fs.Superblock.ClusterCount {
+		problem.Kind = InvalidClusterPtr
+		return c.addProblem(problem, nil)
+	}
+
+	if otherInodePtr, ok := c.usedClusters[clusterPtr]; ok {
+		problem.Kind = DuplicateCluster
+		problem.Detail = fmt.Sprintf("it's used by inode %d too", otherInodePtr)
+		if otherInodePtr == NoInode {
+			problem.Detail = "it holds backup of superblock"
+		}
+		return c.addProblem(problem, nil)
+	}
+	c.usedClusters[clusterPtr] = inodePtr
+
+	isFree, err := vfs.IsClusterFree(c.fs.Volume, c.fs.Superblock, clusterPtr)
+	if err != nil {
+		return err
+	}
+
+	if isFree {
+		problem.Kind = FreeClusterInUse
+		return c.addProblem(problem, func() error {
+			return vfs.OccupyCluster(c.fs.Volume, c.fs.Superblock, clusterPtr)
+		})
+	}
+
+	return nil
+}
+
+func (c *checker) checkClusterBitmap() error {
+	sb := c.fs.Superblock
+	clusterBytes := make([]byte, vfs.NeededMemoryForBitmap(vfs.VolumePtr(sb.ClusterCount)))
+	err := c.fs.Volume.ReadBytes(sb.ClusterBitmapStartAddress, clusterBytes)
+	if err != nil {
+		return err
+	}
+
+	clusterBitmap := vfs.Bitmap(clusterBytes)
+	for i := vfs.VolumePtr(0); i < vfs.VolumePtr(sb.ClusterCount); i++ {
+		value, err := clusterBitmap.GetBit(i)
+		if err != nil {
+			return err
+		}
+
+		clusterPtr := vfs.ClusterPtr(i)
+		if _, ok := c.usedClusters[clusterPtr]; value == vfs.Occupied && !ok {
+			err = c.addProblem(FsCheckProblem{
+				Kind:       OrphanedCluster,
+				InodePtr:   NoInode,
+				ClusterPtr: clusterPtr,
+			}, func() error {
+				return vfs.FreeCluster(c.fs.Volume, sb, clusterPtr)
+			})
 			if err != nil {
 				return err
 			}
@@ -170,3 +766,62 @@ func readAllInodePtrsRecursively(fs vfs.Filesystem, inodePtr vfs.InodePtr, out m
 
 	return nil
 }
+
+// inodeClusterPtrs returns all clusters used by inode including pointer
+// tables, extent leaves, directory index and extended attributes
+func inodeClusterPtrs(fs vfs.Filesystem, inode vfs.Inode) ([]vfs.ClusterPtr, error) {
+	directPtrs, indirect1Ptrs, indirect2Ptrs, indirect3Ptrs, err := inode.GetUsedPtrs(fs.Volume, fs.Superblock)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterPtrs := append([]vfs.ClusterPtr{}, directPtrs...)
+	for k, singlePtrTable := range indirect1Ptrs {
+		clusterPtrs = append(clusterPtrs, k)
+		clusterPtrs = append(clusterPtrs, singlePtrTable...)
+	}
+
+	for k, doublePtrTable := range indirect2Ptrs {
+		clusterPtrs = append(clusterPtrs, k)
+		for k2, singlePtrTable := range doublePtrTable {
+			clusterPtrs = append(clusterPtrs, k2)
+			clusterPtrs = append(clusterPtrs, singlePtrTable...)
+		}
+	}
+
+	for k, triplePtrTable := range indirect3Ptrs {
+		clusterPtrs = append(clusterPtrs, k)
+		for k2, doublePtrTable := range triplePtrTable {
+			clusterPtrs = append(clusterPtrs, k2)
+			for k3, singlePtrTable := range doublePtrTable {
+				clusterPtrs = append(clusterPtrs, k3)
+				clusterPtrs = append(clusterPtrs, singlePtrTable...)
+			}
+		}
+	}
+
+	indexPtrs, err := inode.GetDirectoryIndexPtrs(fs.Volume, fs.Superblock)
+	if err != nil {
+		return nil, err
+	}
+	clusterPtrs = append(clusterPtrs, indexPtrs...)
+
+	if inode.XattrCluster != vfs.Unused {
+		clusterPtrs = append(clusterPtrs, inode.XattrCluster)
+	}
+
+	// Unused pointers of unallocated tables aren't clusters
+	usedClusterPtrs := make([]vfs.ClusterPtr, 0, len(clusterPtrs))
+	for _, clusterPtr := range clusterPtrs {
+		if clusterPtr != vfs.Unused {
+			usedClusterPtrs = append(usedClusterPtrs, clusterPtr)
+		}
+	}
+
+	// Maps are iterated in random order
+	sort.Slice(usedClusterPtrs, func(i, j int) bool {
+		return usedClusterPtrs[i] < usedClusterPtrs[j]
+	})
+
+	return usedClusterPtrs, nil
+}
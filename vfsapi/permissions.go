@@ -0,0 +1,51 @@
+package vfsapi
+
+import (
+	"github.com/PapiCZ/kiv_zos/vfs"
+)
+
+func checkAccess(fs vfs.Filesystem, mutableInode vfs.MutableInode, permissions uint16, path string) error {
+	if !mutableInode.Inode.CanAccess(fs.Identity, permissions) {
+		return vfs.PermissionDenied{Name: path}
+	}
+
+	return nil
+}
+
+func Chmod(fs vfs.Filesystem, path string, mode uint16) error {
+	mutableInode, err := getInodeByPathRecursively(fs, path)
+	if err != nil {
+		return err
+	}
+
+	if !fs.Identity.IsRoot() && fs.Identity.Uid != mutableInode.Inode.Uid {
+		return vfs.PermissionDenied{Name: path}
+	}
+
+	mutableInode.Inode.Mode = mode & vfs.ModeMask
+	mutableInode.Inode.TouchChange()
+
+	return mutableInode.Save(fs.Volume, fs.Superblock)
+}
+
+// Chown changes owner and group of the file, only root is allowed to do that.
+func Chown(fs vfs.Filesystem, path string, uid, gid uint32) error {
+	mutableInode, err := getInodeByPathRecursively(fs, path)
+	if err != nil {
+		return err
+	}
+
+	if !fs.Identity.IsRoot() {
+		return vfs.PermissionDenied{Name: path}
+	}
+
+	mutableInode.Inode.Uid = uid
+	mutableInode.Inode.Gid = gid
+	if !mutableInode.Inode.IsDir() {
+		// Don't let the new owner run code with privileges of the old one
+		mutableInode.Inode.Mode &^= vfs.ModeSetuid | vfs.ModeSetgid
+	}
+	mutableInode.Inode.TouchChange()
+
+	return mutableInode.Save(fs.Volume, fs.Superblock)
+}
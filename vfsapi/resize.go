@@ -0,0 +1,15 @@
+package vfsapi
+
+import (
+	"github.com/PapiCZ/kiv_zos/vfs"
+)
+
+// Resize grows or shrinks filesystem together with its volume, only root is
+// allowed to do that
+func Resize(fs *vfs.Filesystem, size vfs.VolumePtr) error {
+	if !fs.Identity.IsRoot() {
+		return vfs.PermissionDenied{Name: "/"}
+	}
+
+	return vfs.Resize(fs, size)
+}
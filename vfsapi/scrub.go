@@ -0,0 +1,347 @@
+package vfsapi
+
+import (
+	"fmt"
+	"github.com/PapiCZ/kiv_zos/vfs"
+	"path"
+	"sort"
+	"sync"
+)
+
+// Scrub reads clusters that have checksums, those are clusters of directories
+// and, with vfs.FeatureDataChecksums, clusters of files. Pointer tables,
+// extent leaves, directory index nodes and clusters with extended attributes
+// have no checksums, they are only counted as unchecked. Backups of
+// superblock are verified by fsck.
+
+// scrubBatchSize is number of clusters verified while the lock is held
+const scrubBatchSize = 64
+
+// CorruptedCluster is data cluster whose content doesn't match its checksum
+type CorruptedCluster struct {
+	ClusterPtr vfs.ClusterPtr
+	InodePtr   vfs.InodePtr
+	// Path of the first entry pointing to the inode, empty when the inode
+	// isn't reachable from root
+	Path string
+}
+
+func (c CorruptedCluster) String() string {
+	if c.Path == "" {
+		return fmt.Sprintf("cluster %d of unreachable inode %d is corrupted", c.ClusterPtr, c.InodePtr)
+	}
+
+	return fmt.Sprintf("cluster %d of %s is corrupted", c.ClusterPtr, c.Path)
+}
+
+type ScrubReport struct {
+	// Clusters whose checksum was verified, holes aren't counted
+	CheckedClusters vfs.ClusterPtr
+	// Clusters used by inodes that have no checksum
+	UncheckedClusters vfs.ClusterPtr
+	Corrupted         []CorruptedCluster
+}
+
+// ScrubProgress is called after every verified batch of clusters, total is
+// number of clusters with checksum found when the scrub started
+type ScrubProgress func(checked, total vfs.ClusterPtr)
+
+type ScrubCanceled struct{}
+
+func (s ScrubCanceled) Error() string {
+	return "scrub was canceled"
+}
+
+// ScrubStatus describes progress of BackgroundScrub
+type ScrubStatus struct {
+	CheckedClusters vfs.ClusterPtr
+	TotalClusters   vfs.ClusterPtr
+	Running         bool
+}
+
+// BackgroundScrub verifies clusters in its own goroutine. The filesystem is
+// used only while lock is held, so everything else that uses the filesystem
+// has to hold the lock too.
+type BackgroundScrub struct {
+	cancel     chan struct{}
+	cancelOnce sync.Once
+	done       chan struct{}
+
+	mutex  sync.Mutex
+	status ScrubStatus
+	report ScrubReport
+	err    error
+}
+
+// StartScrub starts scrub of filesystem that can be changed while it's running
+func StartScrub(fs *vfs.Filesystem, lock sync.Locker) *BackgroundScrub {
+	s := &BackgroundScrub{
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+		status: ScrubStatus{Running: true},
+	}
+
+	go func() {
+		report, err := scrub(fs, lock, s.cancel, func(checked, total vfs.ClusterPtr) {
+			s.mutex.Lock()
+			s.status.CheckedClusters = checked
+			s.status.TotalClusters = total
+			s.mutex.Unlock()
+		})
+
+		s.mutex.Lock()
+		s.status.Running = false
+		s.report = report
+		s.err = err
+		s.mutex.Unlock()
+
+		close(s.done)
+	}()
+
+	return s
+}
+
+func (s *BackgroundScrub) Status() ScrubStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.status
+}
+
+// Cancel stops the scrub after the current batch, Wait returns ScrubCanceled
+// together with clusters verified until then
+func (s *BackgroundScrub) Cancel() {
+	s.cancelOnce.Do(func() {
+		close(s.cancel)
+	})
+}
+
+// Wait blocks until the scrub finishes, the lock must not be held
+func (s *BackgroundScrub) Wait() (ScrubReport, error) {
+	<-s.done
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.report, s.err
+}
+
+// Scrub verifies all clusters with checksum and reports the corrupted ones
+// together with paths of affected files
+func Scrub(fs vfs.Filesystem, progress ScrubProgress) (ScrubReport, error) {
+	return scrub(&fs, &sync.Mutex{}, nil, progress)
+}
+
+func scrub(fs *vfs.Filesystem, lock sync.Locker, cancel <-chan struct{}, progress ScrubProgress) (ScrubReport, error) {
+	report := ScrubReport{Corrupted: make([]CorruptedCluster, 0)}
+
+	lock.Lock()
+	paths, inodePtrs, total, err := planScrub(*fs, &report)
+	lock.Unlock()
+	if err != nil {
+		return report, err
+	}
+
+	for _, inodePtr := range inodePtrs {
+		for start := vfs.ClusterPtr(0); ; start += scrubBatchSize {
+			select {
+			case <-cancel:
+				return report, ScrubCanceled{}
+			default:
+			}
+
+			lock.Lock()
+			more, err := scrubBatch(*fs, inodePtr, start, paths, &report)
+			lock.Unlock()
+			if err != nil {
+				return report, err
+			}
+
+			if progress != nil {
+				progress(report.CheckedClusters, total)
+			}
+
+			if !more {
+				break
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// planScrub finds paths of inodes, inodes with checksums and number of their
+// clusters, clusters without checksum are counted to the report
+func planScrub(fs vfs.Filesystem, report *ScrubReport) (map[vfs.InodePtr]string, []vfs.InodePtr, vfs.ClusterPtr, error) {
+	paths := map[vfs.InodePtr]string{fs.RootInodePtr: "/"}
+	err := scrubWalk(fs, fs.RootInodePtr, "/", paths)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	inodes, err := loadUsedInodes(fs)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	inodePtrs := make([]vfs.InodePtr, 0, len(inodes))
+	total := vfs.ClusterPtr(0)
+	for inodePtr, inode := range inodes {
+		clusterPtrs, err := inodeClusterPtrs(fs, inode)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		checked := vfs.ClusterPtr(0)
+		if inode.HasClusterChecksums(fs.Superblock) {
+			for index := vfs.ClusterPtr(0); index < inode.AllocatedClusters; index++ {
+				ptr, err := inode.ResolveDataClusterAddress(fs.Volume, fs.Superblock, index)
+				if err != nil {
+					return nil, nil, 0, err
+				}
+				if ptr != vfs.Unused {
+					checked++
+				}
+			}
+
+			inodePtrs = append(inodePtrs, inodePtr)
+		}
+
+		total += checked
+		report.UncheckedClusters += vfs.ClusterPtr(len(clusterPtrs)) - checked
+	}
+
+	sort.Slice(inodePtrs, func(i, j int) bool {
+		return inodePtrs[i] < inodePtrs[j]
+	})
+
+	return paths, inodePtrs, total, nil
+}
+
+// scrubBatch verifies data clusters of the inode starting at given index, the
+// inode is loaded again because it may have changed since the last batch. It
+// returns false when there are no more clusters.
+func scrubBatch(fs vfs.Filesystem, inodePtr vfs.InodePtr, start vfs.ClusterPtr, paths map[vfs.InodePtr]string, report *ScrubReport) (bool, error) {
+	isFree, err := vfs.IsInodeFree(fs.Volume, fs.Superblock, inodePtr)
+	if err != nil || isFree {
+		return false, err
+	}
+
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, inodePtr)
+	if _, ok := err.(vfs.InodeChecksumMismatch); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	inode := *mutableInode.Inode
+	if !inode.HasClusterChecksums(fs.Superblock) {
+		return false, nil
+	}
+
+	end := start + scrubBatchSize
+	if end > inode.AllocatedClusters {
+		end = inode.AllocatedClusters
+	}
+
+	for index := start; index < end; index++ {
+		ptr, err := inode.ResolveDataClusterAddress(fs.Volume, fs.Superblock, index)
+		if err != nil {
+			return false, err
+		}
+		if ptr == vfs.Unused {
+			continue
+		}
+
+		err = vfs.VerifyClusterChecksum(fs.Volume, fs.Superblock, ptr)
+		if _, ok := err.(vfs.ClusterChecksumMismatch); ok {
+			report.Corrupted = append(report.Corrupted, CorruptedCluster{
+				ClusterPtr: ptr,
+				InodePtr:   inodePtr,
+				Path:       paths[inodePtr],
+			})
+		} else if err != nil {
+			return false, err
+		}
+
+		report.CheckedClusters++
+	}
+
+	return end < inode.AllocatedClusters, nil
+}
+
+// scrubWalk finds paths of reachable inodes, directories with corrupted
+// clusters or inodes aren't entered
+func scrubWalk(fs vfs.Filesystem, inodePtr vfs.InodePtr, dirPath string, paths map[vfs.InodePtr]string) error {
+	mutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, inodePtr)
+	if _, ok := err.(vfs.InodeChecksumMismatch); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	directoryEntries, err := vfs.ReadAllDirectoryEntries(fs.Volume, fs.Superblock, *mutableInode.Inode)
+	if _, ok := err.(vfs.ClusterChecksumMismatch); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, directoryEntry := range directoryEntries {
+		if _, ok := paths[directoryEntry.InodePtr]; ok {
+			continue
+		}
+
+		entryPath := path.Join(dirPath, string(directoryEntry.NameBytes()))
+		paths[directoryEntry.InodePtr] = entryPath
+
+		entryMutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, directoryEntry.InodePtr)
+		if _, ok := err.(vfs.InodeChecksumMismatch); ok {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if entryMutableInode.Inode.IsDir() {
+			err = scrubWalk(fs, directoryEntry.InodePtr, entryPath, paths)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadUsedInodes loads all inodes that are marked as used in the bitmap,
+// inodes with wrong checksum are left out
+func loadUsedInodes(fs vfs.Filesystem) (map[vfs.InodePtr]vfs.Inode, error) {
+	sb := fs.Superblock
+	inodeBytes := make([]byte, sb.InodesStartAddress-sb.InodeBitmapStartAddress)
+	err := fs.Volume.ReadBytes(sb.InodeBitmapStartAddress, inodeBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	inodes := make(map[vfs.InodePtr]vfs.Inode)
+	inodeBitmap := vfs.Bitmap(inodeBytes)
+	for i := vfs.VolumePtr(0); i < vfs.VolumePtr(inodeBitmap.Len()); i++ {
+		value, err := inodeBitmap.GetBit(i)
+		if err != nil {
+			return nil, err
+		}
+		if value == vfs.Free {
+			continue
+		}
+
+		mutableInode, err := vfs.LoadMutableInode(fs.Volume, sb, vfs.InodePtr(i))
+		if _, ok := err.(vfs.InodeChecksumMismatch); ok {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		inodes[vfs.InodePtr(i)] = *mutableInode.Inode
+	}
+
+	return inodes, nil
+}
@@ -0,0 +1,90 @@
+package vfsapi
+
+import (
+	"github.com/PapiCZ/kiv_zos/vfs"
+)
+
+// Symlink creates symbolic link linkPath pointing to target. Target doesn't
+// have to exist.
+func Symlink(fs vfs.Filesystem, target, linkPath string) error {
+	pathFragments := splitString(linkPath, "/")
+	parentPath := pathFragments[:len(pathFragments)-1]
+	name := pathFragments[len(pathFragments)-1]
+
+	err := vfs.ValidateName(fs.Superblock, name)
+	if err != nil {
+		return err
+	}
+
+	parentMutableInode, err := getInodeByPathRecursively(fs, joinString(parentPath, "/"))
+	if err != nil {
+		return err
+	}
+
+	err = checkAccess(fs, parentMutableInode, vfs.PermissionWrite|vfs.PermissionExecute, linkPath)
+	if err != nil {
+		return err
+	}
+
+	// Check for duplicate entry
+	_, _, err = vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, *parentMutableInode.Inode, name)
+	if err == nil {
+		return vfs.DuplicateDirectoryEntry{}
+	}
+
+	tx := vfs.BeginTransaction(fs.Volume, fs.Superblock)
+	vo, err := vfs.FindFreeInode(tx, fs.Superblock, true)
+	if err != nil {
+		return err
+	}
+	newInode := vo.Object.(vfs.Inode)
+	newInode.Type = vfs.InodeSymlinkType
+	// Permissions of symlink are never checked, target decides
+	newInode.Mode = vfs.ModePerm
+	newInode.SetOwnership(fs.Identity, *parentMutableInode.Inode)
+
+	symlinkMutableInode := vfs.MutableInode{
+		Inode:    &newInode,
+		InodePtr: vfs.VolumePtrToInodePtr(fs.Superblock, vo.VolumePtr),
+	}
+	err = symlinkMutableInode.WriteSymlinkTarget(tx, fs.Superblock, fs.Identity, target)
+	if err != nil {
+		return err
+	}
+
+	err = vfs.AppendDirectoryEntries(tx, fs.Superblock, fs.Identity, parentMutableInode,
+		vfs.NewDirectoryEntry(name, symlinkMutableInode.InodePtr))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Readlink returns target of symbolic link
+func Readlink(fs vfs.Filesystem, path string) (string, error) {
+	mutableInode, err := getInodeByPathRecursivelyNoFollow(fs, path)
+	if err != nil {
+		return "", err
+	}
+
+	if !mutableInode.Inode.IsSymlink() {
+		return "", vfs.NotSymlink{Name: path}
+	}
+
+	return mutableInode.Inode.ReadSymlinkTarget(fs.Volume, fs.Superblock)
+}
+
+// Lstat returns information about file, symlink in the last path fragment
+// isn't followed
+func Lstat(fs vfs.Filesystem, path string) (FileInfo, error) {
+	pathFragments := splitString(path, "/")
+	name := pathFragments[len(pathFragments)-1]
+
+	mutableInode, err := getInodeByPathRecursivelyNoFollow(fs, path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return newFileInfo(name, mutableInode), nil
+}
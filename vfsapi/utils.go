@@ -6,29 +6,60 @@ import (
 )
 
 func getInodeByPathRecursively(fs vfs.Filesystem, path string) (vfs.MutableInode, error) {
+	hops := 0
+	return resolvePath(fs, startInodePtr(fs, fs.CurrentInodePtr, path), path, true, &hops)
+}
+
+// getInodeByPathRecursivelyNoFollow works like getInodeByPathRecursively, but
+// symlink in the last path fragment is returned itself instead of its target
+func getInodeByPathRecursivelyNoFollow(fs vfs.Filesystem, path string) (vfs.MutableInode, error) {
+	hops := 0
+	return resolvePath(fs, startInodePtr(fs, fs.CurrentInodePtr, path), path, false, &hops)
+}
+
+func getInodeByPathFromInodeRecursively(fs vfs.Filesystem, currentInodePtr vfs.InodePtr, path string) (vfs.MutableInode, error) {
+	hops := 0
+	return resolvePath(fs, currentInodePtr, path, true, &hops)
+}
+
+func startInodePtr(fs vfs.Filesystem, relativeTo vfs.InodePtr, path string) vfs.InodePtr {
 	if len(path) >= 1 && path[0] == '/' {
 		// Absolute path
-		return getInodeByPathFromInodeRecursively(fs, fs.RootInodePtr, path)
-	} else {
-		// Relative path
-		return getInodeByPathFromInodeRecursively(fs, fs.CurrentInodePtr, path)
+		return fs.RootInodePtr
 	}
+
+	// Relative path
+	return relativeTo
 }
 
-func getInodeByPathFromInodeRecursively(fs vfs.Filesystem, currentInodePtr vfs.InodePtr, path string) (vfs.MutableInode, error) {
+// resolvePath walks path from given inode. Symlinks are followed, hops counts
+// followed symlinks across nested resolutions of their targets.
+func resolvePath(fs vfs.Filesystem, currentInodePtr vfs.InodePtr, path string, followLast bool, hops *int) (vfs.MutableInode, error) {
 	pathFragments := splitString(path, "/")
 
-	currentMutableInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, currentInodePtr)
+	lastFragmentIndex := -1
+	for i, pathFragment := range pathFragments {
+		if len(pathFragment) != 0 {
+			lastFragmentIndex = i
+		}
+	}
+
+	currentInode, err := vfs.LoadMutableInode(fs.Volume, fs.Superblock, currentInodePtr)
 	if err != nil {
 		return vfs.MutableInode{}, err
 	}
 
-	currentInode := currentMutableInode
-	for _, pathFragment := range pathFragments {
+	for i, pathFragment := range pathFragments {
 		if len(pathFragment) == 0 {
 			continue
 		}
 
+		// Searching directory requires execute permission
+		err = checkAccess(fs, currentInode, vfs.PermissionExecute, path)
+		if err != nil {
+			return vfs.MutableInode{}, err
+		}
+
 		_, directoryEntry, err := vfs.FindDirectoryEntryByName(fs.Volume, fs.Superblock, *currentInode.Inode, pathFragment)
 		if err != nil {
 			return vfs.MutableInode{}, err
@@ -39,6 +70,24 @@ func getInodeByPathFromInodeRecursively(fs vfs.Filesystem, currentInodePtr vfs.I
 			return vfs.MutableInode{}, err
 		}
 
+		if mutableInode.Inode.IsSymlink() && (followLast || i != lastFragmentIndex) {
+			*hops++
+			if *hops > vfs.MaxSymlinkHops {
+				return vfs.MutableInode{}, vfs.TooManySymlinks{Path: path}
+			}
+
+			target, err := mutableInode.Inode.ReadSymlinkTarget(fs.Volume, fs.Superblock)
+			if err != nil {
+				return vfs.MutableInode{}, err
+			}
+
+			// Relative target is resolved from directory containing the symlink
+			mutableInode, err = resolvePath(fs, startInodePtr(fs, currentInode.InodePtr, target), target, true, hops)
+			if err != nil {
+				return vfs.MutableInode{}, err
+			}
+		}
+
 		currentInode = mutableInode
 	}
 
@@ -61,7 +110,7 @@ func cToGoString(data []byte) string {
 
 func splitString(s string, sep string) []string {
 	absolute := false
-	if s[0] == '/' {
+	if len(s) > 0 && s[0] == '/' {
 		absolute = true
 	}
 
@@ -0,0 +1,136 @@
+package vfsapi
+
+import (
+	"github.com/PapiCZ/kiv_zos/vfs"
+)
+
+func Getxattr(fs vfs.Filesystem, path, name string) ([]byte, error) {
+	mutableInode, err := getInodeByPathRecursively(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkAccess(fs, mutableInode, vfs.PermissionRead, path)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs, err := mutableInode.ReadXattrs(fs.Volume, fs.Superblock)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, xattr := range xattrs {
+		if xattr.Name == name {
+			return xattr.Value, nil
+		}
+	}
+
+	return nil, vfs.XattrNotFound{Name: name}
+}
+
+// Setxattr creates extended attribute or replaces value of existing one
+func Setxattr(fs vfs.Filesystem, path, name string, value []byte) error {
+	err := vfs.ValidateXattrName(name)
+	if err != nil {
+		return err
+	}
+
+	mutableInode, err := getInodeByPathRecursively(fs, path)
+	if err != nil {
+		return err
+	}
+
+	err = checkAccess(fs, mutableInode, vfs.PermissionWrite, path)
+	if err != nil {
+		return err
+	}
+
+	xattrs, err := mutableInode.ReadXattrs(fs.Volume, fs.Superblock)
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i := range xattrs {
+		if xattrs[i].Name == name {
+			xattrs[i].Value = value
+			replaced = true
+		}
+	}
+
+	if !replaced {
+		xattrs = append(xattrs, vfs.Xattr{Name: name, Value: value})
+	}
+
+	tx := vfs.BeginTransaction(fs.Volume, fs.Superblock)
+
+	err = mutableInode.WriteXattrs(tx, fs.Superblock, fs.Identity, xattrs)
+	if err != nil {
+		switch err.(type) {
+		case vfs.NoXattrSpace:
+			return vfs.NoXattrSpace{Name: name}
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Listxattr returns names of all extended attributes in order of creation
+func Listxattr(fs vfs.Filesystem, path string) ([]string, error) {
+	mutableInode, err := getInodeByPathRecursively(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkAccess(fs, mutableInode, vfs.PermissionRead, path)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs, err := mutableInode.ReadXattrs(fs.Volume, fs.Superblock)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(xattrs))
+	for _, xattr := range xattrs {
+		names = append(names, xattr.Name)
+	}
+
+	return names, nil
+}
+
+func Removexattr(fs vfs.Filesystem, path, name string) error {
+	mutableInode, err := getInodeByPathRecursively(fs, path)
+	if err != nil {
+		return err
+	}
+
+	err = checkAccess(fs, mutableInode, vfs.PermissionWrite, path)
+	if err != nil {
+		return err
+	}
+
+	xattrs, err := mutableInode.ReadXattrs(fs.Volume, fs.Superblock)
+	if err != nil {
+		return err
+	}
+
+	for i, xattr := range xattrs {
+		if xattr.Name == name {
+			tx := vfs.BeginTransaction(fs.Volume, fs.Superblock)
+
+			err = mutableInode.WriteXattrs(tx, fs.Superblock, fs.Identity, append(xattrs[:i], xattrs[i+1:]...))
+			if err != nil {
+				return err
+			}
+
+			return tx.Commit()
+		}
+	}
+
+	return vfs.XattrNotFound{Name: name}
+}